@@ -98,6 +98,10 @@ func (p *Reader) parseArray() (Value, error) {
 		return val, err
 	}
 
+	if len == -1 {
+		return NullValue{}, nil
+	}
+
 	val.Val = make([]Value, len)
 
 	for i := 0; i < int(len); i++ {
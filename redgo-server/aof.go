@@ -1,90 +1,805 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Aof struct {
-	file   *os.File
-	parser *Reader
-	mutex  sync.Mutex
+	// file is the last incremental file, the one written to.
+	file  *os.File
+	mutex sync.Mutex
+	// closed stops the goroutine syncing the file.
+	closed chan struct{}
+
+	// buffer holds the commands that couldn't be written, which are written
+	// again before anything else.
+	buffer []byte
+	// size is the length of the file, and syncedSize the part of it known to
+	// be on the disk.
+	size       int64
+	syncedSize int64
+	// writeErr is the error of the last write, or nil if it succeeded. Write
+	// commands are refused until a write succeeds again.
+	writeErr error
+	// lastFsync is when the file was last synced, and fsyncStart when the sync
+	// running in the background started, if one is.
+	lastFsync  time.Time
+	fsyncStart time.Time
+	// delayedFsyncs counts the writes that went ahead while a background sync
+	// was taking too long.
+	delayedFsyncs int
+
+	// dir holds the files listed by the manifest, see aof_manifest.go.
+	dir      string
+	manifest *aofManifest
+	// restSize is the length of the files other than the one written to.
+	restSize int64
+	// baseSize is the length of the AOF when it was last rewritten, or when
+	// the server started, which auto-aof-rewrite-percentage is relative to.
+	baseSize int64
+	// rewriteStart is when the rewrite in progress started, if one is. See
+	// StartRewrite.
+	rewriteStart        time.Time
+	rewrites            int
+	lastRewriteErr      error
+	lastRewriteDuration time.Duration
+	lastRewriteEnd      time.Time
 }
 
-func NewAof(path string) (*Aof, error) {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+// A write waits at most this long for a background sync, like in Redis, before
+// being counted as delayed.
+const aofFsyncDelay = 2 * time.Second
 
+// NewAof opens the AOF in dir, creating it if needed, to load it with Read.
+func NewAof(dir string) (*Aof, error) {
+	manifest, err := openAofManifest(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	aof := &Aof{
-		file:   file,
-		parser: NewReader(file),
+	return &Aof{
+		closed:   make(chan struct{}),
+		dir:      dir,
+		manifest: manifest,
+	}, nil
+}
+
+// open opens the last incremental file for writing, and starts syncing it in
+// the background. A new one is created if there's none, or if the last one
+// was written without checksums, which can't be added to it afterwards.
+func (a *Aof) open() error {
+	checksummed := false
+	if len(a.manifest.incrs) > 0 {
+		incr := a.manifest.incrs[len(a.manifest.incrs)-1]
+
+		var err error
+		if checksummed, err = fileStartsWith(filepath.Join(a.dir, incr.name), aofChecksumsHeader); err != nil {
+			return err
+		}
 	}
 
+	if !checksummed {
+		if err := a.openNewIncr(); err != nil {
+			return err
+		}
+	} else {
+		incr := a.manifest.incrs[len(a.manifest.incrs)-1]
+
+		file, err := os.OpenFile(filepath.Join(a.dir, incr.name), os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		a.file = file
+		a.size = info.Size()
+		a.syncedSize = a.size
+	}
+
+	for _, info := range a.manifest.files()[:len(a.manifest.files())-1] {
+		stat, err := os.Stat(filepath.Join(a.dir, info.name))
+		if err != nil {
+			return err
+		}
+
+		a.restSize += stat.Size()
+	}
+
+	a.baseSize = a.restSize + a.size
+	a.lastFsync = time.Now()
+
+	// Every second, write again what a failed write left in the buffer, sync
+	// the file if appendfsync is everysec, and rewrite it if it grew enough.
 	go func() {
-		for {
-			aof.mutex.Lock()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 
-			aof.file.Sync()
+		for {
+			select {
+			case <-ticker.C:
+				a.retryWrite()
 
-			aof.mutex.Unlock()
+				if serverConfig().AppendFsync == "everysec" {
+					a.backgroundSync()
+				}
 
-			// Sleep for a while to avoid busy waiting
-			time.Sleep(time.Second)
+				a.rewriteIfGrown()
+			case <-a.closed:
+				return
+			}
 		}
 	}()
 
-	return aof, nil
+	return nil
 }
 
-func (a *Aof) Write(data Value) error {
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
+// openNewIncr starts writing to a new incremental file, once the manifest
+// lists it. The previous one is synced first, as it's never written again.
+// The caller must hold the mutex, if the AOF is open.
+func (a *Aof) openNewIncr() error {
+	if a.file != nil {
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	manifest := a.manifest.withIncr(serverConfig().AppendFilename)
+	path := filepath.Join(a.dir, manifest.incrs[len(manifest.incrs)-1].name)
 
-	_, err := a.file.Write(data.Marshal())
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
 
+	if _, err := file.WriteString(aofChecksumsHeader); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err := persistAofManifest(a.dir, manifest); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if a.file != nil {
+		a.file.Close()
+	}
+
+	a.file = file
+	a.manifest = manifest
+	a.restSize += a.size
+	a.size = int64(len(aofChecksumsHeader))
+	a.syncedSize = 0
+
 	return nil
 }
 
-func (a *Aof) Read() error {
+// Commands run one at a time with the keyspace locked, so a single buffer is
+// enough to collect what the running command appends to the AOF.
+var (
+	pendingPropagation          []Value
+	commandPropagationPrevented bool
+)
+
+// alsoPropagate queues a command to be appended to the AOF once the running
+// command completes.
+func alsoPropagate(args ...Value) {
+	pendingPropagation = append(pendingPropagation, ArrayValue{Val: args})
+}
+
+// preventCommandPropagation keeps the running command out of the AOF, leaving
+// only what it queued with alsoPropagate, e.g. a BLPOP that was served right
+// away is logged as an LPOP. Write commands that end up changing nothing call
+// it too, as whatever is propagated counts as a change to the dataset, see
+// flushPropagation.
+func preventCommandPropagation() {
+	commandPropagationPrevented = true
+}
+
+// flushPropagation appends the queued commands to the AOF, or discards them if aof is nil.
+// Every change to the dataset is propagated, so this is also where the changes
+// since the last snapshot are counted.
+func flushPropagation(aof *Aof) error {
+	commands := pendingPropagation
+
+	pendingPropagation = nil
+	commandPropagationPrevented = false
+
+	for _, command := range commands {
+		argv := command.(ArrayValue).Val
+		if name := strings.ToUpper(argv[0].(BulkStringValue).Val); name != "MULTI" && name != "EXEC" {
+			dirty++
+		}
+	}
+
+	if aof == nil || len(commands) == 0 {
+		return nil
+	}
+
+	return aof.Write(commands...)
+}
+
+// aofWriteErrorReply is the reply to a write command run while the AOF can't
+// be written, see Aof.Write.
+func aofWriteErrorReply(err error) Value {
+	return ErrorValue{Val: "MISCONF Errors writing to the AOF file: " + err.Error()}
+}
+
+// Write appends the commands to the file, followed by their checksum, and
+// syncs it if appendfsync is always. If that fails the commands stay in the
+// buffer, to be written again with the next ones or by the background
+// goroutine, and the error is returned until a write succeeds.
+func (a *Aof) Write(commands ...Value) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	start := len(a.buffer)
+	for _, command := range commands {
+		a.buffer = append(a.buffer, command.Marshal()...)
+	}
+	a.buffer = appendAofChecksum(a.buffer, a.buffer[start:])
+
+	return a.flush()
+}
+
+// appendAofChecksum appends the annotation holding the checksum of the
+// commands written since the previous one, like #CRC:1c291ca3. It lets
+// corruption be told apart from commands cut short by a crash.
+func appendAofChecksum(buf, commands []byte) []byte {
+	return fmt.Appendf(buf, "#CRC:%08x\r\n", crc32.ChecksumIEEE(commands))
+}
+
+// Files of the AOF holding checksums start with the checksum of nothing.
+const aofChecksumsHeader = "#CRC:00000000\r\n"
+
+// flush writes the buffer to the file. The caller must hold the mutex.
+func (a *Aof) flush() error {
+	policy := serverConfig().AppendFsync
+
+	if policy == "everysec" && !a.fsyncStart.IsZero() && time.Since(a.fsyncStart) > aofFsyncDelay {
+		a.delayedFsyncs++
+		serverLog(LOG_NOTICE, "Asynchronous AOF fsync is taking too long (disk is busy?). Writing the AOF buffer without waiting for fsync to complete, this may slow down RedGo.")
+	}
+
+	if len(a.buffer) > 0 {
+		n, err := a.file.Write(a.buffer)
+		if err != nil {
+			// Remove what was written of the buffer, as it's written again in full.
+			if n > 0 {
+				if truncateErr := a.file.Truncate(a.size); truncateErr != nil {
+					serverLog(LOG_WARNING, "Could not remove short write from the append-only file. RedGo may refuse to load the AOF the next time it starts. ftruncate: %v", truncateErr)
+					a.size += int64(n)
+					a.buffer = a.buffer[n:]
+				}
+			}
+
+			return a.setWriteError(err)
+		}
+
+		a.size += int64(n)
+		a.buffer = a.buffer[:0]
+	}
+
+	if policy == "always" {
+		if err := a.file.Sync(); err != nil {
+			return a.setWriteError(err)
+		}
+
+		a.lastFsync = time.Now()
+		a.syncedSize = a.size
+	}
+
+	if a.writeErr != nil {
+		serverLog(LOG_WARNING, "AOF write error looks solved, RedGo can write again.")
+		a.writeErr = nil
+	}
+
+	return nil
+}
+
+func (a *Aof) setWriteError(err error) error {
+	if a.writeErr == nil {
+		serverLog(LOG_WARNING, "Error writing to the AOF file: %v", err)
+	}
+
+	a.writeErr = err
+
+	return err
+}
+
+// retryWrite writes again what a failed write left in the buffer.
+func (a *Aof) retryWrite() {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
+	if a.writeErr != nil {
+		a.flush()
+	}
+}
+
+// WriteError returns the error of the last write, or nil if it succeeded.
+func (a *Aof) WriteError() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.writeErr
+}
+
+// backgroundSync syncs what was written since the last sync, without holding
+// the mutex so that writes can go on meanwhile.
+func (a *Aof) backgroundSync() {
+	a.mutex.Lock()
+	file, size := a.file, a.size
+	if size == a.syncedSize {
+		a.mutex.Unlock()
+		return
+	}
+	a.fsyncStart = time.Now()
+	a.mutex.Unlock()
+
+	err := file.Sync()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.fsyncStart = time.Time{}
+
+	// A rewrite may have moved on to a new incremental file meanwhile, after
+	// syncing this one.
+	if file != a.file {
+		return
+	}
+
+	if err != nil {
+		serverLog(LOG_WARNING, "Error syncing the AOF file: %v", err)
+		return
+	}
+
+	a.lastFsync = time.Now()
+	a.syncedSize = size
+}
+
+// persistenceInfo returns the AOF fields of the persistence section of INFO.
+func (a *Aof) persistenceInfo() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	status := "ok"
+	if a.writeErr != nil {
+		status = "err"
+	}
+
+	pendingFsync := 0
+	if !a.fsyncStart.IsZero() {
+		pendingFsync = 1
+	}
+
+	rewriteStatus := "ok"
+	if a.lastRewriteErr != nil {
+		rewriteStatus = "err"
+	}
+
+	rewriting, currentRewriteTime := 0, -1
+	if !a.rewriteStart.IsZero() {
+		rewriting, currentRewriteTime = 1, int(time.Since(a.rewriteStart).Seconds())
+	}
+
+	lastRewriteTime := -1
+	if a.rewrites > 0 || a.lastRewriteErr != nil {
+		lastRewriteTime = int(a.lastRewriteDuration.Seconds())
+	}
+
+	return []string{
+		"aof_rewrite_in_progress:" + strconv.Itoa(rewriting),
+		"aof_last_rewrite_time_sec:" + strconv.Itoa(lastRewriteTime),
+		"aof_current_rewrite_time_sec:" + strconv.Itoa(currentRewriteTime),
+		"aof_last_bgrewrite_status:" + rewriteStatus,
+		"aof_rewrites:" + strconv.Itoa(a.rewrites),
+		"aof_last_write_status:" + status,
+		"aof_current_size:" + strconv.FormatInt(a.restSize+a.size, 10),
+		"aof_base_size:" + strconv.FormatInt(a.baseSize, 10),
+		"aof_buffer_length:" + strconv.Itoa(len(a.buffer)),
+		"aof_pending_bio_fsync:" + strconv.Itoa(pendingFsync),
+		"aof_last_fsync_time:" + strconv.FormatInt(a.lastFsync.Unix(), 10),
+		"aof_delayed_fsync:" + strconv.Itoa(a.delayedFsyncs),
+	}
+}
+
+// Read loads the files of the AOF in order. Only the last one can end with
+// an incomplete command or transaction, cut short by a crash, as the others
+// were synced before the next one was started. If aof-load-truncated is yes,
+// it's truncated to the last complete one, so that nothing is written after
+// the incomplete one, otherwise the AOF isn't loaded.
+func (a *Aof) Read() error {
+	DB.Lock()
+	defer DB.Unlock()
+
+	client := newAofClient()
+
+	files := a.manifest.files()
+	for i, info := range files {
+		path := filepath.Join(a.dir, info.name)
+		last := i == len(files)-1
+
+		snapshot, err := fileStartsWith(path, rdbMagic)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("The AOF file %s doesn't exist", info.name)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.typ == AOF_FILE_TYPE_BASE && snapshot {
+			if err := a.loadSnapshot(path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		good, err := scanAofFile(path, func(commands [][]Value) {
+			for _, argv := range commands {
+				replayAofCommand(client, argv)
+			}
+			serveClientsBlockedOnKeys(nil)
+		})
+
+		switch {
+		case err == nil:
+		case !isAofTruncated(err):
+			return fmt.Errorf("Bad file format reading the append only file %s: %v. Make a backup of your AOF, then use ./redgo-check-aof --fix %s", info.name, err, aofManifestPath(a.dir))
+		case !last:
+			return fmt.Errorf("Unexpected end of file reading the append only file %s, which isn't the last one: %v", info.name, err)
+		case !serverConfig().AofLoadTruncated:
+			return fmt.Errorf("Unexpected end of file reading the append only file %s: %v. You can: 1) Make a backup of your AOF, then use ./redgo-check-aof --fix %s. 2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server.", info.name, err, aofManifestPath(a.dir))
+		default:
+			serverLog(LOG_WARNING, "!!! Warning: short read while loading the AOF file %s: %v!!!", info.name, err)
+			serverLog(LOG_WARNING, "AOF %s loaded anyway because aof-load-truncated is enabled, truncating it to its last %d good bytes", info.name, good)
+
+			if err := os.Truncate(path, good); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Replaying the file isn't a change since the last snapshot.
+	dirty = 0
+
+	return nil
+}
+
+// newAofClient returns the client replaying the AOF. It isn't connected, so
+// it has no reply writer and can't block, and it keeps the transaction state
+// of the commands replayed like any client.
+func newAofClient() *Client {
+	return &Client{
+		ID:            "aof",
+		Subscriptions: make(map[string]*PubSubChannel),
+		Authenticated: true,
+	}
+}
+
+// replayAofCommand runs a command read from the AOF as the client that
+// wrote it did, queuing it if it's part of a transaction. The AOF only holds
+// commands that succeeded, so the reply is dropped.
+func replayAofCommand(client *Client, argv []Value) {
+	command := strings.ToUpper(argv[0].(BulkStringValue).Val)
+
+	if _, queued := queueMultiCommand(client, command, argv[1:]); queued {
+		return
+	}
+
+	call(command, argv[1:], client, nil)
+}
+
+// fileStartsWith tells whether a file starts with prefix, e.g. whether a base
+// file was written as a snapshot rather than as commands.
+func fileStartsWith(path, prefix string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	start := make([]byte, len(prefix))
+	n, _ := io.ReadFull(file, start)
+
+	return string(start[:n]) == prefix, nil
+}
+
+// loadSnapshot loads a base file written as a snapshot.
+func (a *Aof) loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := rdbDecodeDataset(data); err != nil {
+		return fmt.Errorf("Error reading the snapshot preamble of the append only file %s: %v", filepath.Base(path), err)
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes and the lines read through it.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+	lines  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	r.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
+}
+
+// A file cut short by a crash ends with one of these errors.
+var (
+	errAofShortRead             = errors.New("the file ends with an incomplete command")
+	errAofIncompleteTransaction = errors.New("the file ends with a transaction without its EXEC")
+)
+
+func isAofTruncated(err error) bool {
+	return err == errAofShortRead || err == errAofIncompleteTransaction
+}
+
+// aofRecord is a command read from the AOF, with where it starts in the file.
+type aofRecord struct {
+	argv   []Value
+	offset int64
+	line   int64
+}
+
+func (r aofRecord) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s at offset %d, line %d", fmt.Sprintf(format, args...), r.offset, r.line)
+}
+
+// checkAofCommand tells what's wrong with a command read from the AOF, which
+// only holds commands that modify the dataset, and the MULTI and EXEC around
+// transactions.
+func checkAofCommand(record aofRecord) error {
+	name := strings.ToUpper(record.argv[0].(BulkStringValue).Val)
+
+	cmd, found := Handlers[name]
+	switch {
+	case !found:
+		return record.errorf("unknown command '%s'", record.argv[0].(BulkStringValue).Val)
+	case !cmd.checkArity(len(record.argv)):
+		return record.errorf("wrong number of arguments for '%s' command", strings.ToLower(name))
+	case !cmd.Write && name != "MULTI" && name != "EXEC":
+		return record.errorf("'%s' doesn't modify the dataset and can't be replayed", strings.ToLower(name))
+	}
+
+	return nil
+}
+
+// scanAofFile reads the commands of a file, passing each one to run, or the
+// commands of a transaction together, from its MULTI to its EXEC, once the
+// EXEC is read. run may be nil to only check the file. It returns the offset
+// up to which the file holds complete commands and transactions, and what's
+// wrong past it if anything. A command that can't be in the AOF is reported
+// with its offset and line, and nothing from it on is run.
+//
+// In a file holding checksums, which starts with aofChecksumsHeader, commands
+// are only run once their checksum is read and matches. Files written
+// without, like the AOF of earlier versions, are read all the same.
+func scanAofFile(path string, run func(commands [][]Value)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	parser := NewReader(counter)
+
+	// position returns the offset and the line of what's parsed next.
+	position := func() (int64, int64) {
+		buffered, _ := parser.reader.Peek(parser.Buffered())
+		return counter.n - int64(len(buffered)), counter.lines - int64(bytes.Count(buffered, []byte{'\n'})) + 1
+	}
+
+	var transaction [][]Value
+	inTransaction := false
+
+	// good is where the last complete command or transaction ends. batch
+	// holds the commands read since the last checksum, and crc is theirs.
+	good := int64(0)
+	checksummed := false
+	var batch []aofRecord
+	crc := crc32.NewIEEE()
+
+	feed := func(record aofRecord) error {
+		switch strings.ToUpper(record.argv[0].(BulkStringValue).Val) {
+		case "MULTI":
+			if inTransaction {
+				return record.errorf("MULTI calls can not be nested")
+			}
+
+			transaction = [][]Value{record.argv}
+			inTransaction = true
+		case "EXEC":
+			if !inTransaction {
+				return record.errorf("EXEC without MULTI")
+			}
+
+			if run != nil {
+				run(append(transaction, record.argv))
+			}
+
+			transaction = nil
+			inTransaction = false
+		default:
+			if inTransaction {
+				transaction = append(transaction, record.argv)
+			} else if run != nil {
+				run([][]Value{record.argv})
+			}
+		}
+
+		return nil
+	}
+
 	for {
-		value, err := a.parser.ParseFromRespString()
+		start, line := position()
 
-		if err == io.EOF {
+		annotation, found, err := parser.ReadAnnotation()
+		if end, _ := position(); err == io.EOF && end == start {
 			break
 		}
 
+		if found {
+			if sum, ok := strings.CutPrefix(annotation, "CRC:"); ok && (checksummed || start == 0) {
+				if sum != fmt.Sprintf("%08x", crc.Sum32()) {
+					first := aofRecord{offset: start, line: line}
+					if len(batch) > 0 {
+						first = batch[0]
+					}
+
+					return good, first.errorf("checksum mismatch for the commands")
+				}
+
+				checksummed = true
+				crc.Reset()
+
+				// The whole batch is checked before any of it runs.
+				for _, record := range batch {
+					if err := checkAofCommand(record); err != nil {
+						return good, err
+					}
+				}
+
+				for _, record := range batch {
+					if err := feed(record); err != nil {
+						return good, err
+					}
+				}
+				batch = nil
+
+				if !inTransaction {
+					good, _ = position()
+				}
+			}
+
+			continue
+		}
+
+		var value Value
+		if err == nil {
+			value, err = parser.ParseFromRespString()
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return good, errAofShortRead
+		}
+
+		argv, ok := value.(ArrayValue)
+		if err == nil && (!ok || len(argv.Val) == 0) {
+			err = errors.New("not a command")
+		}
+
+		for i := 0; err == nil && i < len(argv.Val); i++ {
+			if _, ok := argv.Val[i].(BulkStringValue); !ok {
+				err = errors.New("not a command")
+			}
+		}
+
+		record := aofRecord{argv: argv.Val, offset: start, line: line}
 		if err != nil {
-			return err
+			return good, record.errorf("%v", err)
+		}
+
+		if checksummed {
+			crc.Write(value.Marshal())
+			batch = append(batch, record)
+			continue
+		}
+
+		if err := checkAofCommand(record); err != nil {
+			return good, err
+		}
+
+		if err := feed(record); err != nil {
+			return good, err
 		}
 
-		ProcessCommand(value.(ArrayValue).Val[0].(BulkStringValue).Val, value.(ArrayValue).Val[1:], nil)
+		if !inTransaction {
+			good, _ = position()
+		}
+	}
+
+	// The commands of a batch whose checksum is missing were being written
+	// when the server stopped.
+	if len(batch) > 0 {
+		return good, errAofShortRead
+	}
+
+	if inTransaction {
+		return good, errAofIncompleteTransaction
+	}
+
+	return good, nil
+}
+
+// Sync writes what's left in the buffer and flushes the file to the disk.
+func (a *Aof) Sync() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.flush(); err != nil {
+		return err
+	}
+
+	if err := a.file.Sync(); err != nil {
+		return err
 	}
 
+	a.lastFsync = time.Now()
+	a.syncedSize = a.size
+
 	return nil
 }
 
-func (a *Aof) Close() {
+// Close closes the file, abandoning the rewrite in progress if there's one.
+func (a *Aof) Close() error {
+	close(a.closed)
+
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	a.file.Close()
+	if !a.rewriteStart.IsZero() {
+		os.Remove(a.rewriteTempPath())
+	}
+
+	return a.file.Close()
 }
 
+// InitAof loads the AOF in appenddirname, then opens it for writing.
 func InitAof() (*Aof, error) {
-	fmt.Println("Loading AOF file....")
-	aof, err := NewAof("database.aof")
+	config := serverConfig()
+
+	serverLog(LOG_NOTICE, "Loading AOF file....")
+	aof, err := NewAof(filepath.Join(config.Dir, config.AppendDirname))
 	if err != nil {
 		return nil, err
 	}
@@ -93,7 +808,11 @@ func InitAof() (*Aof, error) {
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("AOF file loaded successfully....")
+	serverLog(LOG_NOTICE, "AOF file loaded successfully....")
+
+	if err := aof.open(); err != nil {
+		return nil, err
+	}
 
 	return aof, nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The AOF is split over several files in the appenddirname directory, like in
+// Redis 7: a base file holding the dataset as of the last rewrite, either as a
+// snapshot or as commands, then incremental files holding the commands written
+// since, in order. Only the last incremental file is written to. The manifest
+// lists them, one per line:
+//
+//	file database.aof.2.base.rdb seq 2 type b
+//	file database.aof.3.incr.aof seq 3 type i
+//	file database.aof.4.incr.aof seq 4 type i
+//
+// It's always replaced as a whole, so the files it lists are consistent.
+const (
+	AOF_FILE_TYPE_BASE = "b"
+	AOF_FILE_TYPE_INCR = "i"
+)
+
+// aofInfo is a file listed in the manifest.
+type aofInfo struct {
+	name string
+	seq  int64
+	typ  string
+}
+
+type aofManifest struct {
+	// base is nil until the first rewrite, unless the AOF was upgraded from a
+	// single file.
+	base  *aofInfo
+	incrs []*aofInfo
+}
+
+// files returns the files of the AOF in the order they're loaded.
+func (m *aofManifest) files() []*aofInfo {
+	if m.base == nil {
+		return m.incrs
+	}
+
+	return append([]*aofInfo{m.base}, m.incrs...)
+}
+
+// withIncr returns a copy of the manifest with a new incremental file.
+func (m *aofManifest) withIncr(prefix string) *aofManifest {
+	seq := int64(1)
+	if len(m.incrs) > 0 {
+		seq = m.incrs[len(m.incrs)-1].seq + 1
+	}
+
+	incr := &aofInfo{name: fmt.Sprintf("%s.%d.incr.aof", prefix, seq), seq: seq, typ: AOF_FILE_TYPE_INCR}
+
+	return &aofManifest{base: m.base, incrs: append(append([]*aofInfo{}, m.incrs...), incr)}
+}
+
+// withBase returns the manifest replacing every file but the last
+// incremental one with a new base, of the given extension. A rewrite always
+// opens a new incremental file first, but without one, every file is replaced.
+func (m *aofManifest) withBase(prefix, ext string) *aofManifest {
+	seq := int64(1)
+	if m.base != nil {
+		seq = m.base.seq + 1
+	}
+
+	base := &aofInfo{name: fmt.Sprintf("%s.%d.base.%s", prefix, seq, ext), seq: seq, typ: AOF_FILE_TYPE_BASE}
+
+	return &aofManifest{base: base, incrs: m.incrs[max(len(m.incrs)-1, 0):]}
+}
+
+func (m *aofManifest) marshal() []byte {
+	var text strings.Builder
+	for _, info := range m.files() {
+		fmt.Fprintf(&text, "file %s seq %d type %s\n", quoteConfigValue(info.name), info.seq, info.typ)
+	}
+
+	return []byte(text.String())
+}
+
+func aofManifestPath(dir string) string {
+	return filepath.Join(dir, serverConfig().AppendFilename+".manifest")
+}
+
+var errInvalidManifest = errors.New("Invalid AOF manifest file format")
+
+// loadAofManifest reads a manifest.
+func loadAofManifest(path string) (*aofManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &aofManifest{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		args, ok := splitArgs([]byte(line))
+		if !ok || len(args)%2 != 0 {
+			return nil, errInvalidManifest
+		}
+
+		info := &aofInfo{}
+		for i := 0; i < len(args); i += 2 {
+			switch value := string(args[i+1]); string(args[i]) {
+			case "file":
+				info.name = value
+			case "seq":
+				if info.seq, err = strconv.ParseInt(value, 10, 64); err != nil {
+					return nil, errInvalidManifest
+				}
+			case "type":
+				info.typ = value
+			}
+		}
+
+		if info.name == "" || strings.ContainsRune(info.name, filepath.Separator) {
+			return nil, errInvalidManifest
+		}
+
+		switch {
+		case info.typ == AOF_FILE_TYPE_BASE && m.base == nil && len(m.incrs) == 0:
+			m.base = info
+		case info.typ == AOF_FILE_TYPE_INCR && (len(m.incrs) == 0 || info.seq > m.incrs[len(m.incrs)-1].seq):
+			m.incrs = append(m.incrs, info)
+		default:
+			return nil, errInvalidManifest
+		}
+	}
+
+	return m, nil
+}
+
+// persistAofManifest replaces the manifest of the AOF in dir.
+func persistAofManifest(dir string, m *aofManifest) error {
+	temp := filepath.Join(dir, "temp-"+serverConfig().AppendFilename+".manifest")
+
+	if err := writeSyncedFile(temp, m.marshal()); err != nil {
+		return err
+	}
+
+	return renameSynced(temp, aofManifestPath(dir))
+}
+
+// openAofManifest reads the manifest of the AOF in dir, creating the directory
+// and the manifest if there's none. An AOF written as a single file by earlier
+// versions becomes the base of the new one.
+func openAofManifest(dir string) (*aofManifest, error) {
+	m, err := loadAofManifest(aofManifestPath(dir))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return m, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	config := serverConfig()
+	legacy := filepath.Join(config.Dir, config.AppendFilename)
+	m = &aofManifest{}
+
+	if _, err := os.Stat(legacy); err == nil {
+		serverLog(LOG_NOTICE, "Upgrading the single file AOF %s to the multi part AOF in %s", legacy, dir)
+
+		// The file is linked into the directory, so that it's never missing
+		// from both places, and only removed once the manifest lists it.
+		m.base = &aofInfo{name: config.AppendFilename + ".1.base.aof", seq: 1, typ: AOF_FILE_TYPE_BASE}
+		base := filepath.Join(dir, m.base.name)
+
+		os.Remove(base)
+		if err := os.Link(legacy, base); err != nil {
+			return nil, err
+		}
+
+		if err := persistAofManifest(dir, m); err != nil {
+			return nil, err
+		}
+
+		if err := os.Remove(legacy); err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	}
+
+	return m, persistAofManifest(dir, m)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Variadic commands are split so that no command of the rewritten file gets
+// too large, like AOF_REWRITE_ITEMS_PER_CMD in Redis.
+const aofRewriteItemsPerCommand = 64
+
+var errRewriteInProgress = errors.New("a rewrite is already in progress")
+
+// aofRewriter builds the commands recreating the dataset, the smallest set it
+// can rather than the history of every write.
+type aofRewriter struct {
+	chunkedBuffer
+	// checked is where the commands not covered by a checksum yet start.
+	checked int
+	now     int64
+}
+
+// emit appends a command to the rewrite.
+func (r *aofRewriter) emit(args ...string) {
+	r.buf = append(r.buf, '*')
+	r.buf = strconv.AppendInt(r.buf, int64(len(args)), 10)
+	r.buf = append(r.buf, '\r', '\n')
+
+	for _, arg := range args {
+		r.buf = append(r.buf, '$')
+		r.buf = strconv.AppendInt(r.buf, int64(len(arg)), 10)
+		r.buf = append(r.buf, '\r', '\n')
+		r.buf = append(r.buf, arg...)
+		r.buf = append(r.buf, '\r', '\n')
+	}
+}
+
+// checksum ends the commands emitted since the last checksum, see
+// appendAofChecksum.
+func (r *aofRewriter) checksum() {
+	if r.checked == len(r.buf) {
+		return
+	}
+
+	r.buf = appendAofChecksum(r.buf, r.buf[r.checked:])
+	r.checked = len(r.buf)
+}
+
+// aofRewriteBatch emits a variadic command, splitting its items over as many
+// commands as needed.
+type aofRewriteBatch struct {
+	r      *aofRewriter
+	prefix []string
+	// width is the number of arguments making an item, e.g. 2 for HSET.
+	width int
+	args  []string
+}
+
+func (r *aofRewriter) batch(width int, prefix ...string) *aofRewriteBatch {
+	return &aofRewriteBatch{r: r, prefix: prefix, width: width}
+}
+
+func (b *aofRewriteBatch) add(item ...string) {
+	b.args = append(b.args, item...)
+
+	if len(b.args) == b.width*aofRewriteItemsPerCommand {
+		b.flush()
+	}
+}
+
+func (b *aofRewriteBatch) flush() {
+	if len(b.args) > 0 {
+		b.r.emit(slices.Concat(b.prefix, b.args)...)
+		b.args = b.args[:0]
+	}
+}
+
+// newAofRewriter starts a rewrite with the commands loading the function
+// libraries. Keys and hash fields already expired when it's created are left
+// out. The keyspace must be locked by the caller.
+func newAofRewriter() *aofRewriter {
+	r := &aofRewriter{now: nowMs()}
+	r.buf = []byte(aofChecksumsHeader)
+	r.checked = len(r.buf)
+
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.emit("FUNCTION", "LOAD", libraries[name].Code)
+	}
+	r.checksum()
+
+	return r
+}
+
+// key emits the commands recreating a key, followed by their checksum.
+func (r *aofRewriter) key(key string, obj *Object, when int64, expires bool) {
+	if expires && when <= r.now {
+		return
+	}
+
+	switch obj.Type {
+	case OBJ_STRING:
+		r.emit("SET", key, obj.Data.(string))
+	case OBJ_LIST:
+		b := r.batch(1, "RPUSH", key)
+		obj.Data.(*Quicklist).Each(func(_ int, value string) bool {
+			b.add(value)
+			return true
+		})
+		b.flush()
+	case OBJ_SET:
+		b := r.batch(1, "SADD", key)
+		for member := range obj.Data.(map[string]struct{}) {
+			b.add(member)
+		}
+		b.flush()
+	case OBJ_ZSET:
+		b := r.batch(2, "ZADD", key)
+		for member, score := range obj.Data.(*SortedSet).dict {
+			b.add(formatScore(score), member)
+		}
+		b.flush()
+	case OBJ_HASH:
+		if !r.rewriteHash(key, obj.Data.(*Hash)) {
+			return
+		}
+	case OBJ_STREAM:
+		r.rewriteStream(key, obj.Data.(*Stream))
+	}
+
+	if expires {
+		r.emit("PEXPIREAT", key, strconv.FormatInt(when, 10))
+	}
+
+	r.checksum()
+	if r.cut() {
+		r.checked = 0
+	}
+}
+
+// finish returns the commands emitted.
+func (r *aofRewriter) finish() []byte {
+	return r.bytes()
+}
+
+// rewriteHash emits the fields of the hash that didn't expire, then their
+// expirations, one HPEXPIREAT per expiration time. It returns false if every
+// field expired, in which case nothing is emitted.
+func (r *aofRewriter) rewriteHash(key string, h *Hash) bool {
+	b := r.batch(2, "HSET", key)
+	fieldsByExpire := make(map[int64][]string)
+	live := 0
+
+	for field, value := range h.fields {
+		when, expires := h.GetExpire(field)
+		if expires && when <= r.now {
+			continue
+		}
+
+		b.add(field, value)
+		live++
+
+		if expires {
+			fieldsByExpire[when] = append(fieldsByExpire[when], field)
+		}
+	}
+
+	if live == 0 {
+		return false
+	}
+	b.flush()
+
+	for when, fields := range fieldsByExpire {
+		for len(fields) > 0 {
+			chunk := fields[:min(len(fields), aofRewriteItemsPerCommand)]
+			fields = fields[len(chunk):]
+
+			r.emit(slices.Concat([]string{"HPEXPIREAT", key, strconv.FormatInt(when, 10), "FIELDS", strconv.Itoa(len(chunk))}, chunk)...)
+		}
+	}
+
+	return true
+}
+
+// rewriteStream emits the entries of the stream, its last ID and its consumer
+// groups with their consumers and pending entries.
+func (r *aofRewriter) rewriteStream(key string, s *Stream) {
+	for _, entry := range s.entries {
+		r.emit(slices.Concat([]string{"XADD", key, entry.ID.String()}, entry.Fields)...)
+	}
+
+	// An empty stream is created by adding an entry and trimming it right away,
+	// the last ID being set next.
+	if len(s.entries) == 0 {
+		r.emit("XADD", key, "MAXLEN", "0", "0-1", "x", "y")
+	}
+
+	if len(s.entries) == 0 || s.entries[len(s.entries)-1].ID != s.lastID {
+		r.emit("XSETID", key, s.lastID.String())
+	}
+
+	for name, g := range s.groups {
+		r.emit("XGROUP", "CREATE", key, name, g.lastID.String())
+
+		for _, consumer := range g.consumers {
+			r.emit("XGROUP", "CREATECONSUMER", key, name, consumer.name)
+		}
+
+		for id, pe := range g.pel {
+			r.emit(streamClaimArgs(key, name, g, id, pe)...)
+		}
+	}
+}
+
+// bgrewriteaof rewrites the AOF in the background, see Aof.StartRewrite.
+func bgrewriteaof(_ []Value, _ *Client) Value {
+	if serverAof == nil {
+		return ErrorValue{Val: "ERR Background append only file rewriting needs appendonly to be enabled"}
+	}
+
+	if err := serverAof.StartRewrite(); err != nil {
+		if err == errRewriteInProgress {
+			return ErrorValue{Val: "ERR Background append only file rewriting already in progress"}
+		}
+
+		return ErrorValue{Val: "ERR " + err.Error()}
+	}
+
+	return StringValue{Val: "Background append only file rewriting started"}
+}
+
+// StartRewrite starts replacing the files of the AOF with a new base, holding
+// the dataset as it is now: commands are written to a new incremental file
+// from now on, while a snapshot of the dataset is encoded and written in the
+// background, see datasetSnapshot. Once the base is complete, the manifest
+// lists it and the new incremental file only. The keyspace must be locked by
+// the caller.
+func (a *Aof) StartRewrite() error {
+	a.mutex.Lock()
+
+	select {
+	case <-a.closed:
+		a.mutex.Unlock()
+		return errors.New("the AOF is closed")
+	default:
+	}
+
+	if !a.rewriteStart.IsZero() {
+		a.mutex.Unlock()
+		return errRewriteInProgress
+	}
+
+	if err := a.openNewIncr(); err != nil {
+		a.mutex.Unlock()
+		return err
+	}
+
+	a.rewriteStart = time.Now()
+
+	a.mutex.Unlock()
+
+	serverLog(LOG_NOTICE, "Background append only file rewriting started")
+
+	// Nothing can be written until the keyspace is unlocked, so the new
+	// incremental file starts right where the snapshot ends.
+	if serverConfig().AofUseRdbPreamble {
+		go a.rewrite(DB.startSnapshot(newRdbEncoder()), "rdb")
+	} else {
+		go a.rewrite(DB.startSnapshot(newAofRewriter()), "aof")
+	}
+
+	return nil
+}
+
+// rewriteTempPath is where the new base is written until it's complete.
+func (a *Aof) rewriteTempPath() string {
+	return filepath.Join(a.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+}
+
+// rewrite encodes the snapshot and writes it as the new base, with the given
+// extension.
+func (a *Aof) rewrite(snapshot *datasetSnapshot, ext string) {
+	data := snapshot.encode()
+
+	temp := a.rewriteTempPath()
+	err := writeSyncedFile(temp, data)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err == nil {
+		err = a.finishRewrite(temp, ext, int64(len(data)))
+	}
+
+	if err != nil {
+		os.Remove(temp)
+		serverLog(LOG_WARNING, "Background AOF rewrite terminated with error: %v", err)
+	} else {
+		serverLog(LOG_NOTICE, "Background AOF rewrite finished successfully")
+		a.rewrites++
+	}
+
+	a.lastRewriteErr = err
+	a.lastRewriteDuration = time.Since(a.rewriteStart)
+	a.lastRewriteEnd = time.Now()
+	a.rewriteStart = time.Time{}
+}
+
+// finishRewrite puts the new base in place and lists it in the manifest, then
+// removes the files it replaces. The caller must hold the mutex.
+func (a *Aof) finishRewrite(temp, ext string, size int64) error {
+	select {
+	case <-a.closed:
+		return errors.New("the AOF was closed")
+	default:
+	}
+
+	manifest := a.manifest.withBase(serverConfig().AppendFilename, ext)
+	path := filepath.Join(a.dir, manifest.base.name)
+
+	if err := renameSynced(temp, path); err != nil {
+		return err
+	}
+
+	if err := persistAofManifest(a.dir, manifest); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	for _, info := range a.manifest.files()[:len(a.manifest.files())-1] {
+		serverLog(LOG_NOTICE, "Removing the history file %s", info.name)
+		os.Remove(filepath.Join(a.dir, info.name))
+	}
+
+	a.manifest = manifest
+	a.restSize = size
+	a.baseSize = a.restSize + a.size
+
+	return nil
+}
+
+// rewriteIfGrown starts a rewrite once the file has grown by
+// auto-aof-rewrite-percentage since it was last rewritten, or since the server
+// started, as long as it's at least auto-aof-rewrite-min-size. After a failed
+// rewrite, it waits a minute before trying again.
+func (a *Aof) rewriteIfGrown() {
+	config := serverConfig()
+
+	a.mutex.Lock()
+	size, base := a.restSize+a.size, a.baseSize
+	busy := !a.rewriteStart.IsZero() || (a.lastRewriteErr != nil && time.Since(a.lastRewriteEnd) < time.Minute)
+	a.mutex.Unlock()
+
+	if busy || config.AutoAofRewritePercentage == 0 || size < config.AutoAofRewriteMinSize {
+		return
+	}
+
+	growth := (size*100)/max(base, 1) - 100
+	if growth < int64(config.AutoAofRewritePercentage) {
+		return
+	}
+
+	serverLog(LOG_NOTICE, "Starting automatic rewriting of AOF on %d%% growth", growth)
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	a.StartRewrite()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// aofBatch returns commands as written by Aof.Write, followed by their checksum.
+func aofBatch(commands ...string) string {
+	var data []byte
+	for _, command := range commands {
+		args := []Value{}
+		for _, arg := range strings.Fields(command) {
+			args = append(args, BulkStringValue{Val: arg})
+		}
+		data = append(data, ArrayValue{Val: args}.Marshal()...)
+	}
+
+	return string(appendAofChecksum(data, data))
+}
+
+// useTempDir makes a temporary directory the dir of the configuration until
+// the test ends, so that the files the server looks for in it, like the
+// single file AOF of earlier versions, are the test's own.
+func useTempDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	previous := serverConfig()
+	t.Cleanup(func() { currentConfig.Store(previous) })
+
+	config := *previous
+	config.Dir = dir
+	currentConfig.Store(&config)
+
+	return dir
+}
+
+// TestScanAofFile checks which commands of a file are run, and the offset up
+// to which it's found good, when it's complete, cut short, corrupted or holds
+// commands that can't be replayed.
+func TestScanAofFile(t *testing.T) {
+	set1, set2 := aofBatch("SET a 1"), aofBatch("SET b 2")
+	transaction := aofBatch("MULTI", "SET c 3", "EXEC")
+	plainSet, plainMulti := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n", "*1\r\n$5\r\nMULTI\r\n"
+
+	tests := []struct {
+		name    string
+		data    string
+		run     []string
+		good    int
+		wantErr string
+	}{
+		{"complete", aofChecksumsHeader + set1 + transaction,
+			[]string{"SET a 1", "MULTI", "SET c 3", "EXEC"}, len(aofChecksumsHeader + set1 + transaction), ""},
+		{"torn command", aofChecksumsHeader + set1 + set2[:10],
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "incomplete command"},
+		{"missing checksum", aofChecksumsHeader + set1 + set2[:strings.IndexByte(set2, '#')],
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "incomplete command"},
+		{"corrupted", aofChecksumsHeader + set1 + strings.Replace(set2, "$1\r\nb", "$1\r\nx", 1) + transaction,
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "checksum mismatch for the commands at offset 57, line 10"},
+		{"not a command", aofChecksumsHeader + set1 + "+OK\r\n",
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "not a command at offset 57, line 10"},
+		{"unknown command", aofChecksumsHeader + set1 + aofBatch("NOPE a") + set2,
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "unknown command 'NOPE' at offset 57, line 10"},
+		{"wrong number of arguments", aofChecksumsHeader + set1 + aofBatch("SET a"),
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "wrong number of arguments for 'set' command"},
+		{"command not modifying the dataset", aofChecksumsHeader + set1 + aofBatch("GET a"),
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "'get' doesn't modify the dataset"},
+		{"checked before running", aofChecksumsHeader + set1 + aofBatch("SET b 2", "GET b"),
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "can't be replayed at offset 84, line 17"},
+		{"EXEC without MULTI", aofChecksumsHeader + set1 + aofBatch("EXEC"),
+			[]string{"SET a 1"}, len(aofChecksumsHeader + set1), "EXEC without MULTI"},
+		{"nested MULTI", aofChecksumsHeader + aofBatch("MULTI", "MULTI", "EXEC"),
+			nil, len(aofChecksumsHeader), "MULTI calls can not be nested at offset 30, line 5"},
+		{"without checksums", plainSet,
+			[]string{"SET a 1"}, len(plainSet), ""},
+		{"without checksums, incomplete transaction", plainSet + plainMulti,
+			[]string{"SET a 1"}, len(plainSet), "without its EXEC"},
+		{"without checksums, unknown command", plainSet + "*1\r\n$4\r\nNOPE\r\n",
+			[]string{"SET a 1"}, len(plainSet), "unknown command 'NOPE' at offset 27, line 8"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.aof")
+			if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var run []string
+			good, err := scanAofFile(path, func(commands [][]Value) {
+				for _, argv := range commands {
+					args := make([]string, len(argv))
+					for i, arg := range argv {
+						args[i] = arg.(BulkStringValue).Val
+					}
+					run = append(run, strings.Join(args, " "))
+				}
+			})
+
+			if (err == nil) != (test.wantErr == "") || (err != nil && !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+
+			if good != int64(test.good) {
+				t.Errorf("got good offset %d, want %d", good, test.good)
+			}
+
+			if strings.Join(run, ",") != strings.Join(test.run, ",") {
+				t.Errorf("ran %q, want %q", run, test.run)
+			}
+		})
+	}
+}
+
+// TestCheckAofFix checks that redgo-check-aof -y truncates a torn file without
+// asking, and only with --fix.
+func TestCheckAofFix(t *testing.T) {
+	good := aofChecksumsHeader + aofBatch("SET a 1")
+	path := filepath.Join(t.TempDir(), "test.aof")
+	if err := os.WriteFile(path, []byte(good+"*3\r\n$3\r\nSET"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := checkAofMain([]string{"-y", path}); status != 1 {
+		t.Fatalf("-y without --fix should be refused, got status %d", status)
+	}
+
+	if status := checkAofMain([]string{"--fix", "-y", path}); status != 0 {
+		t.Fatalf("the file should have been fixed, got status %d", status)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) != good {
+		t.Fatalf("expected the file truncated to %q, got %q", good, data)
+	}
+}
+
+// TestCheckAofSnapshot checks that redgo-check-aof checks a snapshot preamble
+// without loading it into the keyspace.
+func TestCheckAofSnapshot(t *testing.T) {
+	e := newRdbEncoder()
+	e.key("test:checked", &Object{Type: OBJ_STRING, Data: "1"}, 0, false)
+	data := e.finish()
+
+	path := filepath.Join(t.TempDir(), "test.aof.1.base.rdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := checkAofMain([]string{path}); status != 0 {
+		t.Fatalf("the snapshot should be valid, got status %d", status)
+	}
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	if DB.Exists("test:checked") {
+		t.Fatal("checking the snapshot shouldn't load its keys")
+	}
+
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := checkAofMain([]string{path}); status != 1 {
+		t.Fatalf("the snapshot has a wrong checksum, got status %d", status)
+	}
+}
+
+// TestAofUpgradeRewriteReload checks that a single file AOF of earlier versions
+// becomes the base of the multi part AOF, that a rewrite replaces it, and that
+// the new base and incremental files load back, up to the command the last
+// one was cut short in.
+func TestAofUpgradeRewriteReload(t *testing.T) {
+	dir := useTempDir(t)
+	aofDir := filepath.Join(dir, serverConfig().AppendDirname)
+
+	legacy := filepath.Join(dir, serverConfig().AppendFilename)
+	commands := "*3\r\n$3\r\nSET\r\n$14\r\ntest:upgrade:a\r\n$1\r\n1\r\n" +
+		"*4\r\n$5\r\nRPUSH\r\n$17\r\ntest:upgrade:list\r\n$1\r\nx\r\n$1\r\ny\r\n"
+	if err := os.WriteFile(legacy, []byte(commands), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	aof, err := NewAof(aofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("the single file AOF should have been moved into the directory")
+	}
+
+	if base := aof.manifest.base; base == nil || base.name != serverConfig().AppendFilename+".1.base.aof" {
+		t.Fatalf("the single file AOF should be the base, got %+v", base)
+	}
+
+	addr := startTestServerWithAof(t, aof)
+	client := dialTestClient(t, addr)
+
+	client.do("*2\r\n$1\r\nx\r\n$1\r\ny\r\n", "LRANGE", "test:upgrade:list", "0", "-1")
+	client.do("+OK\r\n", "SET", "test:upgrade:b", "2")
+
+	DB.Lock()
+	err = aof.StartRewrite()
+	DB.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rewriting := true; rewriting; {
+		time.Sleep(10 * time.Millisecond)
+
+		aof.mutex.Lock()
+		rewriting = !aof.rewriteStart.IsZero()
+		aof.mutex.Unlock()
+	}
+
+	if aof.lastRewriteErr != nil {
+		t.Fatal(aof.lastRewriteErr)
+	}
+
+	client.do("+OK\r\n", "SET", "test:upgrade:c", "3")
+
+	if err := aof.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := loadAofManifest(aofManifestPath(aofDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.base == nil || manifest.base.seq != 2 || len(manifest.incrs) != 1 {
+		t.Fatalf("the manifest should list the new base and the last incremental file, got %s", manifest.marshal())
+	}
+
+	if _, err := os.Stat(filepath.Join(aofDir, serverConfig().AppendFilename+".1.base.aof")); !os.IsNotExist(err) {
+		t.Fatal("the base replaced by the rewrite should have been removed")
+	}
+
+	// A crash while writing the last incremental file leaves a command cut short.
+	incr := filepath.Join(aofDir, manifest.incrs[0].name)
+	good, err := os.Stat(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(incr, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(aofBatch("SET test:upgrade:torn 4")[:20])
+	file.Close()
+
+	deleteKeys := func() {
+		DB.Lock()
+		defer DB.Unlock()
+
+		for _, key := range []string{"a", "list", "b", "c"} {
+			DB.Delete("test:upgrade:" + key)
+		}
+	}
+
+	deleteKeys()
+	t.Cleanup(deleteKeys)
+
+	reloaded, err := NewAof(aofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.do("$1\r\n1\r\n", "GET", "test:upgrade:a")
+	client.do("*2\r\n$1\r\nx\r\n$1\r\ny\r\n", "LRANGE", "test:upgrade:list", "0", "-1")
+	client.do("$1\r\n2\r\n", "GET", "test:upgrade:b")
+	client.do("$1\r\n3\r\n", "GET", "test:upgrade:c")
+	client.do(":0\r\n", "EXISTS", "test:upgrade:torn")
+
+	if info, err := os.Stat(incr); err != nil || info.Size() != good.Size() {
+		t.Fatalf("the last incremental file should have been truncated to %d bytes, got %v", good.Size(), info.Size())
+	}
+
+	if m := (&aofManifest{}).withBase("test.aof", "rdb"); m.base == nil || len(m.incrs) != 0 {
+		t.Fatalf("a rewrite without incremental files should leave only the base, got %s", m.marshal())
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// BlockState describes what a client blocked in a command like BLPOP is waiting for.
+type BlockState struct {
+	Keys []string
+	// Timeout is zero when the client blocks forever.
+	Timeout time.Duration
+	// serve tries to satisfy the blocked command using the given key, which just
+	// became ready. It returns false if the key can't serve the client yet.
+	serve func(key string) (Value, bool)
+	reply chan Value
+}
+
+// Everything below is guarded by the keyspace lock.
+var (
+	// BlockingKeys maps each key to the clients blocked on it, in the order they blocked.
+	BlockingKeys = make(map[string][]*Client)
+	// readyKeys are the keys that received data since blocked clients were last served.
+	readyKeys    []string
+	readyKeysSet = make(map[string]bool)
+)
+
+// parseBlockingTimeout parses a timeout in seconds, which may be fractional.
+func parseBlockingTimeout(arg Value) (time.Duration, Value) {
+	seconds, err := strconv.ParseFloat(arg.(BulkStringValue).Val, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, ErrorValue{Val: "ERR timeout is not a float or out of range"}
+	}
+
+	if seconds < 0 {
+		return 0, ErrorValue{Val: "ERR timeout is negative"}
+	}
+
+	if seconds*float64(time.Second) > math.MaxInt64 {
+		return 0, ErrorValue{Val: "ERR timeout is out of range"}
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// canBlock tells whether the client may block. Clients without a connection,
+// like the one replaying the AOF, or running a transaction can't, a blocking
+// command there behaves like its non-blocking counterpart.
+func canBlock(client *Client) bool {
+	return client != nil && client.Conn != nil && client.Multi == nil
+}
+
+// blockForKeys puts the client in the wait queue of every key. The client is
+// unblocked by the first key that can serve it or when the timeout elapses.
+func blockForKeys(client *Client, keys []string, timeout time.Duration, serve func(key string) (Value, bool)) {
+	client.Blocked = &BlockState{
+		Keys:    keys,
+		Timeout: timeout,
+		serve:   serve,
+		reply:   make(chan Value, 1),
+	}
+
+	for _, key := range keys {
+		BlockingKeys[key] = append(BlockingKeys[key], client)
+	}
+}
+
+// unblockClient removes the client from every wait queue.
+func unblockClient(client *Client) {
+	for _, key := range client.Blocked.Keys {
+		queue := BlockingKeys[key]
+
+		for i, c := range queue {
+			if c == client {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+
+		if len(queue) == 0 {
+			delete(BlockingKeys, key)
+		} else {
+			BlockingKeys[key] = queue
+		}
+	}
+
+	client.Blocked = nil
+}
+
+// signalKeyAsReady records that key may now be able to serve blocked clients.
+func signalKeyAsReady(key string) {
+	if _, found := BlockingKeys[key]; !found || readyKeysSet[key] {
+		return
+	}
+
+	readyKeysSet[key] = true
+	readyKeys = append(readyKeys, key)
+}
+
+// serveClientsBlockedOnKeys serves the clients blocked on keys that became
+// ready, in the order the clients blocked. It runs with the keyspace locked once
+// the command that signaled the keys (or the whole transaction) has completed,
+// and appends what the served commands did to the AOF.
+func serveClientsBlockedOnKeys(aof *Aof) {
+	// Serving a client may make more keys ready, e.g. BLMOVE pushing to its destination.
+	for len(readyKeys) > 0 {
+		keys := readyKeys
+		readyKeys = nil
+		clear(readyKeysSet)
+
+		for _, key := range keys {
+			for len(BlockingKeys[key]) > 0 {
+				client := BlockingKeys[key][0]
+
+				reply, ok := client.Blocked.serve(key)
+				if !ok {
+					break
+				}
+
+				state := client.Blocked
+				unblockClient(client)
+				if err := flushPropagation(aof); err != nil {
+					reply = aofWriteErrorReply(err)
+				}
+
+				state.reply <- reply
+			}
+		}
+	}
+}
+
+// waitUntilUnblocked waits, without holding the keyspace lock, until the client
+// is served, its timeout elapses or it disconnects, and returns the reply to send.
+func waitUntilUnblocked(client *Client, state *BlockState) (Value, error) {
+	var timeout <-chan time.Time
+	if state.Timeout > 0 {
+		timer := time.NewTimer(state.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Watch the connection so a client that goes away stops waiting and doesn't
+	// get served data it would never receive.
+	disconnected := make(chan error, 1)
+	go func() {
+		disconnected <- client.Reader.WaitForInput()
+	}()
+
+	// WaitForInput also returns when the client pipelines its next command, in
+	// which case we keep waiting and stop watching the connection.
+	var watchErr error
+	for watching := true; ; {
+		select {
+		case reply := <-state.reply:
+			stopWatching(client, disconnected, watching)
+			return reply, nil
+		case <-timeout:
+			DB.Lock()
+			defer DB.Unlock()
+
+			stopWatching(client, disconnected, watching)
+
+			// The client may have been served while we were waiting for the lock.
+			if client.Blocked != state {
+				return <-state.reply, nil
+			}
+
+			unblockClient(client)
+
+			return NullArrayValue{}, nil
+		case watchErr = <-disconnected:
+			watching = false
+			if watchErr == nil {
+				continue
+			}
+
+			DB.Lock()
+			defer DB.Unlock()
+
+			if client.Blocked == state {
+				unblockClient(client)
+			}
+
+			return nil, watchErr
+		}
+	}
+}
+
+// stopWatching interrupts the pending WaitForInput, so the client's reader is no
+// longer in use when the connection goes back to parsing commands.
+func stopWatching(client *Client, disconnected chan error, watching bool) {
+	if !watching {
+		return
+	}
+
+	// A connection error is sticky, so if one raced with the deadline the next
+	// read reports it again.
+	client.Conn.SetReadDeadline(time.Now())
+	<-disconnected
+	client.Conn.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClient is a connection to the test server sending commands and
+// checking the replies byte for byte, like the conformance sessions.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+
+	command := make([]Value, len(args))
+	for i, arg := range args {
+		command[i] = BulkStringValue{Val: arg}
+	}
+
+	if _, err := c.conn.Write(ArrayValue{Val: command}.Marshal()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) expect(reply string) {
+	c.t.Helper()
+
+	received := make([]byte, len(reply))
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c.reader, received); err != nil {
+		c.t.Fatalf("expected %q, got %q, %v", reply, received, err)
+	}
+
+	if string(received) != reply {
+		c.t.Fatalf("expected %q, got %q", reply, received)
+	}
+}
+
+func (c *testClient) do(reply string, args ...string) {
+	c.t.Helper()
+	c.send(args...)
+	c.expect(reply)
+}
+
+// reply reads the next reply, whatever it is.
+func (c *testClient) reply() Value {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	value, err := (&Reader{reader: c.reader}).ParseFromRespString()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return value
+}
+
+// expectNothing checks that no reply arrives for a while.
+func (c *testClient) expectNothing() {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if b, err := c.reader.ReadByte(); err == nil {
+		c.t.Fatalf("expected no reply, got %q", b)
+	}
+}
+
+// waitForBlocked waits until n clients are blocked on key.
+func waitForBlocked(t *testing.T, key string, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		DB.Lock()
+		blocked := len(BlockingKeys[key])
+		DB.Unlock()
+
+		if blocked == n {
+			return
+		}
+	}
+
+	t.Fatalf("expected %d clients blocked on %s", n, key)
+}
+
+// TestBlockingServingOrder checks that clients are served in the order they
+// blocked, one element each.
+func TestBlockingServingOrder(t *testing.T) {
+	addr := startTestServer(t)
+	pusher := dialTestClient(t, addr)
+
+	var waiting []*testClient
+	for i := 0; i < 3; i++ {
+		client := dialTestClient(t, addr)
+		client.send("BLPOP", "test:order", "0")
+		waitForBlocked(t, "test:order", i+1)
+		waiting = append(waiting, client)
+	}
+
+	pusher.do(":2\r\n", "RPUSH", "test:order", "a", "b")
+	waiting[0].expect("*2\r\n$10\r\ntest:order\r\n$1\r\na\r\n")
+	waiting[1].expect("*2\r\n$10\r\ntest:order\r\n$1\r\nb\r\n")
+	waiting[2].expectNothing()
+
+	pusher.do(":1\r\n", "LPUSH", "test:order", "c")
+	waiting[2].expect("*2\r\n$10\r\ntest:order\r\n$1\r\nc\r\n")
+	pusher.do(":0\r\n", "EXISTS", "test:order")
+}
+
+// TestBlockingSeveralKeys checks that a client blocked on several keys is
+// served by the first one to get an element, and keeps waiting while a key
+// holds another type.
+func TestBlockingSeveralKeys(t *testing.T) {
+	addr := startTestServer(t)
+	pusher := dialTestClient(t, addr)
+	client := dialTestClient(t, addr)
+
+	client.send("BRPOP", "test:first", "test:second", "0")
+	waitForBlocked(t, "test:second", 1)
+
+	pusher.do("+OK\r\n", "SET", "test:first", "string")
+	client.expectNothing()
+
+	pusher.do(":2\r\n", "RPUSH", "test:second", "a", "b")
+	client.expect("*2\r\n$11\r\ntest:second\r\n$1\r\nb\r\n")
+	waitForBlocked(t, "test:first", 0)
+
+	pusher.do(":2\r\n", "DEL", "test:first", "test:second")
+}
+
+// TestBlockingTimeout checks that a client gets a null reply once its timeout
+// elapses, and isn't served afterwards.
+func TestBlockingTimeout(t *testing.T) {
+	addr := startTestServer(t)
+	pusher := dialTestClient(t, addr)
+	client := dialTestClient(t, addr)
+
+	for _, command := range [][]string{
+		{"BLPOP", "test:timeout", "0.1"},
+		{"BLMOVE", "test:timeout", "test:other", "LEFT", "RIGHT", "0.1"},
+		{"BLMPOP", "0.1", "1", "test:timeout", "LEFT"},
+	} {
+		start := time.Now()
+		client.do("*-1\r\n", command...)
+
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("%s timed out after %v", command[0], elapsed)
+		}
+	}
+
+	waitForBlocked(t, "test:timeout", 0)
+	pusher.do(":1\r\n", "RPUSH", "test:timeout", "a")
+	client.expectNothing()
+	pusher.do(":1\r\n", "LLEN", "test:timeout")
+
+	client.do("-ERR timeout is negative\r\n", "BLPOP", "test:timeout", "-1")
+	client.do("-ERR timeout is not a float or out of range\r\n", "BLPOP", "test:timeout", "soon")
+	pusher.do(":1\r\n", "DEL", "test:timeout")
+}
+
+// TestBlockingDisconnect checks that a client disconnecting while blocked
+// leaves the wait queue, so the elements pushed afterwards stay in the list.
+func TestBlockingDisconnect(t *testing.T) {
+	addr := startTestServer(t)
+	pusher := dialTestClient(t, addr)
+	client := dialTestClient(t, addr)
+	next := dialTestClient(t, addr)
+
+	client.send("BLPOP", "test:disconnect", "0")
+	waitForBlocked(t, "test:disconnect", 1)
+	next.send("BLPOP", "test:disconnect", "0")
+	waitForBlocked(t, "test:disconnect", 2)
+
+	client.conn.Close()
+	waitForBlocked(t, "test:disconnect", 1)
+
+	pusher.do(":2\r\n", "RPUSH", "test:disconnect", "a", "b")
+	next.expect("*2\r\n$15\r\ntest:disconnect\r\n$1\r\na\r\n")
+	pusher.do(":1\r\n", "LLEN", "test:disconnect")
+	pusher.do(":1\r\n", "DEL", "test:disconnect")
+}
+
+// TestBlockingMoveChain checks that an element moved by a blocked BLMOVE
+// serves the clients blocked on its destination in turn.
+func TestBlockingMoveChain(t *testing.T) {
+	addr := startTestServer(t)
+	pusher := dialTestClient(t, addr)
+	first := dialTestClient(t, addr)
+	second := dialTestClient(t, addr)
+	last := dialTestClient(t, addr)
+
+	first.send("BLMOVE", "test:source", "test:middle", "RIGHT", "LEFT", "0")
+	waitForBlocked(t, "test:source", 1)
+	second.send("BRPOPLPUSH", "test:middle", "test:destination", "0")
+	waitForBlocked(t, "test:middle", 1)
+	last.send("BLPOP", "test:destination", "0")
+	waitForBlocked(t, "test:destination", 1)
+
+	pusher.do(":1\r\n", "LPUSH", "test:source", "x")
+	first.expect("$1\r\nx\r\n")
+	second.expect("$1\r\nx\r\n")
+	last.expect("*2\r\n$16\r\ntest:destination\r\n$1\r\nx\r\n")
+
+	pusher.do(":0\r\n", "EXISTS", "test:source", "test:middle", "test:destination")
+}
+
+// TestBlockingTransaction checks that blocking commands don't block in a
+// transaction, and that clients are served with what's left once it's done.
+func TestBlockingTransaction(t *testing.T) {
+	addr := startTestServer(t)
+	pusher := dialTestClient(t, addr)
+	client := dialTestClient(t, addr)
+
+	pusher.do("+OK\r\n", "MULTI")
+	pusher.do("+QUEUED\r\n", "BLPOP", "test:transaction", "0")
+	pusher.do("*1\r\n*-1\r\n", "EXEC")
+
+	client.send("BLMPOP", "0", "1", "test:transaction", "LEFT", "COUNT", "5")
+	waitForBlocked(t, "test:transaction", 1)
+
+	pusher.do("+OK\r\n", "MULTI")
+	pusher.do("+QUEUED\r\n", "RPUSH", "test:transaction", "a", "b", "c")
+	pusher.do("+QUEUED\r\n", "LPOP", "test:transaction")
+	pusher.do("*2\r\n:3\r\n$1\r\na\r\n", "EXEC")
+
+	client.expect("*2\r\n$16\r\ntest:transaction\r\n*2\r\n$1\r\nb\r\n$1\r\nc\r\n")
+	pusher.do(":0\r\n", "EXISTS", "test:transaction")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkAofMain runs the server binary as redgo-check-aof, like Redis does when
+// started under the name redis-check-aof. It checks the files listed by a
+// manifest, or a single file, and with --fix truncates the last one to its
+// last good command, once confirmed, or right away with -y. It returns the
+// exit status.
+func checkAofMain(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "Usage: redgo-check-aof [--fix [-y]] <file.manifest|file.aof>")
+		return 1
+	}
+
+	fix, confirmed := false, false
+
+	for ; len(args) > 1; args = args[1:] {
+		switch args[0] {
+		case "--fix":
+			fix = true
+		case "-y":
+			confirmed = true
+		default:
+			return usage()
+		}
+	}
+
+	if len(args) != 1 || (confirmed && !fix) {
+		return usage()
+	}
+
+	path := args[0]
+	files := []string{path}
+	multiPart := strings.HasSuffix(path, ".manifest")
+
+	if multiPart {
+		manifest, err := loadAofManifest(path)
+		if err != nil {
+			fmt.Printf("Can't read the manifest %s: %v\n", path, err)
+			return 1
+		}
+
+		files = nil
+		for _, info := range manifest.files() {
+			files = append(files, filepath.Join(filepath.Dir(path), info.name))
+		}
+
+		fmt.Printf("Start checking the multi part AOF %s, %d files\n", path, len(files))
+	}
+
+	for i, file := range files {
+		if !checkAofFile(file, i == len(files)-1, fix, confirmed) {
+			return 1
+		}
+	}
+
+	if multiPart {
+		fmt.Println("All AOF files and the manifest are valid")
+	}
+
+	return 0
+}
+
+// checkAofFile checks a file of the AOF, reporting what's wrong with it, and
+// returns whether it's valid, or was fixed. Only the last file can be fixed,
+// as the commands of the next ones depend on those of the file. Unless
+// confirmed, the fix is confirmed on the standard input first.
+func checkAofFile(path string, last, fix, confirmed bool) bool {
+	snapshot, err := fileStartsWith(path, rdbMagic)
+	if err != nil {
+		fmt.Printf("Can't open the AOF %s: %v\n", path, err)
+		return false
+	}
+
+	if snapshot {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = rdbCheck(data)
+		}
+
+		if err != nil {
+			fmt.Printf("The snapshot preamble %s is not valid: %v\n", path, err)
+			return false
+		}
+
+		fmt.Printf("The snapshot preamble %s is valid\n", path)
+		return true
+	}
+
+	good, err := scanAofFile(path, nil)
+
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		fmt.Printf("Can't open the AOF %s: %v\n", path, statErr)
+		return false
+	}
+
+	size := info.Size()
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", path, size, good, size-good)
+
+	if err == nil {
+		fmt.Printf("AOF %s is valid\n", path)
+		return true
+	}
+
+	fmt.Printf("AOF %s: %v\n", path, err)
+
+	if !last {
+		fmt.Printf("AOF %s is not the last file of the AOF, so it can't be fixed by truncating it\n", path)
+		return false
+	}
+
+	if !fix {
+		fmt.Printf("AOF %s is not valid. Use the --fix option to try fixing it.\n", path)
+		return false
+	}
+
+	fmt.Printf("This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes\n", path, size, size-good, good)
+
+	if !confirmed {
+		fmt.Print("Continue? [y/N]: ")
+
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			fmt.Println("Aborting...")
+			return false
+		}
+	}
+
+	if err := os.Truncate(path, good); err != nil {
+		fmt.Printf("Failed to truncate AOF %s: %v\n", path, err)
+		return false
+	}
+
+	fmt.Printf("Successfully truncated AOF %s\n", path)
+
+	return true
+}
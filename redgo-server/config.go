@@ -0,0 +1,605 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the server settings. It's never modified once published:
+// CONFIG SET publishes a modified copy, so readers get a consistent view
+// without locking.
+type Config struct {
+	Bind           []string
+	Port           int
+	Dir            string
+	AppendOnly     bool
+	AppendFilename string
+	AppendDirname  string
+	AppendFsync    string
+	// AofUseRdbPreamble writes the base of the AOF as a snapshot rather than
+	// as commands.
+	AofUseRdbPreamble bool
+	// AofLoadTruncated loads an AOF cut short by a crash, see Aof.Read.
+	AofLoadTruncated bool
+	// AutoAofRewritePercentage and AutoAofRewriteMinSize trigger a rewrite of
+	// the AOF once it has grown enough, see Aof.rewriteIfGrown.
+	AutoAofRewritePercentage int
+	AutoAofRewriteMinSize    int64
+	// Save lists the save points, see rdbSaveIfNeeded.
+	Save                 []SavePoint
+	DBFilename           string
+	LogLevel             string
+	LogFile              string
+	MaxClients           int
+	RequirePass          string
+	LuaTimeLimit         time.Duration
+	ProtoMaxBulkLen      int64
+	ProtoMaxMultibulkLen int64
+}
+
+var (
+	currentConfig atomic.Pointer[Config]
+	// configFile is the absolute path of the file the configuration was read
+	// from, which CONFIG REWRITE writes back to. It's empty if there's none.
+	configFile string
+)
+
+// serverConfig returns the settings in effect.
+func serverConfig() *Config {
+	return currentConfig.Load()
+}
+
+// configParam is a setting as named in the config file and by CONFIG.
+type configParam struct {
+	name         string
+	defaultValue string
+	// Immutable settings can only be set on startup.
+	immutable bool
+	// multiArg settings take several arguments, written unquoted.
+	multiArg bool
+	get      func(c *Config) string
+	set      func(c *Config, value string) error
+}
+
+var configParams = []configParam{
+	{name: "bind", defaultValue: "", immutable: true, multiArg: true,
+		get: func(c *Config) string { return strings.Join(c.Bind, " ") },
+		set: func(c *Config, value string) error {
+			c.Bind = strings.Fields(value)
+			return nil
+		}},
+	intParam("port", "7000", true, 1, 65535, func(c *Config) *int { return &c.Port }),
+	stringParam("dir", ".", true, func(c *Config) *string { return &c.Dir }, nil),
+	boolParam("appendonly", "yes", true, func(c *Config) *bool { return &c.AppendOnly }),
+	stringParam("appendfilename", "database.aof", true, func(c *Config) *string { return &c.AppendFilename },
+		func(value string) error {
+			if value == "" || strings.ContainsRune(value, filepath.Separator) {
+				return errors.New("appendfilename can't be a path, just a filename")
+			}
+			return nil
+		}),
+	stringParam("appenddirname", "appendonlydir", true, func(c *Config) *string { return &c.AppendDirname },
+		func(value string) error {
+			if value == "" || strings.ContainsRune(value, filepath.Separator) {
+				return errors.New("appenddirname can't be a path, just a dirname")
+			}
+			return nil
+		}),
+	// How often the AOF is synced to the disk: after every write, once per
+	// second, or whenever the operating system decides to.
+	stringParam("appendfsync", "everysec", false, func(c *Config) *string { return &c.AppendFsync },
+		func(value string) error {
+			if value != "always" && value != "everysec" && value != "no" {
+				return errors.New("argument(s) must be one of the following: always, everysec, no")
+			}
+			return nil
+		}),
+	boolParam("aof-use-rdb-preamble", "yes", false, func(c *Config) *bool { return &c.AofUseRdbPreamble }),
+	boolParam("aof-load-truncated", "yes", false, func(c *Config) *bool { return &c.AofLoadTruncated }),
+	intParam("auto-aof-rewrite-percentage", "100", false, 0, 1<<31-1, func(c *Config) *int { return &c.AutoAofRewritePercentage }),
+	memoryParam("auto-aof-rewrite-min-size", "64mb", false, 0, 1<<62, func(c *Config) *int64 { return &c.AutoAofRewriteMinSize }),
+	// Pairs of seconds and changes: the dataset is saved once that many seconds
+	// passed since the last save if there were at least that many changes.
+	{name: "save", defaultValue: "3600 1 300 100 60 10000", multiArg: true,
+		get: func(c *Config) string {
+			pairs := make([]string, len(c.Save))
+			for i, point := range c.Save {
+				pairs[i] = fmt.Sprintf("%d %d", point.Seconds, point.Changes)
+			}
+			return strings.Join(pairs, " ")
+		},
+		set: func(c *Config, value string) error {
+			args := strings.Fields(value)
+			if len(args)%2 != 0 {
+				return errors.New("Invalid save parameters")
+			}
+
+			points := []SavePoint{}
+			for i := 0; i < len(args); i += 2 {
+				seconds, err := strconv.ParseInt(args[i], 10, 64)
+				changes, err2 := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || err2 != nil || seconds < 1 || changes < 0 {
+					return errors.New("Invalid save parameters")
+				}
+				points = append(points, SavePoint{Seconds: seconds, Changes: changes})
+			}
+
+			c.Save = points
+			return nil
+		}},
+	stringParam("dbfilename", "dump.rdb", false, func(c *Config) *string { return &c.DBFilename },
+		func(value string) error {
+			if value == "" || strings.ContainsRune(value, filepath.Separator) {
+				return errors.New("dbfilename can't be a path, just a filename")
+			}
+			return nil
+		}),
+	stringParam("loglevel", "notice", false, func(c *Config) *string { return &c.LogLevel },
+		func(value string) error {
+			if _, found := logLevels[value]; !found {
+				return errors.New("argument(s) must be one of the following: debug, verbose, notice, warning")
+			}
+			return nil
+		}),
+	stringParam("logfile", "", true, func(c *Config) *string { return &c.LogFile }, nil),
+	intParam("maxclients", "10000", false, 1, 1<<31-1, func(c *Config) *int { return &c.MaxClients }),
+	stringParam("requirepass", "", false, func(c *Config) *string { return &c.RequirePass }, nil),
+	// How long a script runs, in milliseconds, before other clients are told the
+	// server is busy, at which point it can be stopped with SCRIPT KILL. Scripts
+	// are never stopped on their own, as that could leave a write half done.
+	{name: "lua-time-limit", defaultValue: "5000",
+		get: func(c *Config) string { return strconv.FormatInt(c.LuaTimeLimit.Milliseconds(), 10) },
+		set: func(c *Config, value string) error {
+			ms, err := parseConfigInt(value, 0, 1<<53)
+			c.LuaTimeLimit = time.Duration(ms) * time.Millisecond
+			return err
+		}},
+	memoryParam("proto-max-bulk-len", "512mb", false, 1024*1024, 1<<62, func(c *Config) *int64 { return &c.ProtoMaxBulkLen }),
+	memoryParam("proto-max-multibulk-len", "1048576", false, 1, 1<<31-1, func(c *Config) *int64 { return &c.ProtoMaxMultibulkLen }),
+}
+
+func stringParam(name, defaultValue string, immutable bool, field func(c *Config) *string, validate func(value string) error) configParam {
+	return configParam{name: name, defaultValue: defaultValue, immutable: immutable,
+		get: func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			if validate != nil {
+				if err := validate(value); err != nil {
+					return err
+				}
+			}
+
+			*field(c) = value
+			return nil
+		}}
+}
+
+func boolParam(name, defaultValue string, immutable bool, field func(c *Config) *bool) configParam {
+	return configParam{name: name, defaultValue: defaultValue, immutable: immutable,
+		get: func(c *Config) string {
+			if *field(c) {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(c *Config, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				*field(c) = true
+			case "no":
+				*field(c) = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		}}
+}
+
+func intParam(name, defaultValue string, immutable bool, lower, upper int64, field func(c *Config) *int) configParam {
+	return configParam{name: name, defaultValue: defaultValue, immutable: immutable,
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, value string) error {
+			n, err := parseConfigInt(value, lower, upper)
+			*field(c) = int(n)
+			return err
+		}}
+}
+
+// memoryParam is a size in bytes, which may be given with a unit like 512mb.
+func memoryParam(name, defaultValue string, immutable bool, lower, upper int64, field func(c *Config) *int64) configParam {
+	return configParam{name: name, defaultValue: defaultValue, immutable: immutable,
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+		set: func(c *Config, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+
+			if n < lower || n > upper {
+				return fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+			}
+
+			*field(c) = n
+			return nil
+		}}
+}
+
+func parseConfigInt(value string, lower, upper int64) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("argument couldn't be parsed into an integer")
+	}
+
+	if n < lower || n > upper {
+		return 0, fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+	}
+
+	return n, nil
+}
+
+// parseMemory parses a number of bytes with an optional unit: k, m and g are
+// powers of 1000, kb, mb and gb powers of 1024.
+func parseMemory(value string) (int64, error) {
+	lower := strings.ToLower(value)
+
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, unit = strings.TrimSuffix(lower, u.suffix), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/unit {
+		return 0, errors.New("argument must be a memory value")
+	}
+
+	return n * unit, nil
+}
+
+func lookupConfigParam(name string) (configParam, bool) {
+	for _, param := range configParams {
+		if param.name == name {
+			return param, true
+		}
+	}
+
+	return configParam{}, false
+}
+
+func defaultConfig() *Config {
+	c := &Config{}
+	for _, param := range configParams {
+		if err := param.set(c, param.defaultValue); err != nil {
+			panic("invalid default for " + param.name + ": " + err.Error())
+		}
+	}
+
+	return c
+}
+
+func init() {
+	currentConfig.Store(defaultConfig())
+}
+
+// loadConfig builds the configuration from the command line: an optional
+// config file followed by settings overriding it, given as --name value.
+// It returns the configuration and the absolute path of the config file.
+func loadConfig(args []string) (*Config, string, error) {
+	c := defaultConfig()
+	path := ""
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		path, args = args[0], args[1:]
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("Fatal error, can't open config file '%s': %v", path, err)
+		}
+
+		if err := applyConfigLines(c, strings.Split(string(data), "\n")); err != nil {
+			return nil, "", err
+		}
+
+		if path, err = filepath.Abs(path); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Each option from the command line becomes a line, as if it was appended
+	// to the config file.
+	var lines []string
+	for _, arg := range args {
+		if isConfigOption(arg) {
+			lines = append(lines, strings.TrimLeft(arg, "-"))
+		} else if len(lines) == 0 {
+			return nil, "", fmt.Errorf("Invalid argument '%s', options must be given as --name value", arg)
+		} else {
+			lines[len(lines)-1] += " " + quoteConfigValue(arg)
+		}
+	}
+
+	if err := applyConfigLines(c, lines); err != nil {
+		return nil, "", err
+	}
+
+	return c, path, nil
+}
+
+// isConfigOption tells whether a command line argument names a setting, like
+// --port or -port, rather than being a value, which may start with a dash too.
+func isConfigOption(arg string) bool {
+	name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+
+	return len(name) < len(arg) && name != "" && name[0] >= 'a' && name[0] <= 'z'
+}
+
+// applyConfigLines applies lines in the config file format, reporting the
+// first faulty one the way Redis does.
+func applyConfigLines(c *Config, lines []string) error {
+	for i, line := range lines {
+		name, value, err := parseConfigLine(line)
+		if err == nil && name == "" {
+			continue
+		}
+
+		if err == nil {
+			param, found := lookupConfigParam(name)
+			if !found {
+				err = errors.New("Bad directive or wrong number of arguments")
+			} else {
+				err = param.set(c, value)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("\n*** FATAL CONFIG FILE ERROR ***\nReading the configuration file, at line %d\n>>> '%s'\n%v", i+1, strings.TrimSpace(line), err)
+		}
+	}
+
+	return nil
+}
+
+// parseConfigLine splits a line into the lowercase name of a setting and its
+// value, its arguments joined by spaces. Blank lines and comments give no name.
+func parseConfigLine(line string) (string, string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", "", nil
+	}
+
+	args, ok := splitArgs([]byte(line))
+	if !ok {
+		return "", "", errors.New("Unbalanced quotes in configuration line")
+	}
+
+	if len(args) < 2 {
+		return "", "", errors.New("Bad directive or wrong number of arguments")
+	}
+
+	values := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		values[i] = string(arg)
+	}
+
+	return strings.ToLower(string(args[0])), strings.Join(values, " "), nil
+}
+
+// quoteConfigValue quotes a value for the config file if it's empty or holds
+// characters that would otherwise be split or lost.
+func quoteConfigValue(value string) string {
+	plain := value != ""
+	for i := 0; i < len(value) && plain; i++ {
+		c := value[i]
+		plain = c > ' ' && c <= '~' && c != '"' && c != '\'' && c != '\\'
+	}
+
+	if plain {
+		return value
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' || c == '"':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c == '\n':
+			quoted.WriteString("\\n")
+		case c == '\r':
+			quoted.WriteString("\\r")
+		case c == '\t':
+			quoted.WriteString("\\t")
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&quoted, "\\x%02x", c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+
+	return quoted.String()
+}
+
+func formatConfigLine(param configParam, c *Config) string {
+	value := param.get(c)
+	if !param.multiArg || value == "" {
+		value = quoteConfigValue(value)
+	}
+
+	return param.name + " " + value
+}
+
+func config(args []Value, _ *Client) Value {
+	subcommand := strings.ToUpper(args[0].(BulkStringValue).Val)
+
+	switch {
+	case subcommand == "GET" && len(args) >= 2:
+		return configGet(args[1:])
+	case subcommand == "SET" && len(args) >= 3 && len(args)%2 == 1:
+		return configSet(args[1:])
+	case subcommand == "REWRITE" && len(args) == 1:
+		if err := rewriteConfig(); err != nil {
+			return ErrorValue{Val: "ERR Rewriting config file: " + err.Error()}
+		}
+
+		return StringValue{Val: "OK"}
+	default:
+		return ErrorValue{Val: "ERR unknown subcommand or wrong number of arguments for '" + args[0].(BulkStringValue).Val + "'. Try CONFIG HELP."}
+	}
+}
+
+// configGet replies with the settings matching any of the patterns.
+func configGet(patterns []Value) Value {
+	c := serverConfig()
+
+	reply := []Value{}
+	for _, param := range configParams {
+		for _, pattern := range patterns {
+			if stringMatch(strings.ToLower(pattern.(BulkStringValue).Val), param.name) {
+				reply = append(reply, BulkStringValue{Val: param.name}, BulkStringValue{Val: param.get(c)})
+				break
+			}
+		}
+	}
+
+	return MapValue{Val: reply}
+}
+
+// configSet applies every setting or, if any of them is invalid, none.
+func configSet(args []Value) Value {
+	c := *serverConfig()
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(args); i += 2 {
+		name := strings.ToLower(args[i].(BulkStringValue).Val)
+
+		param, found := lookupConfigParam(name)
+		if !found {
+			return ErrorValue{Val: "ERR Unknown option or number of arguments for CONFIG SET - '" + name + "'"}
+		}
+
+		var err error
+		switch {
+		case seen[name]:
+			err = errors.New("duplicate parameter")
+		case param.immutable:
+			err = errors.New("can't set immutable config")
+		default:
+			err = param.set(&c, args[i+1].(BulkStringValue).Val)
+		}
+
+		if err != nil {
+			return ErrorValue{Val: "ERR CONFIG SET failed (possibly related to argument '" + name + "') - " + err.Error()}
+		}
+
+		seen[name] = true
+	}
+
+	currentConfig.Store(&c)
+
+	return StringValue{Val: "OK"}
+}
+
+// rewriteConfig writes the settings in effect to the config file. Settings
+// already in the file are updated in place, keeping comments and the order,
+// and the ones not in it are appended unless they have their default value.
+func rewriteConfig() error {
+	if configFile == "" {
+		return errors.New("The server is running without a config file")
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c := serverConfig()
+	defaults := defaultConfig()
+	written := make(map[string]bool)
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line == "" && len(data) == 0 {
+			break
+		}
+
+		name, _, err := parseConfigLine(line)
+		param, found := lookupConfigParam(name)
+		if err != nil || !found {
+			lines = append(lines, line)
+			continue
+		}
+
+		// A setting given several times is written once, where it first appeared.
+		if !written[name] {
+			lines = append(lines, formatConfigLine(param, c))
+			written[name] = true
+		}
+	}
+
+	generatedHeader := "# Generated by CONFIG REWRITE"
+	for _, param := range configParams {
+		if written[param.name] || param.get(c) == param.get(defaults) {
+			continue
+		}
+
+		if !containsLine(lines, generatedHeader) {
+			lines = append(lines, generatedHeader)
+		}
+
+		lines = append(lines, formatConfigLine(param, c))
+	}
+
+	// Write to a temporary file first, so a crash can't leave the config half written.
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), ".redgo.conf.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if info, err := os.Stat(configFile); err == nil {
+		tmp.Chmod(info.Mode())
+	}
+
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), configFile)
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useConfigFile loads the config file at path with the overrides, as on
+// startup, and makes it the configuration in effect until the test ends.
+func useConfigFile(t *testing.T, path string, overrides ...string) *Config {
+	t.Helper()
+
+	config, absPath, err := loadConfig(append([]string{path}, overrides...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous, previousFile := serverConfig(), configFile
+	t.Cleanup(func() {
+		currentConfig.Store(previous)
+		configFile = previousFile
+	})
+
+	currentConfig.Store(config)
+	configFile = absPath
+
+	return config
+}
+
+// TestLoadConfig checks that the settings of the config file are read, and
+// that the ones given on the command line take precedence.
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redgo.conf")
+	data := "# A comment\nport 7100\nloglevel warning\nappendfsync no\nrequirepass \"two words\"\nsave 100 5 20 1000\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := useConfigFile(t, path, "--port", "7200", "--loglevel", "debug", "--proto-max-bulk-len", "2mb", "--lua-time-limit", "100")
+
+	expected := defaultConfig()
+	expected.Port = 7200
+	expected.LogLevel = "debug"
+	expected.AppendFsync = "no"
+	expected.RequirePass = "two words"
+	expected.Save = []SavePoint{{Seconds: 100, Changes: 5}, {Seconds: 20, Changes: 1000}}
+	expected.ProtoMaxBulkLen = 2 * 1024 * 1024
+	expected.LuaTimeLimit = 100 * time.Millisecond
+
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, config)
+	}
+
+	if !filepath.IsAbs(configFile) {
+		t.Fatalf("the path of the config file should be absolute, got %s", configFile)
+	}
+
+	if _, _, err := loadConfig([]string{path, "--port", "0"}); err == nil || !strings.Contains(err.Error(), ">>> 'port 0'") {
+		t.Fatalf("expected the faulty override to be reported, got %v", err)
+	}
+}
+
+// TestConfigRewrite checks that the file written by CONFIG REWRITE loads back
+// to the settings in effect, keeping the lines that aren't settings.
+func TestConfigRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redgo.conf")
+	if err := os.WriteFile(path, []byte("# A comment\nport 7100\nloglevel warning\nloglevel debug\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	useConfigFile(t, path, "--appendfsync", "always")
+
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+
+	client.do("+OK\r\n", "CONFIG", "SET", "loglevel", "notice", "save", "", "proto-max-bulk-len", "2mb", "dbfilename", "my dump.rdb")
+	client.do("+OK\r\n", "CONFIG", "REWRITE")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(data), "# A comment\nport 7100\nloglevel notice\n# Generated by CONFIG REWRITE\n") {
+		t.Fatalf("the file should have been updated in place, got %q", data)
+	}
+
+	reloaded, _, err := loadConfig([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(reloaded, serverConfig()) {
+		t.Fatalf("the rewritten file loads as %+v, expected %+v", reloaded, serverConfig())
+	}
+}
+
+// TestConfigSetImmutable checks that the settings only read on startup can't
+// be set with CONFIG SET, and that a failed CONFIG SET changes nothing.
+func TestConfigSetImmutable(t *testing.T) {
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+
+	immutable := map[string]bool{}
+	for _, param := range configParams {
+		if param.immutable {
+			immutable[param.name] = true
+		}
+	}
+
+	for _, name := range []string{"bind", "port", "dir", "appendonly", "appendfilename", "appenddirname", "logfile"} {
+		if !immutable[name] {
+			t.Fatalf("%s should be immutable", name)
+		}
+	}
+
+	before := serverConfig()
+
+	for name := range immutable {
+		client.do("-ERR CONFIG SET failed (possibly related to argument '"+name+"') - can't set immutable config\r\n",
+			"CONFIG", "SET", "maxclients", "5", name, "x")
+	}
+
+	if serverConfig() != before {
+		t.Fatal("a failed CONFIG SET shouldn't change the configuration")
+	}
+}
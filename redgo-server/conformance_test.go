@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConformance replays the sessions in testdata/conformance and checks the
+// server replies byte for byte. In a session file:
+//
+//	> data   is sent to the server
+//	< data   is the reply expected next
+//	!closed  expects the server to close the connection
+//	---      starts a new connection
+//	@name    switches to the connection called name, connecting it first if
+//	         needed, while the others stay open, e.g. to publish to a
+//	         subscribed client. The connection a session starts with is @main.
+//
+// Data is written as the inside of a Go string literal, so \r\n and friends
+// can be spelled out, except that double quotes needn't be escaped. Lines
+// starting with # and blank lines are ignored.
+func TestConformance(t *testing.T) {
+	addr := startTestServer(t)
+
+	files, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".txt"), func(t *testing.T) {
+			replaySession(t, addr, file)
+		})
+	}
+}
+
+func replaySession(t *testing.T, addr, file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conn net.Conn
+	var reader *bufio.Reader
+
+	type sessionConn struct {
+		conn   net.Conn
+		reader *bufio.Reader
+	}
+	conns := make(map[string]sessionConn)
+	name := "main"
+
+	connect := func() {
+		if conn != nil {
+			conn.Close()
+		}
+
+		conn, err = net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bufio.NewReader(conn)
+		conns[name] = sessionConn{conn, reader}
+	}
+
+	connect()
+	defer func() {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}()
+
+	for i, line := range strings.Split(string(data), "\n") {
+		where := file + ":" + strconv.Itoa(i+1)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "---":
+			connect()
+		case strings.HasPrefix(line, "@"):
+			name = line[1:]
+			if c, found := conns[name]; found {
+				conn, reader = c.conn, c.reader
+			} else {
+				conn = nil
+				connect()
+			}
+		case line == "!closed":
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if b, err := reader.ReadByte(); err != io.EOF {
+				t.Fatalf("%s: expected the connection to be closed, got %q, %v", where, b, err)
+			}
+		case strings.HasPrefix(line, "> "):
+			if _, err := conn.Write(unquoteSessionData(t, where, line[2:])); err != nil {
+				t.Fatalf("%s: %v", where, err)
+			}
+		case strings.HasPrefix(line, "< "):
+			expected := unquoteSessionData(t, where, line[2:])
+			received := make([]byte, len(expected))
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(reader, received); err != nil {
+				t.Fatalf("%s: expected %q, got %q, %v", where, expected, received, err)
+			}
+
+			if string(received) != string(expected) {
+				t.Fatalf("%s: expected %q, got %q", where, expected, received)
+			}
+		default:
+			t.Fatalf("%s: malformed line %q", where, line)
+		}
+	}
+}
+
+func unquoteSessionData(t *testing.T, where, data string) []byte {
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(data, `"`, `\"`) + `"`)
+	if err != nil {
+		t.Fatalf("%s: %v", where, err)
+	}
+
+	return []byte(unquoted)
+}
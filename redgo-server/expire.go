@@ -0,0 +1,357 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of keys with an expiration sampled on each round of the active expire cycle.
+	activeExpireSampleSize = 20
+	// The cycle keeps sampling while more than this percentage of the sampled keys were expired.
+	activeExpireAcceptablePercent = 25
+	activeExpireCycleInterval     = 100 * time.Millisecond
+	activeExpireCycleTimeLimit    = 25 * time.Millisecond
+)
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+// activeExpireCycle samples keys with an expiration and deletes the expired ones,
+// so keys that are never accessed again still get reclaimed.
+func (ks *Keyspace) activeExpireCycle() {
+	start := time.Now()
+
+	for {
+		ks.Lock()
+
+		sampled, expired := 0, 0
+
+		// Map iteration order is randomized, which gives us the sampling for free.
+		for key := range ks.expires {
+			if sampled == activeExpireSampleSize {
+				break
+			}
+			sampled++
+
+			if ks.expireIfNeeded(key) {
+				expired++
+			}
+		}
+
+		ks.Unlock()
+
+		if sampled == 0 || expired*100/sampled <= activeExpireAcceptablePercent {
+			return
+		}
+
+		if time.Since(start) > activeExpireCycleTimeLimit {
+			return
+		}
+	}
+}
+
+// activeExpireHashFieldsCycle is the counterpart of activeExpireCycle for hash
+// fields. It samples hashes with field expirations rather than single fields.
+func (ks *Keyspace) activeExpireHashFieldsCycle() {
+	start := time.Now()
+
+	for {
+		ks.Lock()
+
+		sampled, expired := 0, 0
+
+		for key := range ks.hashFieldExpires {
+			if sampled == activeExpireSampleSize {
+				break
+			}
+			sampled++
+
+			if ks.expireHashFieldsIfNeeded(key) > 0 {
+				expired++
+			}
+
+			if obj := ks.objects[key]; obj == nil || obj.Type != OBJ_HASH || !obj.Data.(*Hash).HasExpires() {
+				delete(ks.hashFieldExpires, key)
+			}
+		}
+
+		ks.Unlock()
+
+		if sampled == 0 || expired*100/sampled <= activeExpireAcceptablePercent {
+			return
+		}
+
+		if time.Since(start) > activeExpireCycleTimeLimit {
+			return
+		}
+	}
+}
+
+func StartExpireSweeper() {
+	go func() {
+		ticker := time.NewTicker(activeExpireCycleInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			DB.activeExpireCycle()
+			DB.activeExpireHashFieldsCycle()
+		}
+	}()
+}
+
+// absoluteExpiryCommand rewrites commands carrying a relative expiration into an
+// equivalent command with an absolute unix time in milliseconds, e.g.
+// EXPIRE key 10 into PEXPIREAT key <now+10000> and SET key val EX 10 into
+// SET key val PXAT <now+10000>, and HEXPIRE and friends into HPEXPIREAT.
+// Commands that can't be parsed are returned untouched so their handler
+// reports the error.
+func absoluteExpiryCommand(command string, args []Value) (string, []Value) {
+	switch command {
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		if len(args) < 2 {
+			return command, args
+		}
+
+		when, err := strconv.ParseInt(args[1].(BulkStringValue).Val, 10, 64)
+		if err != nil {
+			return command, args
+		}
+
+		var ok bool
+		switch command {
+		case "EXPIRE":
+			when, ok = toAbsoluteMs(when, 1000, nowMs())
+		case "PEXPIRE":
+			when, ok = toAbsoluteMs(when, 1, nowMs())
+		case "EXPIREAT":
+			when, ok = toAbsoluteMs(when, 1000, 0)
+		}
+
+		if !ok {
+			return command, args
+		}
+
+		rewritten := make([]Value, len(args))
+		copy(rewritten, args)
+		rewritten[1] = BulkStringValue{Val: strconv.FormatInt(when, 10)}
+
+		return "PEXPIREAT", rewritten
+	case "HEXPIRE", "HPEXPIRE", "HEXPIREAT":
+		if len(args) < 5 {
+			return command, args
+		}
+
+		// Negative times are rejected by the handler rather than deleting the fields.
+		when, err := strconv.ParseInt(args[1].(BulkStringValue).Val, 10, 64)
+		if err != nil || when < 0 {
+			return command, args
+		}
+
+		var ok bool
+		switch command {
+		case "HEXPIRE":
+			when, ok = toAbsoluteMs(when, 1000, nowMs())
+		case "HPEXPIRE":
+			when, ok = toAbsoluteMs(when, 1, nowMs())
+		case "HEXPIREAT":
+			when, ok = toAbsoluteMs(when, 1000, 0)
+		}
+
+		if !ok {
+			return command, args
+		}
+
+		rewritten := make([]Value, len(args))
+		copy(rewritten, args)
+		rewritten[1] = BulkStringValue{Val: strconv.FormatInt(when, 10)}
+
+		return "HPEXPIREAT", rewritten
+	case "SET":
+		for i := 2; i < len(args)-1; i++ {
+			option := strings.ToUpper(args[i].(BulkStringValue).Val)
+
+			var unit, basetime int64
+			switch option {
+			case "EX":
+				unit, basetime = 1000, nowMs()
+			case "PX":
+				unit, basetime = 1, nowMs()
+			case "EXAT":
+				unit, basetime = 1000, 0
+			default:
+				continue
+			}
+
+			when, err := strconv.ParseInt(args[i+1].(BulkStringValue).Val, 10, 64)
+			if err != nil || when <= 0 {
+				return command, args
+			}
+
+			when, ok := toAbsoluteMs(when, unit, basetime)
+			if !ok {
+				return command, args
+			}
+
+			rewritten := make([]Value, len(args))
+			copy(rewritten, args)
+			rewritten[i] = BulkStringValue{Val: "PXAT"}
+			rewritten[i+1] = BulkStringValue{Val: strconv.FormatInt(when, 10)}
+
+			return command, rewritten
+		}
+	}
+
+	return command, args
+}
+
+// toAbsoluteMs converts an expiration expressed in the given unit (1000 for seconds,
+// 1 for milliseconds) relative to basetime into absolute milliseconds.
+// It returns false if the result would overflow.
+func toAbsoluteMs(when int64, unit int64, basetime int64) (int64, bool) {
+	if when > math.MaxInt64/unit || when < math.MinInt64/unit {
+		return 0, false
+	}
+
+	when *= unit
+
+	if (when > 0 && basetime > math.MaxInt64-when) || (when < 0 && basetime < math.MinInt64-when) {
+		return 0, false
+	}
+
+	return when + basetime, true
+}
+
+func expire(args []Value, _ *Client) Value {
+	return expireGeneric(args, "expire", 1000, nowMs())
+}
+
+func pexpire(args []Value, _ *Client) Value {
+	return expireGeneric(args, "pexpire", 1, nowMs())
+}
+
+func expireat(args []Value, _ *Client) Value {
+	return expireGeneric(args, "expireat", 1000, 0)
+}
+
+func pexpireat(args []Value, _ *Client) Value {
+	return expireGeneric(args, "pexpireat", 1, 0)
+}
+
+// expireGeneric implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT.
+// unit is 1000 when the time argument is in seconds and 1 when it is in milliseconds,
+// basetime is the time the argument is relative to (zero for the *AT variants).
+func expireGeneric(args []Value, name string, unit int64, basetime int64) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	when, err := strconv.ParseInt(args[1].(BulkStringValue).Val, 10, 64)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.(BulkStringValue).Val) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return ErrorValue{Val: "ERR Unsupported option " + arg.(BulkStringValue).Val}
+		}
+	}
+
+	if nx && (xx || gt || lt) {
+		return ErrorValue{Val: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+
+	if gt && lt {
+		return ErrorValue{Val: "ERR GT and LT options at the same time are not compatible"}
+	}
+
+	when, ok := toAbsoluteMs(when, unit, basetime)
+	if !ok {
+		return ErrorValue{Val: "ERR invalid expire time in '" + name + "' command"}
+	}
+
+	if !DB.Exists(key) {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	// A key without an expiration is considered to have an infinite TTL.
+	current, hasExpire := DB.GetExpire(key)
+
+	if (nx && hasExpire) || (xx && !hasExpire) || (gt && (!hasExpire || when <= current)) || (lt && hasExpire && when >= current) {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	if when <= nowMs() {
+		DB.Delete(key)
+		return IntegerValue{Val: 1}
+	}
+
+	DB.SetExpire(key, when)
+
+	return IntegerValue{Val: 1}
+}
+
+func ttl(args []Value, _ *Client) Value {
+	return ttlGeneric(args, "ttl", 1000)
+}
+
+func pttl(args []Value, _ *Client) Value {
+	return ttlGeneric(args, "pttl", 1)
+}
+
+func ttlGeneric(args []Value, name string, unit int64) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	if !DB.Exists(key) {
+		return IntegerValue{Val: -2}
+	}
+
+	when, found := DB.GetExpire(key)
+	if !found {
+		return IntegerValue{Val: -1}
+	}
+
+	remaining := when - nowMs()
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	// Round to the closest unit, like Redis does.
+	return IntegerValue{Val: int((remaining + unit/2) / unit)}
+}
+
+func persist(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'persist' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	if !DB.Exists(key) || !DB.Persist(key) {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	return IntegerValue{Val: 1}
+}
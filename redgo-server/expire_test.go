@@ -0,0 +1,245 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAbsoluteExpiryCommand checks which commands get their relative
+// expiration turned into an absolute one, and that the others are untouched.
+func TestAbsoluteExpiryCommand(t *testing.T) {
+	now := nowMs()
+
+	tests := []struct {
+		command  string
+		expected string
+		// offset is how far from now the expiration is, -1 if it's absolute.
+		offset int64
+	}{
+		{"EXPIRE k 10", "PEXPIREAT k", 10_000},
+		{"PEXPIRE k 10 NX", "PEXPIREAT k", 10},
+		{"EXPIREAT k 1000 GT", "PEXPIREAT k 1000000 GT", -1},
+		{"HEXPIRE k 10 FIELDS 1 f", "HPEXPIREAT k", 10_000},
+		{"HEXPIREAT k 1000 FIELDS 1 f", "HPEXPIREAT k 1000000 FIELDS 1 f", -1},
+		{"SET k v EX 10", "SET k v PXAT", 10_000},
+		{"SET k v NX PX 10 GET", "SET k v NX PXAT", 10},
+		{"SET k v EXAT 1000", "SET k v PXAT 1000000", -1},
+		{"SET k v", "SET k v", -1},
+		{"EXPIRE k ten", "EXPIRE k ten", -1},
+		{"HEXPIRE k -1 FIELDS 1 f", "HEXPIRE k -1 FIELDS 1 f", -1},
+		{"SET k v EX 0", "SET k v EX 0", -1},
+		{"EXPIRE k 9223372036854775807", "EXPIRE k 9223372036854775807", -1},
+	}
+
+	for _, test := range tests {
+		fields := strings.Fields(test.command)
+		args := []Value{}
+		for _, field := range fields[1:] {
+			args = append(args, BulkStringValue{Val: field})
+		}
+
+		command, rewritten := absoluteExpiryCommand(fields[0], args)
+
+		got := []string{command}
+		for _, arg := range rewritten {
+			got = append(got, arg.(BulkStringValue).Val)
+		}
+
+		if test.offset < 0 {
+			if expected := strings.Fields(test.expected); !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: expected %v, got %v", test.command, expected, got)
+			}
+			continue
+		}
+
+		// The expiration follows the prefix expected, and the rest of the
+		// arguments are kept.
+		prefix := strings.Fields(test.expected)
+		if !reflect.DeepEqual(got[:len(prefix)], prefix) || len(got) != len(fields) {
+			t.Errorf("%s: expected %v followed by the expiration, got %v", test.command, prefix, got)
+			continue
+		}
+
+		when, err := strconv.ParseInt(got[len(prefix)], 10, 64)
+		if err != nil || when < now+test.offset || when > nowMs()+test.offset {
+			t.Errorf("%s: expected an expiration %dms from now, got %s", test.command, test.offset, got[len(prefix)])
+		}
+	}
+}
+
+// TestKeyLazyExpiry checks that an expired key is gone as soon as it's
+// accessed, whatever accesses it.
+func TestKeyLazyExpiry(t *testing.T) {
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+
+	client.do("+OK\r\n", "SET", "test:lazy:string", "v", "PX", "20")
+	client.do(":1\r\n", "RPUSH", "test:lazy:list", "a")
+	client.do(":1\r\n", "PEXPIRE", "test:lazy:list", "20")
+	time.Sleep(50 * time.Millisecond)
+
+	client.do("$-1\r\n", "GET", "test:lazy:string")
+	client.do(":-2\r\n", "PTTL", "test:lazy:string")
+	client.do(":0\r\n", "LLEN", "test:lazy:list")
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	for _, key := range []string{"test:lazy:string", "test:lazy:list"} {
+		if _, found := DB.objects[key]; found {
+			t.Fatalf("%s should have been deleted when accessed", key)
+		}
+		if _, found := DB.expires[key]; found {
+			t.Fatalf("%s should no longer have an expiration", key)
+		}
+	}
+}
+
+// TestKeyActiveExpiry checks that the active expire cycle deletes the expired
+// keys nobody accesses, and keeps the others.
+func TestKeyActiveExpiry(t *testing.T) {
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+
+	client.do("+OK\r\n", "SET", "test:active:expired", "v", "PX", "20")
+	client.do("+OK\r\n", "SET", "test:active:kept", "v", "EX", "100")
+	time.Sleep(50 * time.Millisecond)
+
+	DB.activeExpireCycle()
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	if _, found := DB.objects["test:active:expired"]; found {
+		t.Fatal("the expired key should have been deleted")
+	}
+
+	if _, found := DB.objects["test:active:kept"]; !found {
+		t.Fatal("the key not expired yet should have been kept")
+	}
+
+	DB.Delete("test:active:kept")
+}
+
+// TestAofReplayExpired checks that keys given a relative expiration aren't
+// brought back when the AOF is loaded after it passed, as the AOF holds the
+// absolute time they expired at rather than the command run.
+func TestAofReplayExpired(t *testing.T) {
+	dir := filepath.Join(useTempDir(t), serverConfig().AppendDirname)
+
+	aof, err := NewAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTestServerWithAof(t, aof)
+	client := dialTestClient(t, addr)
+
+	client.do("+OK\r\n", "SET", "test:replay:set", "v", "EX", "1")
+	client.do("+OK\r\n", "SET", "test:replay:expire", "v")
+	client.do(":1\r\n", "EXPIRE", "test:replay:expire", "1")
+
+	if err := aof.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, aof.manifest.incrs[len(aof.manifest.incrs)-1].name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "$6\r\nEXPIRE\r\n") || !strings.Contains(string(data), "PEXPIREAT") || !strings.Contains(string(data), "PXAT") {
+		t.Fatalf("the AOF should hold absolute expirations, got %q", data)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	DB.Lock()
+	DB.Delete("test:replay:set")
+	DB.Delete("test:replay:expire")
+	DB.Unlock()
+
+	reloaded, err := NewAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.do(":0\r\n", "EXISTS", "test:replay:set", "test:replay:expire")
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	for _, key := range []string{"test:replay:set", "test:replay:expire"} {
+		if _, found := DB.objects[key]; found {
+			t.Fatalf("%s was brought back by the AOF after it expired", key)
+		}
+	}
+}
+
+// TestHashFieldLazyExpiry checks that an expired field is gone as soon as it's
+// accessed, and the hash with its last field.
+func TestHashFieldLazyExpiry(t *testing.T) {
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+
+	client.do(":2\r\n", "HSET", "test:lazy", "short", "1", "long", "2")
+	client.do("*1\r\n:1\r\n", "HPEXPIRE", "test:lazy", "20", "FIELDS", "1", "short")
+	client.do("*1\r\n:1\r\n", "HEXPIRE", "test:lazy", "100", "FIELDS", "1", "long")
+	time.Sleep(50 * time.Millisecond)
+
+	client.do("$-1\r\n", "HGET", "test:lazy", "short")
+	client.do(":1\r\n", "HLEN", "test:lazy")
+	client.do("*1\r\n:-2\r\n", "HTTL", "test:lazy", "FIELDS", "1", "short")
+
+	client.do("*1\r\n:1\r\n", "HPEXPIRE", "test:lazy", "20", "FIELDS", "1", "long")
+	time.Sleep(50 * time.Millisecond)
+
+	client.do(":0\r\n", "EXISTS", "test:lazy")
+}
+
+// TestHashFieldActiveExpiry checks that the active expire cycle deletes the
+// expired fields of hashes nobody accesses.
+func TestHashFieldActiveExpiry(t *testing.T) {
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+
+	client.do(":3\r\n", "HSET", "test:active", "a", "1", "b", "2", "c", "3")
+	client.do("*2\r\n:1\r\n:1\r\n", "HPEXPIRE", "test:active", "20", "FIELDS", "2", "a", "b")
+	client.do(":1\r\n", "HSET", "test:emptied", "a", "1")
+	client.do("*1\r\n:1\r\n", "HPEXPIRE", "test:emptied", "20", "FIELDS", "1", "a")
+	time.Sleep(50 * time.Millisecond)
+
+	DB.activeExpireHashFieldsCycle()
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	if obj := DB.objects["test:active"]; obj == nil || obj.Data.(*Hash).Len() != 1 {
+		t.Fatal("the expired fields should have been deleted, and the other one kept")
+	}
+
+	if _, found := DB.objects["test:emptied"]; found {
+		t.Fatal("the hash should have been deleted with its last field")
+	}
+
+	for _, key := range []string{"test:active", "test:emptied"} {
+		if _, found := DB.hashFieldExpires[key]; found {
+			t.Fatalf("%s should no longer be tracked by the active expire cycle", key)
+		}
+	}
+
+	delete(DB.objects, "test:active")
+}
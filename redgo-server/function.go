@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// functionLoadTimeout bounds the time the body of a library runs when loaded,
+// which is meant to do nothing but register functions.
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionDumpPrefix starts the payload of FUNCTION DUMP, followed by the code of
+// every library as a RESP array.
+const functionDumpPrefix = "REDGO-FUNCTIONS 1\n"
+
+// Library is a set of functions loaded together from a Lua script. Its
+// interpreter is kept for as long as the library is loaded, as the functions
+// are closures living in it.
+type Library struct {
+	Name      string
+	Code      string
+	Functions map[string]*Function
+	state     *lua.LState
+}
+
+type Function struct {
+	Name        string
+	Description string
+	// NoWrites is set by the no-writes flag, which allows FCALL_RO.
+	NoWrites bool
+	library  *Library
+	callback *lua.LFunction
+}
+
+// Loaded libraries and their functions, guarded by the keyspace lock.
+var (
+	libraries = make(map[string]*Library)
+	functions = make(map[string]*Function)
+)
+
+// FCALL and FCALL_RO run other commands through the command table, and FUNCTION
+// creates the interpreters doing so, so they can't be part of the table's
+// initializer.
+func init() {
+	Handlers["FCALL"] = Command{Handler: fcall, Arity: -3, GetKeys: evalKeys}
+	Handlers["FCALL_RO"] = Command{Handler: fcallRO, Arity: -3, GetKeys: evalKeys}
+	Handlers["FUNCTION"] = Command{Handler: function, Write: true, Arity: -2}
+}
+
+func isValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseLibraryMetadata reads the library name from the shebang line the code
+// must start with, as in "#!lua name=mylib".
+func parseLibraryMetadata(code string) (string, Value) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", ErrorValue{Val: "ERR Missing library metadata"}
+	}
+
+	shebang, _, _ := strings.Cut(code, "\n")
+	fields := strings.Fields(shebang[2:])
+
+	if len(fields) == 0 || fields[0] != "lua" {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+
+		return "", ErrorValue{Val: "ERR Engine '" + engine + "' not found"}
+	}
+
+	name := ""
+	for _, field := range fields[1:] {
+		value, found := strings.CutPrefix(field, "name=")
+		if !found {
+			return "", ErrorValue{Val: "ERR Invalid metadata value given: " + field}
+		}
+
+		name = value
+	}
+
+	if name == "" {
+		return "", ErrorValue{Val: "ERR Library name was not given"}
+	}
+
+	if !isValidFunctionName(name) {
+		return "", ErrorValue{Val: "ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long"}
+	}
+
+	return name, nil
+}
+
+// loadLibrary runs the code of a library, collecting the functions it
+// registers. The library isn't added to the registry.
+func loadLibrary(code string) (*Library, Value) {
+	name, errValue := parseLibraryMetadata(code)
+	if errValue != nil {
+		return nil, errValue
+	}
+
+	// The shebang isn't Lua, so it's dropped, but not the line break that ends
+	// it, to keep line numbers right.
+	body := ""
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		body = code[i:]
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(body), "user_function")
+	if err != nil {
+		return nil, ErrorValue{Val: "ERR Error compiling function: " + firstLine(err.Error())}
+	}
+
+	proto, err := lua.Compile(chunk, "user_function")
+	if err != nil {
+		return nil, ErrorValue{Val: "ERR Error compiling function: " + firstLine(err.Error())}
+	}
+
+	library := &Library{Name: name, Code: code, Functions: make(map[string]*Function)}
+
+	L := newScriptState()
+	L.GetGlobal("redis").(*lua.LTable).RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		return registerFunction(L, library)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	err = L.PCall(0, 0, nil)
+
+	L.RemoveContext()
+
+	if err != nil {
+		L.Close()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrorValue{Val: "ERR FUNCTION LOAD timeout"}
+		}
+
+		msg, _ := luaErrorMessage(err)
+
+		return nil, ErrorValue{Val: "ERR Error registering functions: " + msg}
+	}
+
+	if len(library.Functions) == 0 {
+		L.Close()
+		return nil, ErrorValue{Val: "ERR No functions registered"}
+	}
+
+	// Registering only makes sense while loading.
+	L.GetGlobal("redis").(*lua.LTable).RawSetString("register_function", lua.LNil)
+	library.state = L
+
+	return library, nil
+}
+
+// registerFunction implements redis.register_function, which takes either a
+// name and a callback or a table with function_name, callback and optionally
+// description and flags.
+func registerFunction(L *lua.LState, library *Library) int {
+	fn := &Function{library: library}
+
+	switch arg := L.Get(1).(type) {
+	case lua.LString:
+		fn.Name = string(arg)
+		fn.callback, _ = L.Get(2).(*lua.LFunction)
+	case *lua.LTable:
+		if name, ok := arg.RawGetString("function_name").(lua.LString); ok {
+			fn.Name = string(name)
+		}
+
+		fn.callback, _ = arg.RawGetString("callback").(*lua.LFunction)
+
+		if description, ok := arg.RawGetString("description").(lua.LString); ok {
+			fn.Description = string(description)
+		}
+
+		if flags, ok := arg.RawGetString("flags").(*lua.LTable); ok {
+			for i := 1; i <= flags.Len(); i++ {
+				switch flags.RawGetInt(i).String() {
+				case "no-writes":
+					fn.NoWrites = true
+				case "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys":
+					// Accepted for compatibility, they don't apply here.
+				default:
+					L.RaiseError("unknown flag given")
+				}
+			}
+		}
+	default:
+		L.RaiseError("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+	}
+
+	if !isValidFunctionName(fn.Name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	if fn.callback == nil {
+		L.RaiseError("callback argument must be a function")
+	}
+
+	if _, found := library.Functions[fn.Name]; found {
+		L.RaiseError("Function already exists in the library")
+	}
+
+	library.Functions[fn.Name] = fn
+
+	return 0
+}
+
+// addLibrary adds a loaded library to the registry, replacing the existing one
+// with the same name if replace is set.
+func addLibrary(library *Library, replace bool) Value {
+	existing, found := libraries[library.Name]
+	if found && !replace {
+		return ErrorValue{Val: "ERR Library '" + library.Name + "' already exists"}
+	}
+
+	for name := range library.Functions {
+		if fn, found := functions[name]; found && fn.library != existing {
+			return ErrorValue{Val: "ERR Function " + name + " already exists"}
+		}
+	}
+
+	if found {
+		deleteLibrary(existing)
+	}
+
+	libraries[library.Name] = library
+	for name, fn := range library.Functions {
+		functions[name] = fn
+	}
+
+	return nil
+}
+
+func deleteLibrary(library *Library) {
+	for name := range library.Functions {
+		delete(functions, name)
+	}
+
+	delete(libraries, library.Name)
+	library.state.Close()
+}
+
+func flushLibraries() {
+	for _, library := range libraries {
+		deleteLibrary(library)
+	}
+}
+
+func fcall(args []Value, client *Client) Value {
+	return fcallGeneric(args, client, false)
+}
+
+func fcallRO(args []Value, client *Client) Value {
+	return fcallGeneric(args, client, true)
+}
+
+// fcallGeneric calls a function with the keys and arguments as its two
+// parameters.
+func fcallGeneric(args []Value, client *Client, readOnly bool) Value {
+	fn, found := functions[args[0].(BulkStringValue).Val]
+	if !found {
+		return ErrorValue{Val: "ERR Function not found"}
+	}
+
+	numkeys, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	if numkeys < 0 {
+		return ErrorValue{Val: "ERR Number of keys can't be negative"}
+	}
+
+	if numkeys > len(args)-2 {
+		return ErrorValue{Val: "ERR Number of keys can't be greater than number of args"}
+	}
+
+	if readOnly && !fn.NoWrites {
+		return ErrorValue{Val: "ERR Can not execute a script with write flag using *_ro command."}
+	}
+
+	L := fn.library.state
+	keys := stringsToLuaTable(L, args[2:2+numkeys])
+	argv := stringsToLuaTable(L, args[2+numkeys:])
+
+	return runScript(L, fn.callback, []lua.LValue{keys, argv}, client, fn.NoWrites)
+}
+
+func function(args []Value, _ *Client) Value {
+	subcommand := strings.ToUpper(args[0].(BulkStringValue).Val)
+
+	// Only the subcommands changing the libraries are propagated, so the AOF
+	// reloads them on startup.
+	switch subcommand {
+	case "LOAD", "DELETE", "FLUSH", "RESTORE":
+	default:
+		preventCommandPropagation()
+	}
+
+	switch {
+	case subcommand == "LOAD" && (len(args) == 2 || len(args) == 3):
+		replace := false
+		if len(args) == 3 {
+			if strings.ToUpper(args[1].(BulkStringValue).Val) != "REPLACE" {
+				return ErrorValue{Val: "ERR Unknown option given: " + args[1].(BulkStringValue).Val}
+			}
+			replace = true
+		}
+
+		library, errValue := loadLibrary(args[len(args)-1].(BulkStringValue).Val)
+		if errValue != nil {
+			return errValue
+		}
+
+		if errValue := addLibrary(library, replace); errValue != nil {
+			library.state.Close()
+			return errValue
+		}
+
+		return BulkStringValue{Val: library.Name}
+	case subcommand == "DELETE" && len(args) == 2:
+		library, found := libraries[args[1].(BulkStringValue).Val]
+		if !found {
+			return ErrorValue{Val: "ERR Library not found"}
+		}
+
+		deleteLibrary(library)
+
+		return StringValue{Val: "OK"}
+	case subcommand == "FLUSH" && len(args) <= 2:
+		if len(args) == 2 {
+			mode := strings.ToUpper(args[1].(BulkStringValue).Val)
+			if mode != "ASYNC" && mode != "SYNC" {
+				return ErrorValue{Val: "ERR FUNCTION FLUSH only supports SYNC|ASYNC option"}
+			}
+		}
+
+		flushLibraries()
+
+		return StringValue{Val: "OK"}
+	case subcommand == "LIST":
+		return functionList(args[1:])
+	case subcommand == "DUMP" && len(args) == 1:
+		return BulkStringValue{Val: functionDump()}
+	case subcommand == "RESTORE" && (len(args) == 2 || len(args) == 3):
+		policy := "APPEND"
+		if len(args) == 3 {
+			policy = strings.ToUpper(args[2].(BulkStringValue).Val)
+		}
+
+		return functionRestore(args[1].(BulkStringValue).Val, policy)
+	case subcommand == "KILL" && len(args) == 1:
+		runningScriptMutex.Lock()
+		defer runningScriptMutex.Unlock()
+
+		return killScript()
+	default:
+		return ErrorValue{Val: "ERR unknown subcommand or wrong number of arguments for '" + args[0].(BulkStringValue).Val + "'. Try FUNCTION HELP."}
+	}
+}
+
+// functionList implements FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE].
+func functionList(args []Value) Value {
+	pattern := ""
+	withCode := false
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].(BulkStringValue).Val)
+
+		switch {
+		case option == "WITHCODE" && !withCode:
+			withCode = true
+		case option == "LIBRARYNAME" && pattern == "" && i+1 < len(args):
+			pattern = args[i+1].(BulkStringValue).Val
+			i++
+		default:
+			return ErrorValue{Val: "ERR Unknown argument " + args[i].(BulkStringValue).Val}
+		}
+	}
+
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		if pattern == "" || stringMatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	array := make([]Value, 0, len(names))
+	for _, name := range names {
+		library := libraries[name]
+
+		fnNames := make([]string, 0, len(library.Functions))
+		for fnName := range library.Functions {
+			fnNames = append(fnNames, fnName)
+		}
+		sort.Strings(fnNames)
+
+		fns := make([]Value, 0, len(fnNames))
+		for _, fnName := range fnNames {
+			fn := library.Functions[fnName]
+
+			var description Value = NullValue{}
+			if fn.Description != "" {
+				description = BulkStringValue{Val: fn.Description}
+			}
+
+			flags := []Value{}
+			if fn.NoWrites {
+				flags = append(flags, StringValue{Val: "no-writes"})
+			}
+
+			fns = append(fns, ArrayValue{Val: []Value{
+				BulkStringValue{Val: "name"}, BulkStringValue{Val: fn.Name},
+				BulkStringValue{Val: "description"}, description,
+				BulkStringValue{Val: "flags"}, ArrayValue{Val: flags},
+			}})
+		}
+
+		entry := []Value{
+			BulkStringValue{Val: "library_name"}, BulkStringValue{Val: library.Name},
+			BulkStringValue{Val: "engine"}, BulkStringValue{Val: "LUA"},
+			BulkStringValue{Val: "functions"}, ArrayValue{Val: fns},
+		}
+
+		if withCode {
+			entry = append(entry, BulkStringValue{Val: "library_code"}, BulkStringValue{Val: library.Code})
+		}
+
+		array = append(array, ArrayValue{Val: entry})
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// functionDump serializes the code of every library, which is all it takes to
+// load them again.
+func functionDump() string {
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	codes := make([]Value, len(names))
+	for i, name := range names {
+		codes[i] = BulkStringValue{Val: libraries[name].Code}
+	}
+
+	return functionDumpPrefix + string(ArrayValue{Val: codes}.Marshal())
+}
+
+// functionRestore loads the libraries of a FUNCTION DUMP payload. With the
+// APPEND policy a library that already exists is an error, REPLACE replaces
+// it and FLUSH deletes every library first. Nothing changes if any library
+// fails to load.
+func functionRestore(payload string, policy string) Value {
+	if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+		return ErrorValue{Val: "ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."}
+	}
+
+	invalidPayload := ErrorValue{Val: "ERR invalid FUNCTION DUMP payload"}
+
+	encoded, found := strings.CutPrefix(payload, functionDumpPrefix)
+	if !found {
+		return invalidPayload
+	}
+
+	value, err := NewReader(strings.NewReader(encoded)).ParseFromRespString()
+	codes, ok := value.(ArrayValue)
+	if err != nil || !ok {
+		return invalidPayload
+	}
+
+	loaded := make(map[string]*Library)
+	errValue := func() Value {
+		for _, code := range codes.Val {
+			bulk, ok := code.(BulkStringValue)
+			if !ok {
+				return invalidPayload
+			}
+
+			library, errValue := loadLibrary(bulk.Val)
+			if errValue != nil {
+				return errValue
+			}
+
+			if _, found := loaded[library.Name]; found {
+				library.state.Close()
+				return ErrorValue{Val: "ERR Library " + library.Name + " already exists"}
+			}
+			loaded[library.Name] = library
+		}
+
+		// Work out the functions there will be once restored, so a conflict is
+		// found before anything changes.
+		owners := make(map[string]string)
+		if policy != "FLUSH" {
+			for name, library := range libraries {
+				if _, found := loaded[name]; found {
+					if policy == "APPEND" {
+						return ErrorValue{Val: "ERR Library " + name + " already exists"}
+					}
+					continue
+				}
+
+				for fnName := range library.Functions {
+					owners[fnName] = name
+				}
+			}
+		}
+
+		for name, library := range loaded {
+			for fnName := range library.Functions {
+				if _, found := owners[fnName]; found {
+					return ErrorValue{Val: "ERR Function " + fnName + " already exists"}
+				}
+				owners[fnName] = name
+			}
+		}
+
+		return nil
+	}()
+
+	if errValue != nil {
+		for _, library := range loaded {
+			library.state.Close()
+		}
+
+		return errValue
+	}
+
+	if policy == "FLUSH" {
+		flushLibraries()
+	}
+
+	for name := range loaded {
+		if existing, found := libraries[name]; found {
+			deleteLibrary(existing)
+		}
+	}
+
+	for _, library := range loaded {
+		addLibrary(library, false)
+	}
+
+	return StringValue{Val: "OK"}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestFunctionDumpRestore checks that a FUNCTION DUMP payload restores the
+// libraries it was taken from, with each of the restore policies.
+func TestFunctionDumpRestore(t *testing.T) {
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+	t.Cleanup(func() { client.do("+OK\r\n", "FUNCTION", "FLUSH") })
+
+	code := "#!lua name=testlib\nredis.register_function('test_fn', function() return 'restored' end)"
+	payload := functionDumpPrefix + string(ArrayValue{Val: []Value{BulkStringValue{Val: code}}}.Marshal())
+
+	client.do("$7\r\ntestlib\r\n", "FUNCTION", "LOAD", code)
+	client.do("$"+strconv.Itoa(len(payload))+"\r\n"+payload+"\r\n", "FUNCTION", "DUMP")
+
+	client.do("-ERR Library testlib already exists\r\n", "FUNCTION", "RESTORE", payload)
+	client.do("+OK\r\n", "FUNCTION", "DELETE", "testlib")
+	client.do("+OK\r\n", "FUNCTION", "RESTORE", payload)
+	client.do("$8\r\nrestored\r\n", "FCALL", "test_fn", "0")
+
+	// REPLACE keeps the other libraries, FLUSH doesn't.
+	client.do("$9\r\ntestother\r\n", "FUNCTION", "LOAD", "#!lua name=testother\nredis.register_function('test_other', function() return 1 end)")
+	client.do("+OK\r\n", "FUNCTION", "RESTORE", payload, "REPLACE")
+	client.do(":1\r\n", "FCALL", "test_other", "0")
+	client.do("+OK\r\n", "FUNCTION", "RESTORE", payload, "FLUSH")
+	client.do("-ERR Function not found\r\n", "FCALL", "test_other", "0")
+	client.do("$8\r\nrestored\r\n", "FCALL", "test_fn", "0")
+
+	// A function of another library with the same name fails the whole restore.
+	client.do("+OK\r\n", "FUNCTION", "FLUSH")
+	client.do("$9\r\ntestclash\r\n", "FUNCTION", "LOAD", "#!lua name=testclash\nredis.register_function('test_fn', function() return 'clash' end)")
+	client.do("-ERR Function test_fn already exists\r\n", "FUNCTION", "RESTORE", payload, "REPLACE")
+	client.do("$5\r\nclash\r\n", "FCALL", "test_fn", "0")
+}
@@ -0,0 +1,90 @@
+package main
+
+// stringMatch reports whether s matches the glob-style pattern, the syntax Redis
+// uses in commands like SCAN and KEYS: "*" matches any run of characters, "?"
+// a single character, "[...]" a character class that may be negated with "^"
+// and hold ranges like "a-z", and "\" escapes the next character.
+func stringMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if stringMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+
+			pattern = pattern[1:]
+
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+
+			// An unterminated class extends to the end of the pattern.
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					match = match || pattern[0] == s[0]
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+
+					match = match || (s[0] >= start && s[0] <= end)
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == s[0]
+				}
+
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+
+			if match == negate {
+				return false
+			}
+
+			s = s[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+
+	return len(s) == 0
+}
@@ -1,3 +1,5 @@
 module redgo
 
 go 1.22.4
+
+require github.com/yuin/gopher-lua v1.1.1
@@ -1,75 +1,550 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
+	"runtime/debug"
+	"strconv"
 	"strings"
-	"sync"
+	"unsafe"
 )
 
-var Handlers = map[string]func([]Value, *Client) Value{
-	"PING":        ping,
-	"SET":         set,
-	"DEL":         del,
-	"GET":         get,
-	"HSET":        hset,
-	"HGET":        hget,
-	"HGETALL":     hgetall,
-	"SUBSCRIBE":   subscribe,
-	"UNSUBSCRIBE": unsubscribe,
-	"PUBLISH":     publish,
+type Command struct {
+	Handler func([]Value, *Client) Value
+	// Write marks commands that modify the dataset and must be appended to the AOF.
+	Write bool
+	// Arity is the number of arguments including the command name, as in Redis:
+	// a negative arity -N means at least N.
+	Arity int
+	// FirstKey, LastKey and KeyStep give the position of the keys in the
+	// arguments, the command name being at 0. A negative LastKey counts from the
+	// end. Commands whose keys can't be described this way, like ZUNIONSTORE
+	// with its numkeys, extract them with GetKeys instead.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	GetKeys  func(argv []Value) []string
+	// NoMulti marks commands that can't be queued in a transaction.
+	NoMulti bool
 }
 
-var SETs = map[string]string{}
-var HSETs = map[string]map[string]string{}
+// checkArity tells whether argc, which counts the command name, matches the arity.
+func (c Command) checkArity(argc int) bool {
+	if c.Arity >= 0 {
+		return argc == c.Arity
+	}
+
+	return argc >= -c.Arity
+}
+
+// commandKeys returns the keys of a command given with its name in argv[0].
+func commandKeys(argv []Value) []string {
+	cmd, found := Handlers[strings.ToUpper(argv[0].(BulkStringValue).Val)]
+	if !found || !cmd.checkArity(len(argv)) {
+		return nil
+	}
+
+	if cmd.GetKeys != nil {
+		return cmd.GetKeys(argv)
+	}
+
+	if cmd.FirstKey == 0 {
+		return nil
+	}
+
+	last := cmd.LastKey
+	if last < 0 {
+		last += len(argv)
+	}
+
+	var keys []string
+	for i := cmd.FirstKey; i <= last && i < len(argv); i += cmd.KeyStep {
+		keys = append(keys, argv[i].(BulkStringValue).Val)
+	}
+
+	return keys
+}
+
+// keysAfterNumkeys returns the keys that follow the count at argv[i], as in
+// LMPOP numkeys key [key ...].
+func keysAfterNumkeys(argv []Value, i int) []string {
+	if i >= len(argv) {
+		return nil
+	}
+
+	numkeys, err := strconv.Atoi(argv[i].(BulkStringValue).Val)
+	if err != nil || numkeys <= 0 || numkeys > len(argv)-i-1 {
+		return nil
+	}
+
+	keys := make([]string, numkeys)
+	for j := range keys {
+		keys[j] = argv[i+1+j].(BulkStringValue).Val
+	}
+
+	return keys
+}
+
+var Handlers = map[string]Command{
+	"PING":             {Handler: ping, Arity: -1},
+	"HELLO":            {Handler: hello, Arity: -1},
+	"AUTH":             {Handler: auth, Arity: -2},
+	"CONFIG":           {Handler: config, Arity: -2},
+	"SHUTDOWN":         {Handler: shutdown, Arity: -1, NoMulti: true},
+	"INFO":             {Handler: info, Arity: -1},
+	"BGREWRITEAOF":     {Handler: bgrewriteaof, Arity: 1},
+	"SAVE":             {Handler: save, Arity: 1, NoMulti: true},
+	"BGSAVE":           {Handler: bgsave, Arity: -1},
+	"LASTSAVE":         {Handler: lastsave, Arity: 1},
+	"SET":              {Handler: set, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"GET":              {Handler: get, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"INCR":             {Handler: incr, Write: true, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"DECR":             {Handler: decr, Write: true, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"INCRBY":           {Handler: incrby, Write: true, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"DECRBY":           {Handler: decrby, Write: true, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"INCRBYFLOAT":      {Handler: incrbyfloat, Write: true, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"APPEND":           {Handler: appendCommand, Write: true, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"STRLEN":           {Handler: strlen, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"GETRANGE":         {Handler: getrange, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SETRANGE":         {Handler: setrange, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"GETSET":           {Handler: getset, Write: true, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"GETDEL":           {Handler: getdel, Write: true, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"GETEX":            {Handler: getex, Write: true, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"MGET":             {Handler: mget, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"MSET":             {Handler: mset, Write: true, Arity: -3, FirstKey: 1, LastKey: -1, KeyStep: 2},
+	"MSETNX":           {Handler: msetnx, Write: true, Arity: -3, FirstKey: 1, LastKey: -1, KeyStep: 2},
+	"DEL":              {Handler: del, Write: true, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"EXISTS":           {Handler: exists, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"TYPE":             {Handler: typeCommand, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"RENAME":           {Handler: rename, Write: true, Arity: 3, FirstKey: 1, LastKey: 2, KeyStep: 1},
+	"RENAMENX":         {Handler: renamenx, Write: true, Arity: 3, FirstKey: 1, LastKey: 2, KeyStep: 1},
+	"HSET":             {Handler: hset, Write: true, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HGET":             {Handler: hget, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HGETALL":          {Handler: hgetall, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HSETNX":           {Handler: hsetnx, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HMSET":            {Handler: hmset, Write: true, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HMGET":            {Handler: hmget, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HKEYS":            {Handler: hkeys, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HVALS":            {Handler: hvals, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HDEL":             {Handler: hdel, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HEXISTS":          {Handler: hexists, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HLEN":             {Handler: hlen, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HSTRLEN":          {Handler: hstrlen, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HINCRBY":          {Handler: hincrby, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HINCRBYFLOAT":     {Handler: hincrbyfloat, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HRANDFIELD":       {Handler: hrandfield, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HSCAN":            {Handler: hscan, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HEXPIRE":          {Handler: hexpire, Write: true, Arity: -6, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HPEXPIRE":         {Handler: hpexpire, Write: true, Arity: -6, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HEXPIREAT":        {Handler: hexpireat, Write: true, Arity: -6, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HPEXPIREAT":       {Handler: hpexpireat, Write: true, Arity: -6, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HTTL":             {Handler: httl, Arity: -5, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HPTTL":            {Handler: hpttl, Arity: -5, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"HPERSIST":         {Handler: hpersist, Write: true, Arity: -5, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LPUSH":            {Handler: lpush, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"RPUSH":            {Handler: rpush, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LPUSHX":           {Handler: lpushx, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"RPUSHX":           {Handler: rpushx, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LPOP":             {Handler: lpop, Write: true, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"RPOP":             {Handler: rpop, Write: true, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LLEN":             {Handler: llen, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LINDEX":           {Handler: lindex, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LSET":             {Handler: lset, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LRANGE":           {Handler: lrange, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LREM":             {Handler: lrem, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LTRIM":            {Handler: ltrim, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LINSERT":          {Handler: linsert, Write: true, Arity: 5, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LPOS":             {Handler: lpos, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"LMOVE":            {Handler: lmove, Write: true, Arity: 5, FirstKey: 1, LastKey: 2, KeyStep: 1},
+	"RPOPLPUSH":        {Handler: rpoplpush, Write: true, Arity: 3, FirstKey: 1, LastKey: 2, KeyStep: 1},
+	"LMPOP":            {Handler: lmpop, Write: true, Arity: -4, GetKeys: lmpopKeys},
+	"BLPOP":            {Handler: blpop, Write: true, Arity: -3, FirstKey: 1, LastKey: -2, KeyStep: 1},
+	"BRPOP":            {Handler: brpop, Write: true, Arity: -3, FirstKey: 1, LastKey: -2, KeyStep: 1},
+	"BLMOVE":           {Handler: blmove, Write: true, Arity: 6, FirstKey: 1, LastKey: 2, KeyStep: 1},
+	"BRPOPLPUSH":       {Handler: brpoplpush, Write: true, Arity: 4, FirstKey: 1, LastKey: 2, KeyStep: 1},
+	"BLMPOP":           {Handler: blmpop, Write: true, Arity: -5, GetKeys: blmpopKeys},
+	"SADD":             {Handler: sadd, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SREM":             {Handler: srem, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SMEMBERS":         {Handler: smembers, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SISMEMBER":        {Handler: sismember, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SMISMEMBER":       {Handler: smismember, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SCARD":            {Handler: scard, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SMOVE":            {Handler: smove, Write: true, Arity: 4, FirstKey: 1, LastKey: 2, KeyStep: 1},
+	"SRANDMEMBER":      {Handler: srandmember, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SPOP":             {Handler: spop, Write: true, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SINTER":           {Handler: sinter, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"SUNION":           {Handler: sunion, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"SDIFF":            {Handler: sdiff, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"SINTERSTORE":      {Handler: sinterstore, Write: true, Arity: -3, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"SUNIONSTORE":      {Handler: sunionstore, Write: true, Arity: -3, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"SDIFFSTORE":       {Handler: sdiffstore, Write: true, Arity: -3, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"SINTERCARD":       {Handler: sintercard, Arity: -3, GetKeys: sintercardKeys},
+	"ZADD":             {Handler: zadd, Write: true, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZINCRBY":          {Handler: zincrby, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREM":             {Handler: zrem, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZCARD":            {Handler: zcard, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZSCORE":           {Handler: zscore, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZMSCORE":          {Handler: zmscore, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZRANK":            {Handler: zrank, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREVRANK":         {Handler: zrevrank, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZRANGE":           {Handler: zrange, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREVRANGE":        {Handler: zrevrange, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZRANGEBYSCORE":    {Handler: zrangebyscore, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREVRANGEBYSCORE": {Handler: zrevrangebyscore, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZRANGEBYLEX":      {Handler: zrangebylex, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREVRANGEBYLEX":   {Handler: zrevrangebylex, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZCOUNT":           {Handler: zcount, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZLEXCOUNT":        {Handler: zlexcount, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREMRANGEBYRANK":  {Handler: zremrangebyrank, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREMRANGEBYSCORE": {Handler: zremrangebyscore, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZREMRANGEBYLEX":   {Handler: zremrangebylex, Write: true, Arity: 4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZPOPMIN":          {Handler: zpopmin, Write: true, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZPOPMAX":          {Handler: zpopmax, Write: true, Arity: -2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"ZUNIONSTORE":      {Handler: zunionstore, Write: true, Arity: -4, GetKeys: zstoreKeys},
+	"ZINTERSTORE":      {Handler: zinterstore, Write: true, Arity: -4, GetKeys: zstoreKeys},
+	"XADD":             {Handler: xadd, Write: true, Arity: -5, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XLEN":             {Handler: xlen, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XRANGE":           {Handler: xrange, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XREVRANGE":        {Handler: xrevrange, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XDEL":             {Handler: xdel, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XSETID":           {Handler: xsetid, Write: true, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XTRIM":            {Handler: xtrim, Write: true, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XREAD":            {Handler: xread, Arity: -4, GetKeys: xreadKeys},
+	"XGROUP":           {Handler: xgroup, Write: true, Arity: -2, FirstKey: 2, LastKey: 2, KeyStep: 1},
+	"XREADGROUP":       {Handler: xreadgroup, Write: true, Arity: -7, GetKeys: xreadgroupKeys},
+	"XACK":             {Handler: xack, Write: true, Arity: -4, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XPENDING":         {Handler: xpending, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XCLAIM":           {Handler: xclaim, Write: true, Arity: -6, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"XAUTOCLAIM":       {Handler: xautoclaim, Write: true, Arity: -6, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"EXPIRE":           {Handler: expire, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"PEXPIRE":          {Handler: pexpire, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"EXPIREAT":         {Handler: expireat, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"PEXPIREAT":        {Handler: pexpireat, Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"TTL":              {Handler: ttl, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"PTTL":             {Handler: pttl, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"PERSIST":          {Handler: persist, Write: true, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"SUBSCRIBE":        {Handler: subscribe, Arity: -2, NoMulti: true},
+	"UNSUBSCRIBE":      {Handler: unsubscribe, Arity: -1, NoMulti: true},
+	"MULTI":            {Handler: multi, Arity: 1},
+	"DISCARD":          {Handler: discard, Arity: 1},
+	"WATCH":            {Handler: watch, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"UNWATCH":          {Handler: unwatch, Arity: 1},
+	"SCRIPT":           {Handler: script, Arity: -2},
+	"PUBLISH":          {Handler: publish, Arity: 3},
+}
 
-var SETsMutex = sync.RWMutex{}
-var HSETsMutex = sync.RWMutex{}
+var (
+	SyntaxError     = ErrorValue{Val: "ERR syntax error"}
+	NotIntegerError = ErrorValue{Val: "ERR value is not an integer or out of range"}
+)
 
 func ping(args []Value, _ *Client) Value {
 	if len(args) > 1 {
 		return ErrorValue{Val: "ERR wrong number of arguments for 'ping' command"}
 	}
 
-	msg := "PONG"
-
 	if len(args) == 1 {
-		msg = args[0].(BulkStringValue).Val
+		return BulkStringValue{Val: args[0].(BulkStringValue).Val}
+	}
+
+	return StringValue{Val: "PONG"}
+}
+
+// Version reported by HELLO.
+const redgoVersion = "0.1.0"
+
+// hello switches the connection to the requested protocol, authenticating and
+// naming the client if asked, and replies with information about the server.
+func hello(args []Value, client *Client) Value {
+	protocol := client.Writer.Protocol()
+
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0].(BulkStringValue).Val)
+		if err != nil {
+			return ErrorValue{Val: "ERR Protocol version is not an integer or out of range"}
+		}
+
+		if version < 2 || version > 3 {
+			return ErrorValue{Val: "NOPROTO unsupported protocol version"}
+		}
+
+		protocol = version
+	}
+
+	name, setName := "", false
+	authenticated := false
+
+	for i := 1; i < len(args); i++ {
+		option := args[i].(BulkStringValue).Val
+
+		switch strings.ToUpper(option) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return ErrorValue{Val: "ERR Syntax error in HELLO option '" + option + "'"}
+			}
+
+			if !checkPassword(args[i+1].(BulkStringValue).Val, args[i+2].(BulkStringValue).Val) {
+				return ErrorValue{Val: "WRONGPASS invalid username-password pair or user is disabled."}
+			}
+
+			authenticated = true
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return ErrorValue{Val: "ERR Syntax error in HELLO option '" + option + "'"}
+			}
+
+			name, setName = args[i+1].(BulkStringValue).Val, true
+			if !isValidClientName(name) {
+				return ErrorValue{Val: "ERR Client names cannot contain spaces, newlines or special characters."}
+			}
+
+			i++
+		default:
+			return ErrorValue{Val: "ERR Syntax error in HELLO option '" + option + "'"}
+		}
+	}
+
+	if !authenticated && authRequired(client) {
+		return ErrorValue{Val: "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	if authenticated {
+		client.Authenticated = true
+	}
+
+	if setName {
+		client.Name = name
 	}
 
-	return BulkStringValue{Val: msg}
+	// The reply is already sent in the new protocol.
+	client.Writer.SetProtocol(protocol)
+
+	return MapValue{Val: []Value{
+		BulkStringValue{Val: "server"}, BulkStringValue{Val: "redgo"},
+		BulkStringValue{Val: "version"}, BulkStringValue{Val: redgoVersion},
+		BulkStringValue{Val: "proto"}, IntegerValue{Val: protocol},
+		BulkStringValue{Val: "mode"}, BulkStringValue{Val: "standalone"},
+		BulkStringValue{Val: "role"}, BulkStringValue{Val: "master"},
+		BulkStringValue{Val: "modules"}, ArrayValue{Val: []Value{}},
+	}}
+}
+
+// authRequired tells whether the client must authenticate before running commands.
+func authRequired(client *Client) bool {
+	return !client.Authenticated && serverConfig().RequirePass != ""
+}
+
+// checkPassword tells whether the password is the one of the user. There are no
+// users besides the default one, which accepts any password until requirepass
+// is set.
+func checkPassword(username, password string) bool {
+	if username != "default" {
+		return false
+	}
+
+	requirePass := serverConfig().RequirePass
+
+	return requirePass == "" || subtle.ConstantTimeCompare([]byte(password), []byte(requirePass)) == 1
+}
+
+func auth(args []Value, client *Client) Value {
+	if len(args) > 2 {
+		return SyntaxError
+	}
+
+	username := "default"
+	if len(args) == 2 {
+		username = args[0].(BulkStringValue).Val
+	}
+
+	if len(args) == 1 && serverConfig().RequirePass == "" {
+		return ErrorValue{Val: "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"}
+	}
+
+	if !checkPassword(username, args[len(args)-1].(BulkStringValue).Val) {
+		return ErrorValue{Val: "WRONGPASS invalid username-password pair or user is disabled."}
+	}
+
+	client.Authenticated = true
+
+	return StringValue{Val: "OK"}
+}
+
+func isValidClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookupCommand returns the command to run, or an error if it doesn't exist or
+// is given the wrong number of arguments.
+func lookupCommand(command string, args []Value) (Command, Value) {
+	cmd, found := Handlers[command]
+	if !found {
+		return cmd, ErrorValue{Val: "ERR unknown command '" + command + "'"}
+	}
+
+	if !cmd.checkArity(len(args) + 1) {
+		return cmd, ErrorValue{Val: "ERR wrong number of arguments for '" + strings.ToLower(command) + "' command"}
+	}
+
+	return cmd, nil
 }
 
 func ProcessCommand(command string, args []Value, client *Client) Value {
-	if handler, found := Handlers[command]; found {
-		return handler(args, client)
+	cmd, errValue := lookupCommand(command, args)
+	if errValue != nil {
+		return errValue
+	}
+
+	return cmd.Handler(args, client)
+}
+
+// call runs a command and appends it, or whatever it asked to propagate in its
+// place, to the AOF. If that fails, the reply is an error although the command
+// ran. The keyspace must be locked by the caller.
+func call(command string, args []Value, client *Client, aof *Aof) Value {
+	response := propagateCall(command, args, client)
+
+	if err := flushPropagation(aof); err != nil {
+		return aofWriteErrorReply(err)
 	}
 
-	return ErrorValue{Val: "ERR unknown command '" + command + "'"}
+	return response
 }
 
-func Handle(client Client, aof *Aof) error {
+// propagateCall runs a command and queues what it propagates, without
+// appending it to the AOF yet, which lets EXEC log a whole transaction at once.
+func propagateCall(command string, args []Value, client *Client) Value {
+	// Writes aren't accepted while they can't be logged.
+	if Handlers[command].Write && serverAof != nil {
+		if err := serverAof.WriteError(); err != nil {
+			return aofWriteErrorReply(err)
+		}
+	}
+
+	response := ProcessCommand(command, args, client)
+
+	_, isError := response.(ErrorValue)
+	blocked := client != nil && client.Blocked != nil
+
+	if Handlers[command].Write && !isError && !blocked && !commandPropagationPrevented {
+		alsoPropagate(append([]Value{BulkStringValue{Val: command}}, args...)...)
+	}
+
+	commandPropagationPrevented = false
+
+	return response
+}
+
+// commandArgs turns the arguments read from a client into values for the
+// handlers. The Reader copies each argument into a slice of its own that
+// nothing writes to afterwards, so its bytes are handed over as the string
+// the handlers and the keyspace keep, rather than being copied once more.
+func commandArgs(argv [][]byte) []Value {
+	args := make([]Value, len(argv))
+	for i, arg := range argv {
+		args[i] = BulkStringValue{Val: unsafe.String(unsafe.SliceData(arg), len(arg))}
+	}
+
+	return args
+}
+
+// runCommand runs a command and serves the clients blocked on the keys it made
+// ready. Commands run one at a time against the keyspace, and the lock also
+// covers the AOF write so the log records commands in the order they were
+// executed. It returns the reply and, if the client blocked, what it waits for.
+//
+// A handler that panics gets the client an error reply and leaves the keyspace
+// unlocked, rather than hanging every other client. What the command changed
+// before panicking isn't propagated.
+func runCommand(command string, args []Value, client *Client, aof *Aof) (response Value, blocked *BlockState) {
+	DB.Lock()
+	defer DB.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			serverLog(LOG_WARNING, "Panic running '%s': %v\n%s", strings.ToLower(command), r, debug.Stack())
+
+			pendingPropagation = nil
+			commandPropagationPrevented = false
+
+			if client.Blocked != nil {
+				unblockClient(client)
+			}
+
+			response, blocked = ErrorValue{Val: "ERR internal error running '" + strings.ToLower(command) + "'"}, nil
+		}
+	}()
+
+	response = call(command, args, client, aof)
+	serveClientsBlockedOnKeys(aof)
+
+	// Read the block state while still holding the lock, as another client may
+	// serve us as soon as it's released.
+	return response, client.Blocked
+}
+
+// Handle runs the client's commands as they're parsed. Replies are buffered
+// and sent when the input is drained, see flushBeforeRead.
+func Handle(client *Client, aof *Aof) error {
 	for {
-		value, err := client.Reader.ParseFromRespString()
+		argv, err := client.Reader.ReadCommand()
 		if err != nil {
-			client.Writer.WriteAsRespString(ErrorValue{Val: "ERR parsing error"})
+			var protocolErr ProtocolError
+			if errors.As(err, &protocolErr) {
+				client.Writer.WriteAsRespString(ErrorValue{Val: "ERR " + protocolErr.Error()})
+				client.Writer.Flush()
+			}
 			return err
 		}
-		println("Received command from client:", client.ID)
 
-		arrayVal, ok := value.(ArrayValue)
+		command := strings.ToUpper(string(argv[0]))
+		args := commandArgs(argv[1:])
 
-		if !ok || len(arrayVal.Val) == 0 {
-			client.Writer.WriteAsRespString(ErrorValue{Val: "ERR wrong number of arguments"})
-		} else {
-			command := strings.ToUpper(arrayVal.Val[0].(BulkStringValue).Val)
-			args := arrayVal.Val[1:]
+		if authRequired(client) && command != "AUTH" && command != "HELLO" {
+			if client.Multi != nil {
+				client.Multi.aborted = true
+			}
 
-			response := ProcessCommand(command, args, &client)
+			client.Writer.WriteAsRespString(ErrorValue{Val: "NOAUTH Authentication required."})
+			continue
+		}
 
-			if command == "SET" || command == "HSET" || command == "DEL" {
-				aof.Write(value)
+		if reply, queued := queueMultiCommand(client, command, args); queued {
+			client.Writer.WriteAsRespString(reply)
+			continue
+		}
+
+		if reply, busy := scriptBusyReply(command, args); busy {
+			client.Writer.WriteAsRespString(reply)
+			continue
+		}
+
+		// Relative expirations are turned into absolute ones before running the
+		// command, so that the AOF replays exactly what was executed.
+		command, args = absoluteExpiryCommand(command, args)
+
+		response, blocked := runCommand(command, args, client, aof)
+
+		if blocked != nil {
+			// Send the replies to the commands pipelined before this one
+			// rather than holding them until it's served.
+			if err := client.Writer.Flush(); err != nil {
+				return err
 			}
 
-			client.Writer.WriteAsRespString(response)
+			response, err = waitUntilUnblocked(client, blocked)
+			if err != nil {
+				return err
+			}
 		}
+
+		client.Writer.WriteAsRespString(response)
 	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+// TESTPANIC stands for a handler with a bug. It's registered once for the whole
+// test binary, as the servers of earlier tests keep reading the table.
+func init() {
+	Handlers["TESTPANIC"] = Command{Handler: func(_ []Value, _ *Client) Value {
+		DB.Set("test:panic", &Object{Type: OBJ_STRING, Data: "partial"})
+		panic("bug")
+	}, Write: true, Arity: 1}
+}
+
+// TestHandlerPanic checks that a panicking handler gets the client an error
+// reply and leaves the keyspace unlocked, for this client, the others and the
+// cleanup when the client disconnects.
+func TestHandlerPanic(t *testing.T) {
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+	other := dialTestClient(t, addr)
+
+	client.do("+OK\r\n", "WATCH", "test:watched")
+	client.do("-ERR internal error running 'testpanic'\r\n", "TESTPANIC")
+	client.do("+PONG\r\n", "PING")
+	other.do("+OK\r\n", "SET", "test:other", "1")
+
+	client.do("+OK\r\n", "MULTI")
+	client.do("+QUEUED\r\n", "INCR", "test:other")
+	client.do("+QUEUED\r\n", "TESTPANIC")
+	client.do("-ERR internal error running 'exec'\r\n", "EXEC")
+	client.do("-ERR EXEC without MULTI\r\n", "EXEC")
+
+	client.conn.Close()
+	other.do("$1\r\n2\r\n", "GET", "test:other")
+	other.do(":2\r\n", "DEL", "test:other", "test:panic")
+}
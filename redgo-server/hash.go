@@ -1,27 +1,216 @@
 package main
 
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Hash maps fields to values. Fields may have their own expiration, which is
+// independent of the expiration of the key holding the hash.
+type Hash struct {
+	fields map[string]string
+	// expires holds the absolute expiration time, in unix milliseconds, of the
+	// fields that have one. It's only allocated once a field gets one.
+	expires map[string]int64
+	// nextExpire is never later than the earliest field expiration, so lookups
+	// can skip scanning expires until then.
+	nextExpire int64
+}
+
+func NewHash() *Hash {
+	return &Hash{fields: make(map[string]string)}
+}
+
+func (h *Hash) Len() int {
+	return len(h.fields)
+}
+
+// Set sets the value of a field, discarding its expiration.
+func (h *Hash) Set(field, value string) {
+	h.fields[field] = value
+	delete(h.expires, field)
+}
+
+// Update changes the value of an existing field, retaining its expiration.
+func (h *Hash) Update(field, value string) {
+	h.fields[field] = value
+}
+
+func (h *Hash) Delete(field string) bool {
+	if _, found := h.fields[field]; !found {
+		return false
+	}
+
+	delete(h.fields, field)
+	delete(h.expires, field)
+
+	return true
+}
+
+func (h *Hash) GetExpire(field string) (int64, bool) {
+	when, found := h.expires[field]
+	return when, found
+}
+
+func (h *Hash) SetExpire(field string, when int64) {
+	if h.expires == nil {
+		h.expires = make(map[string]int64)
+	}
+
+	if len(h.expires) == 0 || when < h.nextExpire {
+		h.nextExpire = when
+	}
+
+	h.expires[field] = when
+}
+
+// Persist removes the expiration of the field, returning false if it had none.
+func (h *Hash) Persist(field string) bool {
+	if _, found := h.expires[field]; !found {
+		return false
+	}
+
+	delete(h.expires, field)
+
+	return true
+}
+
+// HasExpires tells whether any field has an expiration.
+func (h *Hash) HasExpires() bool {
+	return len(h.expires) > 0
+}
+
+// expireFields deletes the fields whose expiration time has passed and returns
+// how many it deleted.
+func (h *Hash) expireFields(now int64) int {
+	if len(h.expires) == 0 || now < h.nextExpire {
+		return 0
+	}
+
+	expired := 0
+	next := int64(math.MaxInt64)
+
+	for field, when := range h.expires {
+		if when <= now {
+			delete(h.fields, field)
+			delete(h.expires, field)
+			expired++
+		} else if when < next {
+			next = when
+		}
+	}
+
+	h.nextExpire = next
+
+	return expired
+}
+
+// lookupHash returns the hash stored at key, nil if the key doesn't exist, or
+// WrongTypeError if it holds something else.
+func lookupHash(key string) (*Hash, Value) {
+	obj, errValue := DB.LookupType(key, OBJ_HASH)
+	if errValue != nil || obj == nil {
+		return nil, errValue
+	}
+
+	return obj.Data.(*Hash), nil
+}
+
+// lookupOrCreateHash is like lookupHash but creates an empty hash if the key doesn't exist.
+func lookupOrCreateHash(key string) (*Hash, Value) {
+	hash, errValue := lookupHash(key)
+	if errValue != nil || hash != nil {
+		return hash, errValue
+	}
+
+	hash = NewHash()
+	DB.Set(key, &Object{Type: OBJ_HASH, Data: hash})
+
+	return hash, nil
+}
+
+// deleteHashIfEmpty removes the key once its last field is gone, as empty hashes don't exist.
+func deleteHashIfEmpty(key string, hash *Hash) {
+	if hash.Len() == 0 {
+		DB.Delete(key)
+	}
+}
+
 func hset(args []Value, _ *Client) Value {
 	if len(args) < 3 || len(args)%2 != 1 {
 		return ErrorValue{Val: "ERR wrong number of arguments for 'hset' command"}
 	}
 
-	key := args[0].(BulkStringValue).Val
+	added, errValue := hsetGeneric(args)
+	if errValue != nil {
+		return errValue
+	}
 
-	HSETsMutex.Lock()
-	defer HSETsMutex.Unlock()
+	return IntegerValue{Val: added}
+}
+
+// hmset is the deprecated form of HSET, which replies OK rather than the number of fields added.
+func hmset(args []Value, _ *Client) Value {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hmset' command"}
+	}
+
+	if _, errValue := hsetGeneric(args); errValue != nil {
+		return errValue
+	}
+
+	return StringValue{Val: "OK"}
+}
+
+// hsetGeneric sets the field value pairs following the key and returns how
+// many fields were added.
+func hsetGeneric(args []Value) (int, Value) {
+	key := args[0].(BulkStringValue).Val
 
-	if _, found := HSETs[key]; !found {
-		HSETs[key] = make(map[string]string)
+	hash, errValue := lookupOrCreateHash(key)
+	if errValue != nil {
+		return 0, errValue
 	}
 
+	added := 0
 	for i := 1; i < len(args)-1; i += 2 {
 		field := args[i].(BulkStringValue).Val
 		value := args[i+1].(BulkStringValue).Val
 
-		HSETs[key][field] = value
+		if _, found := hash.fields[field]; !found {
+			added++
+		}
+
+		hash.Set(field, value)
 	}
 
-	return StringValue{Val: "OK"}
+	signalModifiedKey(key)
+
+	return added, nil
+}
+
+func hsetnx(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hsetnx' command"}
+	}
+
+	hash, errValue := lookupOrCreateHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	field := args[1].(BulkStringValue).Val
+	if _, found := hash.fields[field]; found {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	hash.Set(field, args[2].(BulkStringValue).Val)
+	signalModifiedKey(args[0].(BulkStringValue).Val)
+
+	return IntegerValue{Val: 1}
 }
 
 func hget(args []Value, _ *Client) Value {
@@ -29,38 +218,665 @@ func hget(args []Value, _ *Client) Value {
 		return ErrorValue{Val: "ERR wrong number of arguments for 'hget' command"}
 	}
 
-	key := args[0].(BulkStringValue).Val
-	field := args[1].(BulkStringValue).Val
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
 
-	HSETsMutex.RLock()
-	defer HSETsMutex.RUnlock()
+	if hash == nil {
+		return NullValue{}
+	}
 
-	if value, found := HSETs[key][field]; found {
+	if value, found := hash.fields[args[1].(BulkStringValue).Val]; found {
 		return BulkStringValue{Val: value}
 	}
 
 	return NullValue{}
 }
 
+func hmget(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hmget' command"}
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		hash = NewHash()
+	}
+
+	array := make([]Value, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if value, found := hash.fields[arg.(BulkStringValue).Val]; found {
+			array = append(array, BulkStringValue{Val: value})
+		} else {
+			array = append(array, NullValue{})
+		}
+	}
+
+	return ArrayValue{Val: array}
+}
+
 func hgetall(args []Value, _ *Client) Value {
 	if len(args) != 1 {
 		return ErrorValue{Val: "ERR wrong number of arguments for 'hgetall' command"}
 	}
 
-	key := args[0].(BulkStringValue).Val
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		return MapValue{Val: []Value{}}
+	}
 
-	HSETsMutex.RLock()
-	hash, found := HSETs[key]
-	HSETsMutex.RUnlock()
+	array := make([]Value, 0, hash.Len()*2)
+	for field, value := range hash.fields {
+		array = append(array, BulkStringValue{Val: field})
+		array = append(array, BulkStringValue{Val: value})
+	}
 
-	if !found {
-		return NullValue{}
+	return MapValue{Val: array}
+}
+
+func hkeys(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hkeys' command"}
 	}
 
-	array := make([]Value, 0, len(hash)*2)
-	for field, value := range hash {
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		return ArrayValue{Val: []Value{}}
+	}
+
+	array := make([]Value, 0, hash.Len())
+	for field := range hash.fields {
 		array = append(array, BulkStringValue{Val: field})
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func hvals(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hvals' command"}
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		return ArrayValue{Val: []Value{}}
+	}
+
+	array := make([]Value, 0, hash.Len())
+	for _, value := range hash.fields {
 		array = append(array, BulkStringValue{Val: value})
 	}
+
+	return ArrayValue{Val: array}
+}
+
+func hdel(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hdel' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	hash, errValue := lookupHash(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	deleted := 0
+	for _, arg := range args[1:] {
+		field := arg.(BulkStringValue).Val
+
+		if hash.Delete(field) {
+			deleted++
+		}
+	}
+
+	if deleted == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	deleteHashIfEmpty(key, hash)
+
+	return IntegerValue{Val: deleted}
+}
+
+func hexists(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hexists' command"}
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	if _, found := hash.fields[args[1].(BulkStringValue).Val]; found {
+		return IntegerValue{Val: 1}
+	}
+
+	return IntegerValue{Val: 0}
+}
+
+func hlen(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hlen' command"}
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	return IntegerValue{Val: hash.Len()}
+}
+
+func hstrlen(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hstrlen' command"}
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	return IntegerValue{Val: len(hash.fields[args[1].(BulkStringValue).Val])}
+}
+
+func hincrby(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hincrby' command"}
+	}
+
+	field := args[1].(BulkStringValue).Val
+
+	increment, ok := parseStrictInt(args[2].(BulkStringValue).Val)
+	if !ok {
+		return NotIntegerError
+	}
+
+	hash, errValue := lookupOrCreateHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	var current int64
+	if value, found := hash.fields[field]; found {
+		if current, ok = parseStrictInt(value); !ok {
+			return ErrorValue{Val: "ERR hash value is not an integer"}
+		}
+	}
+
+	if (increment > 0 && current > math.MaxInt64-increment) || (increment < 0 && current < math.MinInt64-increment) {
+		return ErrorValue{Val: "ERR increment or decrement would overflow"}
+	}
+
+	current += increment
+	hash.Update(field, strconv.FormatInt(current, 10))
+	signalModifiedKey(args[0].(BulkStringValue).Val)
+
+	return IntegerValue{Val: int(current)}
+}
+
+func hincrbyfloat(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hincrbyfloat' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+	field := args[1].(BulkStringValue).Val
+
+	increment, err := strconv.ParseFloat(args[2].(BulkStringValue).Val, 64)
+	if err != nil {
+		return ErrorValue{Val: "ERR value is not a valid float"}
+	}
+
+	hash, errValue := lookupHash(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	var current float64
+	if hash != nil {
+		if value, found := hash.fields[field]; found {
+			if current, err = strconv.ParseFloat(value, 64); err != nil {
+				return ErrorValue{Val: "ERR hash value is not a float"}
+			}
+		}
+	}
+
+	current += increment
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return ErrorValue{Val: "ERR increment would produce NaN or Infinity"}
+	}
+
+	if hash == nil {
+		hash, _ = lookupOrCreateHash(key)
+	}
+
+	result := formatIncrFloat(current)
+	hash.Update(field, result)
+	signalModifiedKey(key)
+
+	// Like INCRBYFLOAT, the AOF records the resulting value instead of the
+	// increment. HSET discards the field TTL, so it's restored right after.
+	preventCommandPropagation()
+	alsoPropagate(BulkStringValue{Val: "HSET"}, BulkStringValue{Val: key}, BulkStringValue{Val: field}, BulkStringValue{Val: result})
+
+	if when, found := hash.GetExpire(field); found {
+		alsoPropagate(BulkStringValue{Val: "HPEXPIREAT"}, BulkStringValue{Val: key}, BulkStringValue{Val: strconv.FormatInt(when, 10)},
+			BulkStringValue{Val: "FIELDS"}, BulkStringValue{Val: "1"}, BulkStringValue{Val: field})
+	}
+
+	return BulkStringValue{Val: result}
+}
+
+func hrandfield(args []Value, _ *Client) Value {
+	if len(args) < 1 || len(args) > 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hrandfield' command"}
+	}
+
+	count, withValues := 1, false
+	if len(args) > 1 {
+		var errValue Value
+		if count, errValue = parseRandomCount(args[1]); errValue != nil {
+			return errValue
+		}
+	}
+
+	if len(args) == 3 {
+		if strings.ToUpper(args[2].(BulkStringValue).Val) != "WITHVALUES" {
+			return SyntaxError
+		}
+		withValues = true
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		hash = NewHash()
+	}
+
+	fields := make([]string, 0, hash.Len())
+	for field := range hash.fields {
+		fields = append(fields, field)
+	}
+
+	if len(args) == 1 {
+		if len(fields) == 0 {
+			return NullValue{}
+		}
+
+		return BulkStringValue{Val: fields[rand.Intn(len(fields))]}
+	}
+
+	// As in SRANDMEMBER, a positive count returns distinct fields and a negative
+	// one allows repetitions.
+	var picked []string
+	if count >= 0 {
+		rand.Shuffle(len(fields), func(i, j int) {
+			fields[i], fields[j] = fields[j], fields[i]
+		})
+
+		picked = fields[:min(count, len(fields))]
+	} else if len(fields) > 0 {
+		picked = make([]string, -count)
+		for i := range picked {
+			picked[i] = fields[rand.Intn(len(fields))]
+		}
+	}
+
+	array := make([]Value, 0, len(picked))
+	for _, field := range picked {
+		array = append(array, BulkStringValue{Val: field})
+
+		if withValues {
+			array = append(array, BulkStringValue{Val: hash.fields[field]})
+		}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// hscan returns the fields matching the pattern. The whole hash is returned in
+// a single call with a cursor of 0, which Redis also does for small hashes and
+// which trivially meets the SCAN guarantees; COUNT is only a hint.
+func hscan(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hscan' command"}
+	}
+
+	if _, err := strconv.ParseUint(args[1].(BulkStringValue).Val, 10, 64); err != nil {
+		return ErrorValue{Val: "ERR invalid cursor"}
+	}
+
+	pattern := ""
+	noValues := false
+
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i].(BulkStringValue).Val)
+
+		switch {
+		case option == "MATCH" && i+1 < len(args):
+			pattern = args[i+1].(BulkStringValue).Val
+			i++
+		case option == "COUNT" && i+1 < len(args):
+			count, err := strconv.Atoi(args[i+1].(BulkStringValue).Val)
+			if err != nil {
+				return NotIntegerError
+			}
+
+			if count < 1 {
+				return SyntaxError
+			}
+			i++
+		case option == "NOVALUES":
+			noValues = true
+		default:
+			return SyntaxError
+		}
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		hash = NewHash()
+	}
+
+	array := []Value{}
+	for field, value := range hash.fields {
+		if pattern != "" && !stringMatch(pattern, field) {
+			continue
+		}
+
+		array = append(array, BulkStringValue{Val: field})
+
+		if !noValues {
+			array = append(array, BulkStringValue{Val: value})
+		}
+	}
+
+	return ArrayValue{Val: []Value{BulkStringValue{Val: "0"}, ArrayValue{Val: array}}}
+}
+
+func hexpire(args []Value, _ *Client) Value {
+	return hexpireGeneric(args, "hexpire", 1000, nowMs())
+}
+
+func hpexpire(args []Value, _ *Client) Value {
+	return hexpireGeneric(args, "hpexpire", 1, nowMs())
+}
+
+func hexpireat(args []Value, _ *Client) Value {
+	return hexpireGeneric(args, "hexpireat", 1000, 0)
+}
+
+func hpexpireat(args []Value, _ *Client) Value {
+	return hexpireGeneric(args, "hpexpireat", 1, 0)
+}
+
+// parseHashFields parses the "FIELDS numfields field [field ...]" block that
+// ends the field expiration commands, starting at args[i].
+func parseHashFields(args []Value, i int) ([]string, Value) {
+	if i >= len(args) || strings.ToUpper(args[i].(BulkStringValue).Val) != "FIELDS" || i+1 >= len(args) {
+		return nil, ErrorValue{Val: "ERR Mandatory argument FIELDS is missing or not at the right position"}
+	}
+
+	numFields, err := strconv.Atoi(args[i+1].(BulkStringValue).Val)
+	if err != nil || numFields <= 0 {
+		return nil, ErrorValue{Val: "ERR Parameter `numFields` should be greater than 0"}
+	}
+
+	if numFields != len(args)-i-2 {
+		return nil, ErrorValue{Val: "ERR The `numfields` parameter must match the number of arguments"}
+	}
+
+	fields := make([]string, numFields)
+	for j := range fields {
+		fields[j] = args[i+2+j].(BulkStringValue).Val
+	}
+
+	return fields, nil
+}
+
+// hexpireGeneric implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT, with
+// unit and basetime as in expireGeneric. It replies with an array holding, for
+// each field, -2 if it doesn't exist, 0 if the NX/XX/GT/LT condition wasn't met,
+// 1 if the expiration was set and 2 if the field was deleted because the time
+// is already in the past.
+func hexpireGeneric(args []Value, name string, unit int64, basetime int64) Value {
+	if len(args) < 5 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	when, err := strconv.ParseInt(args[1].(BulkStringValue).Val, 10, 64)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	if when < 0 {
+		return ErrorValue{Val: "ERR invalid expire time, must be >= 0"}
+	}
+
+	i := 2
+	var nx, xx, gt, lt bool
+	switch strings.ToUpper(args[i].(BulkStringValue).Val) {
+	case "NX":
+		nx = true
+	case "XX":
+		xx = true
+	case "GT":
+		gt = true
+	case "LT":
+		lt = true
+	}
+
+	if nx || xx || gt || lt {
+		i++
+	}
+
+	fields, errValue := parseHashFields(args, i)
+	if errValue != nil {
+		return errValue
+	}
+
+	when, ok := toAbsoluteMs(when, unit, basetime)
+	if !ok {
+		return ErrorValue{Val: "ERR invalid expire time in '" + name + "' command"}
+	}
+
+	hash, errValue := lookupHash(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		hash = NewHash()
+	}
+
+	now := nowMs()
+	changed := false
+
+	array := make([]Value, len(fields))
+	for j, field := range fields {
+		if _, found := hash.fields[field]; !found {
+			array[j] = IntegerValue{Val: -2}
+			continue
+		}
+
+		// A field without an expiration is considered to have an infinite TTL.
+		current, hasExpire := hash.GetExpire(field)
+
+		if (nx && hasExpire) || (xx && !hasExpire) || (gt && (!hasExpire || when <= current)) || (lt && hasExpire && when >= current) {
+			array[j] = IntegerValue{Val: 0}
+			continue
+		}
+
+		changed = true
+
+		if when <= now {
+			hash.Delete(field)
+			array[j] = IntegerValue{Val: 2}
+			continue
+		}
+
+		hash.SetExpire(field, when)
+		array[j] = IntegerValue{Val: 1}
+	}
+
+	if !changed {
+		preventCommandPropagation()
+		return ArrayValue{Val: array}
+	}
+
+	signalModifiedKey(key)
+
+	if hash.Len() == 0 {
+		DB.Delete(key)
+	} else {
+		DB.TrackHashFieldExpires(key)
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func httl(args []Value, _ *Client) Value {
+	return httlGeneric(args, "httl", 1000)
+}
+
+func hpttl(args []Value, _ *Client) Value {
+	return httlGeneric(args, "hpttl", 1)
+}
+
+// httlGeneric replies with the remaining time to live of each field in the
+// given unit, -1 if it has no expiration or -2 if it doesn't exist.
+func httlGeneric(args []Value, name string, unit int64) Value {
+	if len(args) < 4 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	fields, errValue := parseHashFields(args, 1)
+	if errValue != nil {
+		return errValue
+	}
+
+	hash, errValue := lookupHash(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		hash = NewHash()
+	}
+
+	now := nowMs()
+
+	array := make([]Value, len(fields))
+	for j, field := range fields {
+		if _, found := hash.fields[field]; !found {
+			array[j] = IntegerValue{Val: -2}
+			continue
+		}
+
+		when, found := hash.GetExpire(field)
+		if !found {
+			array[j] = IntegerValue{Val: -1}
+			continue
+		}
+
+		remaining := max(when-now, 0)
+		array[j] = IntegerValue{Val: int((remaining + unit/2) / unit)}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// hpersist removes the expiration of each field, replying with 1 if it had one,
+// -1 if it didn't or -2 if the field doesn't exist.
+func hpersist(args []Value, _ *Client) Value {
+	if len(args) < 4 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'hpersist' command"}
+	}
+
+	fields, errValue := parseHashFields(args, 1)
+	if errValue != nil {
+		return errValue
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	hash, errValue := lookupHash(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if hash == nil {
+		hash = NewHash()
+	}
+
+	persisted := false
+
+	array := make([]Value, len(fields))
+	for j, field := range fields {
+		if _, found := hash.fields[field]; !found {
+			array[j] = IntegerValue{Val: -2}
+		} else if hash.Persist(field) {
+			array[j] = IntegerValue{Val: 1}
+			persisted = true
+		} else {
+			array[j] = IntegerValue{Val: -1}
+		}
+	}
+
+	if !persisted {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
 	return ArrayValue{Val: array}
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var serverStart = time.Now()
+
+// infoSections are the sections of INFO, in the order they're listed.
+var infoSections = []struct {
+	name   string
+	fields func() []string
+}{
+	{"server", serverInfo},
+	{"clients", clientsInfo},
+	{"persistence", persistenceInfo},
+}
+
+func serverInfo() []string {
+	return []string{
+		"redgo_version:" + redgoVersion,
+		"process_id:" + strconv.Itoa(os.Getpid()),
+		"tcp_port:" + strconv.Itoa(serverConfig().Port),
+		"uptime_in_seconds:" + strconv.FormatInt(int64(time.Since(serverStart).Seconds()), 10),
+		"config_file:" + configFile,
+	}
+}
+
+func clientsInfo() []string {
+	ClientsMutex.Lock()
+	connected := len(Clients)
+	ClientsMutex.Unlock()
+
+	return []string{
+		"connected_clients:" + strconv.Itoa(connected),
+		"maxclients:" + strconv.Itoa(serverConfig().MaxClients),
+	}
+}
+
+func persistenceInfo() []string {
+	fields := rdbInfo()
+	if serverAof == nil {
+		return append(fields, "aof_enabled:0")
+	}
+
+	fields = append(fields, "aof_enabled:1")
+
+	return append(fields, serverAof.persistenceInfo()...)
+}
+
+// info replies with the given sections, or all of them if there are none or
+// one is "all", "default" or "everything". Unknown sections are left out.
+func info(args []Value, _ *Client) Value {
+	selected := make(map[string]bool)
+	all := len(args) == 0
+
+	for _, arg := range args {
+		section := strings.ToLower(arg.(BulkStringValue).Val)
+		if section == "all" || section == "default" || section == "everything" {
+			all = true
+		}
+		selected[section] = true
+	}
+
+	var text strings.Builder
+	for _, section := range infoSections {
+		if !all && !selected[section.name] {
+			continue
+		}
+
+		if text.Len() > 0 {
+			text.WriteString("\r\n")
+		}
+
+		text.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, field := range section.fields() {
+			text.WriteString(field + "\r\n")
+		}
+	}
+
+	return VerbatimStringValue{Format: "txt", Val: text.String()}
+}
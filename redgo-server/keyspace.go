@@ -0,0 +1,314 @@
+package main
+
+import (
+	"sync"
+)
+
+type ObjectType string
+
+const (
+	OBJ_STRING ObjectType = "string"
+	OBJ_HASH   ObjectType = "hash"
+	OBJ_LIST   ObjectType = "list"
+	OBJ_SET    ObjectType = "set"
+	OBJ_ZSET   ObjectType = "zset"
+	OBJ_STREAM ObjectType = "stream"
+)
+
+// Object is a typed value stored in the keyspace. Data holds a string for
+// OBJ_STRING, a *Hash for OBJ_HASH, a *Quicklist for OBJ_LIST,
+// a map[string]struct{} for OBJ_SET, a *SortedSet for OBJ_ZSET and a *Stream
+// for OBJ_STREAM.
+type Object struct {
+	Type ObjectType
+	Data any
+}
+
+var WrongTypeError = ErrorValue{Val: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+
+// Keyspace holds every key of the database regardless of its type, along with
+// the absolute expiration time, in unix milliseconds, of the keys that have one.
+//
+// Commands run with the keyspace locked (see Handle), so the methods below
+// assume the caller holds the lock.
+type Keyspace struct {
+	mutex   sync.Mutex
+	objects map[string]*Object
+	expires map[string]int64
+	// hashFieldExpires holds the keys of the hashes that have fields with an
+	// expiration, for the active expire cycle to sample. It may contain stale
+	// keys, which the cycle drops.
+	hashFieldExpires map[string]struct{}
+	// watched holds the keys watched by clients for their transactions.
+	watched map[string]*WatchedKey
+	// snapshots holds the snapshots being encoded in the background.
+	snapshots []*datasetSnapshot
+}
+
+var DB = NewKeyspace()
+
+func NewKeyspace() *Keyspace {
+	return &Keyspace{
+		objects:          make(map[string]*Object),
+		expires:          make(map[string]int64),
+		hashFieldExpires: make(map[string]struct{}),
+		watched:          make(map[string]*WatchedKey),
+	}
+}
+
+func (ks *Keyspace) Lock() {
+	ks.mutex.Lock()
+}
+
+func (ks *Keyspace) Unlock() {
+	ks.mutex.Unlock()
+}
+
+// Lookup returns the object stored at key, or nil if the key doesn't exist.
+// Keys whose expiration time has passed are deleted on access, and so are the
+// expired fields of hashes.
+func (ks *Keyspace) Lookup(key string) *Object {
+	ks.preserve(key)
+	ks.expireIfNeeded(key)
+	ks.expireHashFieldsIfNeeded(key)
+
+	return ks.objects[key]
+}
+
+// LookupType is like Lookup but returns WrongTypeError if the key holds a
+// value of a different type.
+func (ks *Keyspace) LookupType(key string, objType ObjectType) (*Object, Value) {
+	obj := ks.Lookup(key)
+
+	if obj != nil && obj.Type != objType {
+		return nil, WrongTypeError
+	}
+
+	return obj, nil
+}
+
+func (ks *Keyspace) Exists(key string) bool {
+	return ks.Lookup(key) != nil
+}
+
+// Set stores the object at key, overwriting any existing value regardless of
+// its type and discarding its expiration.
+func (ks *Keyspace) Set(key string, obj *Object) {
+	ks.preserve(key)
+	ks.objects[key] = obj
+	delete(ks.expires, key)
+	ks.TrackHashFieldExpires(key)
+	ks.touchWatchedKey(key)
+	signalKeyAsReady(key)
+}
+
+// SetKeepTTL is like Set but retains the expiration of an existing key.
+func (ks *Keyspace) SetKeepTTL(key string, obj *Object) {
+	ks.preserve(key)
+	ks.objects[key] = obj
+	ks.TrackHashFieldExpires(key)
+	ks.touchWatchedKey(key)
+	signalKeyAsReady(key)
+}
+
+func (ks *Keyspace) Delete(key string) bool {
+	ks.preserve(key)
+	ks.expireIfNeeded(key)
+
+	if _, found := ks.objects[key]; !found {
+		return false
+	}
+
+	delete(ks.objects, key)
+	delete(ks.expires, key)
+	ks.touchWatchedKey(key)
+
+	return true
+}
+
+// GetExpire returns the absolute expiration time of the key in unix milliseconds.
+func (ks *Keyspace) GetExpire(key string) (int64, bool) {
+	when, found := ks.expires[key]
+	return when, found
+}
+
+func (ks *Keyspace) SetExpire(key string, when int64) {
+	ks.preserve(key)
+	ks.expires[key] = when
+	ks.touchWatchedKey(key)
+}
+
+// Persist removes the expiration of the key, returning false if it had none.
+func (ks *Keyspace) Persist(key string) bool {
+	ks.preserve(key)
+
+	if _, found := ks.expires[key]; !found {
+		return false
+	}
+
+	delete(ks.expires, key)
+	ks.touchWatchedKey(key)
+
+	return true
+}
+
+// expireIfNeeded deletes the key if its expiration time has passed.
+// It returns true if the key was expired.
+func (ks *Keyspace) expireIfNeeded(key string) bool {
+	when, found := ks.expires[key]
+
+	if !found || when > nowMs() {
+		return false
+	}
+
+	ks.preserve(key)
+	delete(ks.objects, key)
+	delete(ks.expires, key)
+	ks.touchWatchedKey(key)
+
+	return true
+}
+
+// TrackHashFieldExpires registers the key with the active expire cycle if it
+// holds a hash with fields that have an expiration.
+func (ks *Keyspace) TrackHashFieldExpires(key string) {
+	if obj := ks.objects[key]; obj != nil && obj.Type == OBJ_HASH && obj.Data.(*Hash).HasExpires() {
+		ks.hashFieldExpires[key] = struct{}{}
+	}
+}
+
+// expireHashFieldsIfNeeded deletes the expired fields of the hash stored at
+// key, and the key itself if no field is left. It returns the number of fields
+// expired.
+func (ks *Keyspace) expireHashFieldsIfNeeded(key string) int {
+	obj := ks.objects[key]
+	if obj == nil || obj.Type != OBJ_HASH {
+		return 0
+	}
+
+	hash := obj.Data.(*Hash)
+
+	ks.preserve(key)
+
+	expired := hash.expireFields(nowMs())
+	if expired == 0 {
+		return 0
+	}
+
+	if hash.Len() == 0 {
+		delete(ks.objects, key)
+		delete(ks.expires, key)
+	}
+
+	ks.touchWatchedKey(key)
+
+	return expired
+}
+
+func keysFromArgs(args []Value) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.(BulkStringValue).Val
+	}
+
+	return keys
+}
+
+func del(args []Value, _ *Client) Value {
+	if len(args) < 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'del' command"}
+	}
+
+	deleted := 0
+	for _, arg := range args {
+		if DB.Delete(arg.(BulkStringValue).Val) {
+			deleted++
+		}
+	}
+
+	if deleted == 0 {
+		preventCommandPropagation()
+	}
+
+	return IntegerValue{Val: deleted}
+}
+
+func exists(args []Value, _ *Client) Value {
+	if len(args) < 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'exists' command"}
+	}
+
+	// A key mentioned multiple times is counted multiple times, like Redis does.
+	count := 0
+	for _, arg := range args {
+		if DB.Exists(arg.(BulkStringValue).Val) {
+			count++
+		}
+	}
+
+	return IntegerValue{Val: count}
+}
+
+func typeCommand(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'type' command"}
+	}
+
+	obj := DB.Lookup(args[0].(BulkStringValue).Val)
+	if obj == nil {
+		return StringValue{Val: "none"}
+	}
+
+	return StringValue{Val: string(obj.Type)}
+}
+
+func rename(args []Value, _ *Client) Value {
+	return renameGeneric(args, "rename", false)
+}
+
+func renamenx(args []Value, _ *Client) Value {
+	return renameGeneric(args, "renamenx", true)
+}
+
+func renameGeneric(args []Value, name string, nx bool) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+	newKey := args[1].(BulkStringValue).Val
+
+	obj := DB.Lookup(key)
+	if obj == nil {
+		return ErrorValue{Val: "ERR no such key"}
+	}
+
+	if key == newKey {
+		preventCommandPropagation()
+
+		if nx {
+			return IntegerValue{Val: 0}
+		}
+		return StringValue{Val: "OK"}
+	}
+
+	if nx && DB.Exists(newKey) {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	when, hasExpire := DB.GetExpire(key)
+
+	DB.Delete(key)
+	DB.Set(newKey, obj)
+
+	if hasExpire {
+		DB.SetExpire(newKey, when)
+	}
+
+	if nx {
+		return IntegerValue{Val: 1}
+	}
+
+	return StringValue{Val: "OK"}
+}
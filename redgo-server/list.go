@@ -0,0 +1,849 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	LIST_HEAD = iota
+	LIST_TAIL
+)
+
+// lookupList returns the list stored at key, nil if the key doesn't exist, or
+// WrongTypeError if it holds something else.
+func lookupList(key string) (*Quicklist, Value) {
+	obj, errValue := DB.LookupType(key, OBJ_LIST)
+	if errValue != nil || obj == nil {
+		return nil, errValue
+	}
+
+	return obj.Data.(*Quicklist), nil
+}
+
+// lookupOrCreateList is like lookupList but creates an empty list if the key doesn't exist.
+func lookupOrCreateList(key string) (*Quicklist, Value) {
+	list, errValue := lookupList(key)
+	if errValue != nil {
+		return nil, errValue
+	}
+
+	if list == nil {
+		list = NewQuicklist()
+		DB.Set(key, &Object{Type: OBJ_LIST, Data: list})
+	}
+
+	return list, nil
+}
+
+// deleteListIfEmpty removes the key once its last element is gone, as empty
+// lists don't exist.
+func deleteListIfEmpty(key string, list *Quicklist) {
+	if list.Len() == 0 {
+		DB.Delete(key)
+	}
+}
+
+func listPush(key string, list *Quicklist, value string, where int) {
+	if where == LIST_HEAD {
+		list.PushHead(value)
+	} else {
+		list.PushTail(value)
+	}
+
+	signalModifiedKey(key)
+	signalKeyAsReady(key)
+}
+
+func listPop(key string, list *Quicklist, where int) (string, bool) {
+	pop := list.PopTail
+	if where == LIST_HEAD {
+		pop = list.PopHead
+	}
+
+	value, ok := pop()
+	if ok {
+		signalModifiedKey(key)
+	}
+
+	return value, ok
+}
+
+func listWhereName(where int) string {
+	if where == LIST_HEAD {
+		return "LEFT"
+	}
+
+	return "RIGHT"
+}
+
+func parseListWhere(arg Value) (int, bool) {
+	switch strings.ToUpper(arg.(BulkStringValue).Val) {
+	case "LEFT":
+		return LIST_HEAD, true
+	case "RIGHT":
+		return LIST_TAIL, true
+	}
+
+	return 0, false
+}
+
+func lpush(args []Value, _ *Client) Value {
+	return pushGeneric(args, "lpush", LIST_HEAD, false)
+}
+
+func rpush(args []Value, _ *Client) Value {
+	return pushGeneric(args, "rpush", LIST_TAIL, false)
+}
+
+func lpushx(args []Value, _ *Client) Value {
+	return pushGeneric(args, "lpushx", LIST_HEAD, true)
+}
+
+func rpushx(args []Value, _ *Client) Value {
+	return pushGeneric(args, "rpushx", LIST_TAIL, true)
+}
+
+// pushGeneric implements LPUSH, RPUSH, LPUSHX and RPUSHX. When xx is set the
+// elements are only pushed if the list already exists.
+func pushGeneric(args []Value, name string, where int, xx bool) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	list, errValue := lookupList(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		if xx {
+			preventCommandPropagation()
+			return IntegerValue{Val: 0}
+		}
+
+		list, _ = lookupOrCreateList(key)
+	}
+
+	for _, arg := range args[1:] {
+		listPush(key, list, arg.(BulkStringValue).Val, where)
+	}
+
+	return IntegerValue{Val: list.Len()}
+}
+
+func lpop(args []Value, _ *Client) Value {
+	return popGeneric(args, "lpop", LIST_HEAD)
+}
+
+func rpop(args []Value, _ *Client) Value {
+	return popGeneric(args, "rpop", LIST_TAIL)
+}
+
+// popGeneric implements LPOP and RPOP. Without a count a single element is
+// returned, with a count an array of up to count elements.
+func popGeneric(args []Value, name string, where int) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	count := -1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+		if err != nil || n < 0 {
+			return ErrorValue{Val: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	list, errValue := lookupList(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		preventCommandPropagation()
+
+		if count == -1 {
+			return NullValue{}
+		}
+		return NullArrayValue{}
+	}
+
+	if count == -1 {
+		value, _ := listPop(key, list, where)
+		deleteListIfEmpty(key, list)
+
+		return BulkStringValue{Val: value}
+	}
+
+	values := make([]Value, 0, min(count, list.Len()))
+	for len(values) < count {
+		value, ok := listPop(key, list, where)
+		if !ok {
+			break
+		}
+		values = append(values, BulkStringValue{Val: value})
+	}
+
+	if len(values) == 0 {
+		preventCommandPropagation()
+	}
+
+	deleteListIfEmpty(key, list)
+
+	return ArrayValue{Val: values}
+}
+
+func llen(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'llen' command"}
+	}
+
+	list, errValue := lookupList(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	return IntegerValue{Val: list.Len()}
+}
+
+func lindex(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'lindex' command"}
+	}
+
+	index, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	list, errValue := lookupList(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		return NullValue{}
+	}
+
+	value, found := list.Index(index)
+	if !found {
+		return NullValue{}
+	}
+
+	return BulkStringValue{Val: value}
+}
+
+func lset(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'lset' command"}
+	}
+
+	index, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	list, errValue := lookupList(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		return ErrorValue{Val: "ERR no such key"}
+	}
+
+	if !list.Set(index, args[2].(BulkStringValue).Val) {
+		return ErrorValue{Val: "ERR index out of range"}
+	}
+
+	signalModifiedKey(args[0].(BulkStringValue).Val)
+
+	return StringValue{Val: "OK"}
+}
+
+func lrange(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'lrange' command"}
+	}
+
+	start, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	stop, err := strconv.Atoi(args[2].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	list, errValue := lookupList(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		return ArrayValue{Val: []Value{}}
+	}
+
+	values := list.Range(start, stop)
+
+	array := make([]Value, len(values))
+	for i, value := range values {
+		array[i] = BulkStringValue{Val: value}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func lrem(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'lrem' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	count, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	list, errValue := lookupList(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	removed := list.Remove(count, args[2].(BulkStringValue).Val)
+	if removed == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	deleteListIfEmpty(key, list)
+
+	return IntegerValue{Val: removed}
+}
+
+func ltrim(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'ltrim' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	start, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	stop, err := strconv.Atoi(args[2].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	list, errValue := lookupList(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		preventCommandPropagation()
+		return StringValue{Val: "OK"}
+	}
+
+	list.Trim(start, stop)
+	signalModifiedKey(key)
+	deleteListIfEmpty(key, list)
+
+	return StringValue{Val: "OK"}
+}
+
+func linsert(args []Value, _ *Client) Value {
+	if len(args) != 4 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'linsert' command"}
+	}
+
+	var after bool
+	switch strings.ToUpper(args[1].(BulkStringValue).Val) {
+	case "BEFORE":
+		after = false
+	case "AFTER":
+		after = true
+	default:
+		return SyntaxError
+	}
+
+	list, errValue := lookupList(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list == nil {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	if !list.Insert(args[2].(BulkStringValue).Val, args[3].(BulkStringValue).Val, after) {
+		preventCommandPropagation()
+		return IntegerValue{Val: -1}
+	}
+
+	signalModifiedKey(args[0].(BulkStringValue).Val)
+
+	return IntegerValue{Val: list.Len()}
+}
+
+func lpos(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'lpos' command"}
+	}
+
+	element := args[1].(BulkStringValue).Val
+	rank, count, maxlen := 1, -1, 0
+
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return SyntaxError
+		}
+
+		n, err := strconv.Atoi(args[i+1].(BulkStringValue).Val)
+		if err != nil {
+			return NotIntegerError
+		}
+
+		switch strings.ToUpper(args[i].(BulkStringValue).Val) {
+		case "RANK":
+			if n == 0 {
+				return ErrorValue{Val: "ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"}
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return ErrorValue{Val: "ERR COUNT can't be negative"}
+			}
+			count = n
+		case "MAXLEN":
+			if n < 0 {
+				return ErrorValue{Val: "ERR MAXLEN can't be negative"}
+			}
+			maxlen = n
+		default:
+			return SyntaxError
+		}
+	}
+
+	list, errValue := lookupList(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	matches := []Value{}
+	limit := count
+	if limit == -1 {
+		limit = 1
+	}
+
+	if list != nil {
+		// A negative rank scans from the tail and skips the first -rank-1 matches from there.
+		fromTail := rank < 0
+		skip := rank - 1
+		if fromTail {
+			skip = -rank - 1
+		}
+
+		values := list.Range(0, -1)
+		for scanned := 0; scanned < len(values) && (maxlen == 0 || scanned < maxlen); scanned++ {
+			index := scanned
+			if fromTail {
+				index = len(values) - 1 - scanned
+			}
+
+			if values[index] != element {
+				continue
+			}
+
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			matches = append(matches, IntegerValue{Val: index})
+			if limit != 0 && len(matches) == limit {
+				break
+			}
+		}
+	}
+
+	if count != -1 {
+		return ArrayValue{Val: matches}
+	}
+
+	if len(matches) == 0 {
+		return NullValue{}
+	}
+
+	return matches[0]
+}
+
+func lmove(args []Value, _ *Client) Value {
+	if len(args) != 4 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'lmove' command"}
+	}
+
+	whereFrom, ok := parseListWhere(args[2])
+	if !ok {
+		return SyntaxError
+	}
+
+	whereTo, ok := parseListWhere(args[3])
+	if !ok {
+		return SyntaxError
+	}
+
+	return lmoveGeneric(args[0].(BulkStringValue).Val, args[1].(BulkStringValue).Val, whereFrom, whereTo)
+}
+
+func rpoplpush(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'rpoplpush' command"}
+	}
+
+	return lmoveGeneric(args[0].(BulkStringValue).Val, args[1].(BulkStringValue).Val, LIST_TAIL, LIST_HEAD)
+}
+
+// lmoveGeneric atomically pops an element from one end of source and pushes it
+// to one end of destination, returning the element or nil if source is empty.
+func lmoveGeneric(source, destination string, whereFrom, whereTo int) Value {
+	sourceList, errValue := lookupList(source)
+	if errValue != nil {
+		return errValue
+	}
+
+	if sourceList == nil {
+		preventCommandPropagation()
+		return NullValue{}
+	}
+
+	// Check the destination type before touching the source, so a WRONGTYPE
+	// error leaves both keys untouched.
+	if _, errValue := lookupList(destination); errValue != nil {
+		return errValue
+	}
+
+	value, _ := listPop(source, sourceList, whereFrom)
+
+	// When source and destination are the same key this is a rotation, so push
+	// before checking for emptiness to keep the key (and its TTL) alive.
+	destinationList, _ := lookupOrCreateList(destination)
+	listPush(destination, destinationList, value, whereTo)
+
+	deleteListIfEmpty(source, sourceList)
+
+	return BulkStringValue{Val: value}
+}
+
+// parseMpopArgs parses the "numkeys key [key ...] LEFT|RIGHT [COUNT count]"
+// arguments shared by LMPOP and BLMPOP.
+func parseMpopArgs(args []Value) (keys []string, where int, count int, errValue Value) {
+	numkeys, err := strconv.Atoi(args[0].(BulkStringValue).Val)
+	if err != nil || numkeys <= 0 {
+		return nil, 0, 0, ErrorValue{Val: "ERR numkeys should be greater than 0"}
+	}
+
+	if len(args) < numkeys+2 {
+		return nil, 0, 0, SyntaxError
+	}
+
+	for _, arg := range args[1 : numkeys+1] {
+		keys = append(keys, arg.(BulkStringValue).Val)
+	}
+
+	where, ok := parseListWhere(args[numkeys+1])
+	if !ok {
+		return nil, 0, 0, SyntaxError
+	}
+
+	count = 1
+	rest := args[numkeys+2:]
+
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0].(BulkStringValue).Val) == "COUNT":
+		count, err = strconv.Atoi(rest[1].(BulkStringValue).Val)
+		if err != nil || count <= 0 {
+			return nil, 0, 0, ErrorValue{Val: "ERR count should be greater than 0"}
+		}
+	default:
+		return nil, 0, 0, SyntaxError
+	}
+
+	return keys, where, count, nil
+}
+
+// mpopFromList pops up to count elements from the list at key and replies with
+// the key name and the popped elements, the reply of LMPOP and BLMPOP.
+func mpopFromList(key string, list *Quicklist, where int, count int) Value {
+	values := make([]Value, 0, min(count, list.Len()))
+	for len(values) < count {
+		value, ok := listPop(key, list, where)
+		if !ok {
+			break
+		}
+		values = append(values, BulkStringValue{Val: value})
+	}
+
+	deleteListIfEmpty(key, list)
+
+	return ArrayValue{Val: []Value{BulkStringValue{Val: key}, ArrayValue{Val: values}}}
+}
+
+// popCommandFor returns the non-blocking command equivalent to popping count
+// elements, which is what the AOF records for the blocking variants.
+func popCommandFor(key string, where int, count int) []Value {
+	name := "LPOP"
+	if where == LIST_TAIL {
+		name = "RPOP"
+	}
+
+	return []Value{BulkStringValue{Val: name}, BulkStringValue{Val: key}, BulkStringValue{Val: strconv.Itoa(count)}}
+}
+
+func lmpopKeys(argv []Value) []string {
+	return keysAfterNumkeys(argv, 1)
+}
+
+func blmpopKeys(argv []Value) []string {
+	return keysAfterNumkeys(argv, 2)
+}
+
+func lmpop(args []Value, _ *Client) Value {
+	if len(args) < 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'lmpop' command"}
+	}
+
+	keys, where, count, errValue := parseMpopArgs(args)
+	if errValue != nil {
+		return errValue
+	}
+
+	for _, key := range keys {
+		list, errValue := lookupList(key)
+		if errValue != nil {
+			return errValue
+		}
+
+		if list != nil {
+			return mpopFromList(key, list, where, count)
+		}
+	}
+
+	preventCommandPropagation()
+
+	return NullArrayValue{}
+}
+
+func blpop(args []Value, client *Client) Value {
+	return blockingPopGeneric(args, client, "blpop", LIST_HEAD)
+}
+
+func brpop(args []Value, client *Client) Value {
+	return blockingPopGeneric(args, client, "brpop", LIST_TAIL)
+}
+
+// blockingPopGeneric implements BLPOP and BRPOP: it pops from the first
+// non-empty list among the keys, or blocks until one of them gets an element.
+func blockingPopGeneric(args []Value, client *Client, name string, where int) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	timeout, errValue := parseBlockingTimeout(args[len(args)-1])
+	if errValue != nil {
+		return errValue
+	}
+
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		keys = append(keys, arg.(BulkStringValue).Val)
+	}
+
+	serve := func(key string) (Value, bool) {
+		list, errValue := lookupList(key)
+		if errValue != nil || list == nil {
+			return nil, false
+		}
+
+		value, _ := listPop(key, list, where)
+		deleteListIfEmpty(key, list)
+
+		alsoPropagate(popCommandFor(key, where, 1)...)
+
+		return ArrayValue{Val: []Value{BulkStringValue{Val: key}, BulkStringValue{Val: value}}}, true
+	}
+
+	for _, key := range keys {
+		if _, errValue := lookupList(key); errValue != nil {
+			return errValue
+		}
+	}
+
+	for _, key := range keys {
+		if reply, ok := serve(key); ok {
+			preventCommandPropagation()
+			return reply
+		}
+	}
+
+	if !canBlock(client) {
+		// Nothing happened, so there's nothing to propagate either.
+		preventCommandPropagation()
+		return NullArrayValue{}
+	}
+
+	blockForKeys(client, keys, timeout, serve)
+
+	return EmptyValue{}
+}
+
+func blmove(args []Value, client *Client) Value {
+	if len(args) != 5 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'blmove' command"}
+	}
+
+	whereFrom, ok := parseListWhere(args[2])
+	if !ok {
+		return SyntaxError
+	}
+
+	whereTo, ok := parseListWhere(args[3])
+	if !ok {
+		return SyntaxError
+	}
+
+	return blockingMoveGeneric(args[0].(BulkStringValue).Val, args[1].(BulkStringValue).Val, whereFrom, whereTo, args[4], client)
+}
+
+func brpoplpush(args []Value, client *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'brpoplpush' command"}
+	}
+
+	return blockingMoveGeneric(args[0].(BulkStringValue).Val, args[1].(BulkStringValue).Val, LIST_TAIL, LIST_HEAD, args[2], client)
+}
+
+// blockingMoveGeneric implements BLMOVE and BRPOPLPUSH.
+func blockingMoveGeneric(source, destination string, whereFrom, whereTo int, timeoutArg Value, client *Client) Value {
+	timeout, errValue := parseBlockingTimeout(timeoutArg)
+	if errValue != nil {
+		return errValue
+	}
+
+	serve := func(key string) (Value, bool) {
+		list, errValue := lookupList(source)
+		if errValue != nil || list == nil {
+			return nil, false
+		}
+
+		// A destination that was turned into another type makes the move fail,
+		// which unblocks the client with the error.
+		reply := lmoveGeneric(source, destination, whereFrom, whereTo)
+
+		if _, isError := reply.(ErrorValue); !isError {
+			alsoPropagate(
+				BulkStringValue{Val: "LMOVE"},
+				BulkStringValue{Val: source},
+				BulkStringValue{Val: destination},
+				BulkStringValue{Val: listWhereName(whereFrom)},
+				BulkStringValue{Val: listWhereName(whereTo)},
+			)
+		}
+
+		return reply, true
+	}
+
+	list, errValue := lookupList(source)
+	if errValue != nil {
+		return errValue
+	}
+
+	if list != nil {
+		reply, _ := serve(source)
+		preventCommandPropagation()
+		return reply
+	}
+
+	if !canBlock(client) {
+		// Nothing happened, so there's nothing to propagate either.
+		preventCommandPropagation()
+		return NullValue{}
+	}
+
+	blockForKeys(client, []string{source}, timeout, serve)
+
+	return EmptyValue{}
+}
+
+func blmpop(args []Value, client *Client) Value {
+	if len(args) < 4 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'blmpop' command"}
+	}
+
+	timeout, errValue := parseBlockingTimeout(args[0])
+	if errValue != nil {
+		return errValue
+	}
+
+	keys, where, count, errValue := parseMpopArgs(args[1:])
+	if errValue != nil {
+		return errValue
+	}
+
+	serve := func(key string) (Value, bool) {
+		list, errValue := lookupList(key)
+		if errValue != nil || list == nil {
+			return nil, false
+		}
+
+		alsoPropagate(popCommandFor(key, where, min(count, list.Len()))...)
+
+		return mpopFromList(key, list, where, count), true
+	}
+
+	for _, key := range keys {
+		if _, errValue := lookupList(key); errValue != nil {
+			return errValue
+		}
+	}
+
+	for _, key := range keys {
+		if reply, ok := serve(key); ok {
+			preventCommandPropagation()
+			return reply
+		}
+	}
+
+	if !canBlock(client) {
+		// Nothing happened, so there's nothing to propagate either.
+		preventCommandPropagation()
+		return NullArrayValue{}
+	}
+
+	blockForKeys(client, keys, timeout, serve)
+
+	return EmptyValue{}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_DEBUG = iota
+	LOG_VERBOSE
+	LOG_NOTICE
+	LOG_WARNING
+)
+
+// logLevels maps the loglevel setting to the least important level logged.
+var logLevels = map[string]int{
+	"debug":   LOG_DEBUG,
+	"verbose": LOG_VERBOSE,
+	"notice":  LOG_NOTICE,
+	"warning": LOG_WARNING,
+}
+
+var (
+	logMutex  sync.Mutex
+	logOutput io.Writer = os.Stdout
+)
+
+// openLog sends the log to the logfile setting, or to the standard output if
+// it's empty.
+func openLog(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	logOutput = file
+
+	return nil
+}
+
+// serverLog logs a message if its level is at least the loglevel setting. Like
+// Redis, every line has a timestamp and a mark for its level.
+func serverLog(level int, format string, args ...any) {
+	if level < logLevels[serverConfig().LogLevel] {
+		return
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	fmt.Fprintf(logOutput, "%d:M %s %c %s\n", os.Getpid(), time.Now().Format("02 Jan 2006 15:04:05.000"), ".-*#"[level], fmt.Sprintf(format, args...))
+}
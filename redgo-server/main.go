@@ -1,35 +1,123 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 func main() {
-	fmt.Println("Initiating RedGo....")
+	if strings.HasPrefix(filepath.Base(os.Args[0]), "redgo-check-aof") {
+		os.Exit(checkAofMain(os.Args[1:]))
+	}
+
+	config, path, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	currentConfig.Store(config)
+	configFile = path
 
-	listener, err := net.Listen("tcp", ":7000")
+	if err := openLog(config.LogFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Can't open the log file:", err)
+		os.Exit(1)
+	}
+
+	serverLog(LOG_NOTICE, "Initiating RedGo....")
+
+	if configFile == "" {
+		serverLog(LOG_WARNING, "No config file specified, using the default config. In order to specify a config file use redgo-server /path/to/redgo.conf")
+	}
 
+	listeners, err := listen(config)
 	if err != nil {
-		fmt.Println(err)
+		serverLog(LOG_WARNING, "%v", err)
 		return
 	}
 
-	aof, err := InitAof()
+	// With the AOF on, it's the most complete record of the dataset, and the
+	// snapshot isn't loaded.
+	var aof *Aof
+	if config.AppendOnly {
+		aof, err = InitAof()
+	} else {
+		err = rdbLoad()
+	}
+
 	if err != nil {
-		fmt.Println(err)
+		serverLog(LOG_WARNING, "%v", err)
 		return
 	}
-	defer aof.Close()
 
-	fmt.Println("Listening on port 7000...")
+	serverListeners = listeners
+	serverAof = aof
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go handleShutdownSignals(signals)
+
+	StartExpireSweeper()
+	StartSaveScheduler()
 
+	serverLog(LOG_NOTICE, "Listening on port %d...", config.Port)
+
+	errs := make(chan error)
+	for _, listener := range listeners {
+		go func() {
+			// The listeners are only closed on shutdown, which exits on its own.
+			if err := acceptConnections(listener, aof); !errors.Is(err, net.ErrClosed) {
+				errs <- err
+			}
+		}()
+	}
+
+	serverLog(LOG_WARNING, "%v", <-errs)
+}
+
+// listen opens a listener on the port for every address of the bind setting,
+// or for every interface if there's none.
+func listen(config *Config) ([]net.Listener, error) {
+	addresses := config.Bind
+	if len(addresses) == 0 {
+		addresses = []string{""}
+	}
+
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(config.Port)))
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+func acceptConnections(listener net.Listener, aof *Aof) error {
 	for {
 		connection, err := listener.Accept()
-
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
+		}
+
+		ClientsMutex.Lock()
+		full := len(Clients) >= serverConfig().MaxClients
+		ClientsMutex.Unlock()
+
+		if full {
+			connection.Write([]byte("-ERR max number of clients reached\r\n"))
+			connection.Close()
+			continue
 		}
 
 		go handleConnection(connection, aof)
@@ -38,8 +126,8 @@ func main() {
 
 func handleConnection(conn net.Conn, aof *Aof) {
 	clientID := conn.RemoteAddr().String()
-	reader := NewReader(conn)
 	writer := NewWriter(conn)
+	reader := NewReader(flushBeforeRead{reader: conn, writer: writer})
 
 	client := &Client{
 		ID:            clientID,
@@ -47,13 +135,15 @@ func handleConnection(conn net.Conn, aof *Aof) {
 		Subscriptions: make(map[string]*PubSubChannel),
 		Reader:        reader,
 		Writer:        writer,
+		// Clients connected before a password is set stay authenticated.
+		Authenticated: serverConfig().RequirePass == "",
 	}
 
 	ClientsMutex.Lock()
 	Clients[clientID] = client
 	ClientsMutex.Unlock()
 
-	fmt.Println("New client connected:", clientID)
+	serverLog(LOG_VERBOSE, "New client connected: %s", clientID)
 
 	defer func() {
 		conn.Close()
@@ -61,11 +151,14 @@ func handleConnection(conn net.Conn, aof *Aof) {
 		delete(Clients, clientID)
 		ClientsMutex.Unlock()
 		unsubscribeAll(client)
-		fmt.Println("Client disconnected:", clientID)
+		DB.Lock()
+		unwatchAllKeys(client)
+		DB.Unlock()
+		serverLog(LOG_VERBOSE, "Client disconnected: %s", clientID)
 	}()
 
 	for {
-		err := Handle(*client, aof)
+		err := Handle(client, aof)
 		if err != nil {
 			break
 		}
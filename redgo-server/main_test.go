@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// startTestServer serves connections on a random port until the test ends,
+// without an AOF, and returns its address.
+func startTestServer(tb testing.TB) string {
+	return startTestServerWithAof(tb, nil)
+}
+
+// startTestServerWithAof is startTestServer with the commands propagated to
+// aof, which may be nil.
+func startTestServerWithAof(tb testing.TB, aof *Aof) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go handleConnection(conn, aof)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// BenchmarkPipeline measures the throughput of SET commands sent over a
+// connection in batches of the given depth, one command per op.
+func BenchmarkPipeline(b *testing.B) {
+	addr := startTestServer(b)
+
+	command := ArrayValue{Val: []Value{
+		BulkStringValue{Val: "SET"},
+		BulkStringValue{Val: "key"},
+		BulkStringValue{Val: "value"},
+	}}.Marshal()
+	reply := StringValue{Val: "OK"}.Marshal()
+
+	for _, depth := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+
+			var batch, replies []byte
+			for i := 0; i < depth; i++ {
+				batch = append(batch, command...)
+				replies = append(replies, reply...)
+			}
+			received := make([]byte, len(replies))
+
+			b.ResetTimer()
+
+			for sent := 0; sent < b.N; sent += depth {
+				n := min(depth, b.N-sent)
+
+				if _, err := conn.Write(batch[:n*len(command)]); err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := io.ReadFull(reader, received[:n*len(reply)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+
+			if string(received[:len(reply)]) != string(reply) {
+				b.Fatalf("unexpected reply %q", received[:len(reply)])
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+// MultiState holds the commands a client queued since MULTI.
+type MultiState struct {
+	commands []QueuedCommand
+	// aborted is set when a command failed to queue, which makes EXEC discard
+	// the transaction.
+	aborted bool
+}
+
+type QueuedCommand struct {
+	Name string
+	Args []Value
+}
+
+// WatchedKey tracks a key watched by at least one client.
+type WatchedKey struct {
+	// version changes every time the key is modified.
+	version  uint64
+	watchers int
+}
+
+// Watch registers a watcher of the key and returns the key's current version.
+func (ks *Keyspace) Watch(key string) uint64 {
+	watched, found := ks.watched[key]
+	if !found {
+		watched = &WatchedKey{}
+		ks.watched[key] = watched
+	}
+
+	watched.watchers++
+
+	return watched.version
+}
+
+func (ks *Keyspace) Unwatch(key string) {
+	watched, found := ks.watched[key]
+	if !found {
+		return
+	}
+
+	watched.watchers--
+	if watched.watchers == 0 {
+		delete(ks.watched, key)
+	}
+}
+
+// Version returns the version of a watched key.
+func (ks *Keyspace) Version(key string) uint64 {
+	return ks.watched[key].version
+}
+
+// touchWatchedKey records that the key was modified, so the transactions of the
+// clients watching it fail.
+func (ks *Keyspace) touchWatchedKey(key string) {
+	if watched, found := ks.watched[key]; found {
+		watched.version++
+	}
+}
+
+// signalModifiedKey is called by the commands that change a value in place,
+// e.g. pushing to a list, which the keyspace can't tell from a lookup, so
+// that the transactions watching the key fail.
+func signalModifiedKey(key string) {
+	DB.touchWatchedKey(key)
+}
+
+// queueMultiCommand queues the command if the client is in a transaction. It
+// returns the reply to send and true if the command was queued or rejected,
+// or false if it must run right away, like EXEC.
+func queueMultiCommand(client *Client, command string, args []Value) (Value, bool) {
+	if client.Multi == nil {
+		return nil, false
+	}
+
+	switch command {
+	case "EXEC", "DISCARD", "MULTI", "WATCH":
+		return nil, false
+	}
+
+	// Errors caught now, rather than when the command runs, abort the transaction.
+	cmd, errValue := lookupCommand(command, args)
+	if errValue == nil && cmd.NoMulti {
+		errValue = ErrorValue{Val: "ERR Command not allowed inside a transaction"}
+	}
+
+	if errValue != nil {
+		client.Multi.aborted = true
+		return errValue, true
+	}
+
+	client.Multi.commands = append(client.Multi.commands, QueuedCommand{Name: command, Args: args})
+
+	return StringValue{Val: "QUEUED"}, true
+}
+
+// EXEC runs other commands through the command table, so it can't be part of
+// the table's initializer.
+func init() {
+	Handlers["EXEC"] = Command{Handler: exec, Arity: 1}
+}
+
+func multi(_ []Value, client *Client) Value {
+	if client.Multi != nil {
+		return ErrorValue{Val: "ERR MULTI calls can not be nested"}
+	}
+
+	client.Multi = &MultiState{}
+
+	return StringValue{Val: "OK"}
+}
+
+// exec runs the queued commands with the keyspace locked, so no other client
+// sees the transaction half done, and wraps what they propagate in MULTI/EXEC
+// so the AOF replays it as a unit too.
+func exec(_ []Value, client *Client) Value {
+	if client.Multi == nil {
+		return ErrorValue{Val: "ERR EXEC without MULTI"}
+	}
+
+	state := client.Multi
+
+	defer func() {
+		client.Multi = nil
+		unwatchAllKeys(client)
+	}()
+
+	if state.aborted {
+		return ErrorValue{Val: "EXECABORT Transaction discarded because of previous errors."}
+	}
+
+	if watchedKeysModified(client) {
+		return NullArrayValue{}
+	}
+
+	alsoPropagate(BulkStringValue{Val: "MULTI"})
+	propagated := len(pendingPropagation)
+
+	replies := make([]Value, len(state.commands))
+	for i, queued := range state.commands {
+		// Relative expirations are resolved when the command runs, not when it was queued.
+		command, args := absoluteExpiryCommand(queued.Name, queued.Args)
+		replies[i] = propagateCall(command, args, client)
+	}
+
+	if len(pendingPropagation) == propagated {
+		pendingPropagation = pendingPropagation[:propagated-1]
+	} else {
+		alsoPropagate(BulkStringValue{Val: "EXEC"})
+	}
+
+	return ArrayValue{Val: replies}
+}
+
+func discard(_ []Value, client *Client) Value {
+	if client.Multi == nil {
+		return ErrorValue{Val: "ERR DISCARD without MULTI"}
+	}
+
+	client.Multi = nil
+	unwatchAllKeys(client)
+
+	return StringValue{Val: "OK"}
+}
+
+func watch(args []Value, client *Client) Value {
+	if client.Multi != nil {
+		return ErrorValue{Val: "ERR WATCH inside MULTI is not allowed"}
+	}
+
+	if client.Watched == nil {
+		client.Watched = make(map[string]uint64)
+	}
+
+	for _, key := range keysFromArgs(args) {
+		if _, found := client.Watched[key]; found {
+			continue
+		}
+
+		// A key that already expired is deleted before taking its version, so
+		// its deletion doesn't count as a change.
+		DB.Lookup(key)
+
+		client.Watched[key] = DB.Watch(key)
+	}
+
+	return StringValue{Val: "OK"}
+}
+
+func unwatch(_ []Value, client *Client) Value {
+	unwatchAllKeys(client)
+
+	return StringValue{Val: "OK"}
+}
+
+func unwatchAllKeys(client *Client) {
+	for key := range client.Watched {
+		DB.Unwatch(key)
+	}
+
+	client.Watched = nil
+}
+
+// watchedKeysModified tells whether any key watched by the client was modified,
+// or expired, since it was watched.
+func watchedKeysModified(client *Client) bool {
+	for key, version := range client.Watched {
+		DB.expireIfNeeded(key)
+
+		if DB.Version(key) != version {
+			return true
+		}
+	}
+
+	return false
+}
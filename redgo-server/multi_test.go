@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestWatchModifiedInPlace checks that the commands changing a value in place,
+// rather than storing a new one, abort the transactions watching the key,
+// including those whose changes are propagated as other commands.
+func TestWatchModifiedInPlace(t *testing.T) {
+	addr := startTestServer(t)
+	watcher := dialTestClient(t, addr)
+	other := dialTestClient(t, addr)
+
+	tests := []struct {
+		setup   []string
+		command string
+	}{
+		{[]string{"RPUSH test:watch a b"}, "LPUSH test:watch c"},
+		{[]string{"RPUSH test:watch a b"}, "RPOP test:watch"},
+		{[]string{"RPUSH test:watch a b"}, "LSET test:watch 0 c"},
+		{[]string{"RPUSH test:watch a b"}, "LTRIM test:watch 0 0"},
+		{[]string{"RPUSH test:watch a b"}, "LINSERT test:watch BEFORE a c"},
+		{[]string{"RPUSH test:watch a b"}, "LMOVE test:watch test:watch LEFT RIGHT"},
+		{[]string{"SADD test:watch a b"}, "SADD test:watch c"},
+		{[]string{"SADD test:watch a b"}, "SPOP test:watch"},
+		{[]string{"SADD test:watch a b"}, "SMOVE test:watch test:watch:other a"},
+		{[]string{"ZADD test:watch 1 a 2 b"}, "ZINCRBY test:watch 1 a"},
+		{[]string{"ZADD test:watch 1 a 2 b"}, "ZPOPMIN test:watch"},
+		{[]string{"ZADD test:watch 1 a 2 b"}, "ZREMRANGEBYRANK test:watch 0 0"},
+		{[]string{"HSET test:watch a 1 b 2"}, "HINCRBYFLOAT test:watch a 1.5"},
+		{[]string{"HSET test:watch a 1 b 2"}, "HPEXPIRE test:watch 100000 FIELDS 1 a"},
+		{[]string{"XADD test:watch 1-1 f v"}, "XADD test:watch * f v"},
+		{[]string{"XADD test:watch 1-1 f v"}, "XSETID test:watch 5-0"},
+		{[]string{"XADD test:watch 1-1 f v", "XGROUP CREATE test:watch g 0"}, "XREADGROUP GROUP g c STREAMS test:watch >"},
+		{[]string{"XADD test:watch 1-1 f v", "XGROUP CREATE test:watch g 0", "XREADGROUP GROUP g c STREAMS test:watch >"}, "XACK test:watch g 1-1"},
+		{[]string{"SET test:watch 1"}, "INCRBYFLOAT test:watch 1.5"},
+		{[]string{"SET test:watch 1"}, "PEXPIRE test:watch 100000"},
+	}
+
+	for _, test := range tests {
+		for _, setup := range test.setup {
+			other.send(strings.Fields(setup)...)
+			other.reply()
+		}
+
+		watcher.do("+OK\r\n", "WATCH", "test:watch")
+
+		other.send(strings.Fields(test.command)...)
+		if reply, isError := other.reply().(ErrorValue); isError {
+			t.Fatalf("%s failed: %s", test.command, reply.Val)
+		}
+
+		watcher.do("+OK\r\n", "MULTI")
+		watcher.do("+QUEUED\r\n", "PING")
+		watcher.send("EXEC")
+		if reply := watcher.reply(); reply != (NullArrayValue{}) {
+			t.Fatalf("%s didn't abort the transaction watching the key, EXEC replied %#v", test.command, reply)
+		}
+
+		other.do(":1\r\n", "DEL", "test:watch")
+		other.send("DEL", "test:watch:other")
+		other.reply()
+	}
+}
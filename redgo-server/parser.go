@@ -2,60 +2,355 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
-	"net"
+	"math"
 	"strconv"
+	"sync"
 )
 
+const (
+	// Size of the per-client buffer replies are accumulated in before being sent.
+	outputBufferSize = 16 * 1024
+	// Longest line accepted, whether an inline command or the header of an
+	// array or bulk string. It's also the size of the per-client buffer input
+	// is read into, so a line that doesn't fit is one too long.
+	protoInlineMaxSize = 64 * 1024
+	// Bulk strings longer than this are allocated as their payload arrives,
+	// rather than up front from a length that may never be honored.
+	bulkPreallocLimit = 64 * 1024
+)
+
+// Reader is a streaming RESP parser. Lines such as array and bulk headers are
+// parsed straight from its buffer, while every payload is copied out into a
+// byte slice of its own.
 type Reader struct {
 	reader *bufio.Reader
 }
 
 func NewReader(ioReader io.Reader) *Reader {
 	return &Reader{
-		reader: bufio.NewReader(ioReader),
+		reader: bufio.NewReaderSize(ioReader, protoInlineMaxSize),
 	}
 }
 
-func (p *Reader) readLine() (line []byte, n int, err error) {
-	for {
-		b, err := p.reader.ReadByte()
+// Buffered returns the number of bytes received but not parsed yet.
+func (p *Reader) Buffered() int {
+	return p.reader.Buffered()
+}
+
+// WaitForInput blocks until input is available or reading fails, without consuming anything.
+func (p *Reader) WaitForInput() error {
+	_, err := p.reader.Peek(1)
+	return err
+}
+
+// ProtocolError reports malformed input. The rest of the input can't be
+// parsed after it, so the connection is closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// readLine reads a line ended by \n, which inline commands may use instead of
+// \r\n, failing with a ProtocolError carrying tooBig if it's longer than
+// protoInlineMaxSize. The line is only valid until the next read.
+func (p *Reader) readLine(tooBig string) ([]byte, error) {
+	line, err := p.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ProtocolError{msg: tooBig}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return line, nil
+}
+
+// readInteger reads a line holding an integer, failing with a ProtocolError
+// carrying invalid if it doesn't.
+func (p *Reader) readInteger(tooBig, invalid string) (int64, error) {
+	line, err := p.readLine(tooBig)
+	if err != nil {
+		return 0, err
+	}
+
+	val, ok := parseInteger(line)
+	if !ok {
+		return 0, ProtocolError{msg: invalid}
+	}
+
+	return val, nil
+}
+
+// parseInteger parses a base 10 integer without going through a string.
+func parseInteger(b []byte) (int64, bool) {
+	negative := len(b) > 0 && b[0] == '-'
+	if negative {
+		b = b[1:]
+	}
+
+	if len(b) == 0 || len(b) > 19 {
+		return 0, false
+	}
+
+	var val uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		val = val*10 + uint64(c-'0')
+	}
+
+	if negative {
+		if val > math.MaxInt64+1 {
+			return 0, false
+		}
+		return -int64(val), true
+	}
+
+	if val > math.MaxInt64 {
+		return 0, false
+	}
+
+	return int64(val), true
+}
+
+// readBulk reads the payload of a bulk string of the given length and skips
+// the \r\n after it. Large payloads are read in chunks of growing size, so
+// the memory allocated stays in line with what was actually received. The
+// payload is kept as is by the keyspace, see commandArgs, so the buffer is
+// grown to the exact size rather than with append's spare capacity.
+func (p *Reader) readBulk(length int64) ([]byte, error) {
+	total := int(length) + 2
+
+	bulk := make([]byte, min(total, bulkPreallocLimit))
+	if _, err := io.ReadFull(p.reader, bulk); err != nil {
+		return nil, err
+	}
+
+	for len(bulk) < total {
+		read := len(bulk)
+		grown := make([]byte, read+min(total-read, read))
+		copy(grown, bulk)
+		bulk = grown
+
+		if _, err := io.ReadFull(p.reader, bulk[read:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return bulk[:length], nil
+}
 
+// ReadCommand reads the next command, sent either as an array of bulk strings
+// or inline as a line of space separated arguments. Empty commands are skipped.
+func (p *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		first, err := p.reader.Peek(1)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
-		if b == '\r' {
-			p.reader.ReadByte()
-			break
+		var argv [][]byte
+		if first[0] == ARRAY {
+			argv, err = p.readMultibulkCommand()
 		} else {
-			n += 1
-			line = append(line, b)
+			argv, err = p.readInlineCommand()
+		}
+
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	return line, n, nil
+		if len(argv) > 0 {
+			return argv, nil
+		}
+	}
 }
 
-func (p *Reader) readInteger() (val int64, n int, err error) {
-	line, _, err := p.readLine()
+func (p *Reader) readMultibulkCommand() ([][]byte, error) {
+	p.reader.ReadByte()
 
+	count, err := p.readInteger("too big mbulk count string", "invalid multibulk length")
 	if err != nil {
-		return 0, 0, err
+		return nil, err
+	}
+
+	if count > serverConfig().ProtoMaxMultibulkLen {
+		return nil, ProtocolError{msg: "invalid multibulk length"}
+	}
+
+	// Like an empty line, an empty or null array is no command at all.
+	if count <= 0 {
+		return nil, nil
+	}
+
+	// The length can't be trusted until the arguments actually arrive.
+	argv := make([][]byte, 0, min(count, 1024))
+
+	for i := int64(0); i < count; i++ {
+		_type, err := p.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if _type != BULK_STRING {
+			return nil, ProtocolError{msg: fmt.Sprintf("expected '$', got '%c'", _type)}
+		}
+
+		length, err := p.readInteger("too big bulk count string", "invalid bulk length")
+		if err != nil {
+			return nil, err
+		}
+
+		if length < 0 || length > serverConfig().ProtoMaxBulkLen {
+			return nil, ProtocolError{msg: "invalid bulk length"}
+		}
+
+		arg, err := p.readBulk(length)
+		if err != nil {
+			return nil, err
+		}
+
+		argv = append(argv, arg)
 	}
 
-	val, err = strconv.ParseInt(string(line), 10, 64)
+	return argv, nil
+}
 
+// readInlineCommand reads a command typed by hand, e.g. through telnet.
+func (p *Reader) readInlineCommand() ([][]byte, error) {
+	line, err := p.readLine("too big inline request")
 	if err != nil {
-		return 0, 0, err
+		return nil, err
+	}
+
+	argv, ok := splitArgs(line)
+	if !ok {
+		return nil, ProtocolError{msg: "unbalanced quotes in request"}
+	}
+
+	return argv, nil
+}
+
+// splitArgs splits an inline command into its arguments, which are separated
+// by spaces and may be quoted as in redis-cli: double quotes support escapes
+// like \n and \x41, single quotes only \'. It returns false if quotes are
+// unbalanced or a closing quote isn't followed by a space.
+func splitArgs(line []byte) ([][]byte, bool) {
+	args := [][]byte{}
+
+	for i := 0; ; {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+
+		if i == len(line) {
+			return args, true
+		}
+
+		// Arguments are never empty slices, even "", so every one gets its own.
+		arg := []byte{}
+		inDoubleQuotes, inSingleQuotes := false, false
+
+		for done := false; !done; i++ {
+			if i == len(line) {
+				if inDoubleQuotes || inSingleQuotes {
+					return nil, false
+				}
+				break
+			}
+
+			c := line[i]
+
+			switch {
+			case inDoubleQuotes:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					arg = append(arg, hexDigitValue(line[i+2])<<4|hexDigitValue(line[i+3]))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if c == '"' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSingleQuotes:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case isInlineSpace(c):
+				done = true
+			case c == '"':
+				inDoubleQuotes = true
+			case c == '\'':
+				inSingleQuotes = true
+			default:
+				arg = append(arg, c)
+			}
+		}
+
+		args = append(args, arg)
 	}
+}
 
-	return val, n, nil
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
 }
 
+// ParseFromRespString parses any RESP2 value, as found in replies or in the AOF.
 func (p *Reader) ParseFromRespString() (Value, error) {
 	_type, err := p.reader.ReadByte()
-
 	if err != nil {
 		return EmptyValue{}, err
 	}
@@ -65,64 +360,145 @@ func (p *Reader) ParseFromRespString() (Value, error) {
 		return p.parseArray()
 	case BULK_STRING:
 		return p.parseBulkStr()
+	case STRING, ERROR:
+		line, err := p.readLine("too big inline request")
+		if err != nil {
+			return EmptyValue{}, err
+		}
+
+		if _type == ERROR {
+			return ErrorValue{Val: string(line)}, nil
+		}
+		return StringValue{Val: string(line)}, nil
+	case INTEGER:
+		val, err := p.readInteger("too big inline request", "invalid integer")
+		if err != nil {
+			return EmptyValue{}, err
+		}
+
+		return IntegerValue{Val: int(val)}, nil
+	case NULL:
+		if _, err := p.readLine("too big inline request"); err != nil {
+			return EmptyValue{}, err
+		}
+
+		return NullValue{}, nil
 	default:
-		return EmptyValue{}, nil
+		return EmptyValue{}, ProtocolError{msg: fmt.Sprintf("unexpected type '%c'", _type)}
 	}
 }
 
-func (p *Reader) parseBulkStr() (Value, error) {
-	val := BulkStringValue{}
+// ReadAnnotation reads a line starting with '#', which the AOF holds
+// annotations in, without the '#'. It reads nothing and returns false if the
+// next line isn't one.
+func (p *Reader) ReadAnnotation() (string, bool, error) {
+	b, err := p.reader.Peek(1)
+	if err != nil || b[0] != '#' {
+		return "", false, err
+	}
 
-	len, _, err := p.readInteger()
+	line, err := p.readLine("too big annotation")
 	if err != nil {
-		return val, err
+		return "", false, err
 	}
 
-	bulk := make([]byte, len)
-	_, errDuringRead := p.reader.Read(bulk)
+	return string(line[1:]), true, nil
+}
 
-	if errDuringRead != nil {
-		return val, errDuringRead
+func (p *Reader) parseBulkStr() (Value, error) {
+	length, err := p.readInteger("too big bulk count string", "invalid bulk length")
+	if err != nil {
+		return EmptyValue{}, err
 	}
 
-	p.readLine()
+	if length == -1 {
+		return NullValue{}, nil
+	}
 
-	val.Val = string(bulk)
+	if length < 0 || length > serverConfig().ProtoMaxBulkLen {
+		return EmptyValue{}, ProtocolError{msg: "invalid bulk length"}
+	}
 
-	return val, nil
+	bulk, err := p.readBulk(length)
+	if err != nil {
+		return EmptyValue{}, err
+	}
+
+	return BulkStringValue{Val: string(bulk)}, nil
 }
 
 func (p *Reader) parseArray() (Value, error) {
-	val := ArrayValue{}
-
-	len, _, err := p.readInteger()
+	count, err := p.readInteger("too big mbulk count string", "invalid multibulk length")
 	if err != nil {
-		return val, err
+		return EmptyValue{}, err
 	}
 
-	val.Val = make([]Value, len)
+	if count == -1 {
+		return NullArrayValue{}, nil
+	}
 
-	for i := 0; i < int(len); i++ {
-		v, err := p.ParseFromRespString()
+	if count < 0 || count > serverConfig().ProtoMaxMultibulkLen {
+		return EmptyValue{}, ProtocolError{msg: "invalid multibulk length"}
+	}
 
+	val := ArrayValue{Val: make([]Value, 0, min(count, 1024))}
+
+	for i := int64(0); i < count; i++ {
+		v, err := p.ParseFromRespString()
 		if err != nil {
-			return val, err
+			return EmptyValue{}, err
 		}
 
-		val.Val[i] = v
+		val.Val = append(val.Val, v)
 	}
 
 	return val, nil
 }
 
+// Writer accumulates replies in an output buffer, which is sent with Flush.
+// The mutex lets other clients write to it, like PUBLISH does.
 type Writer struct {
-	writer io.Writer
+	mu     sync.Mutex
+	writer *bufio.Writer
+	// protocol is the RESP version negotiated with HELLO.
+	protocol int
 }
 
-func NewWriter(conn net.Conn) *Writer {
+func NewWriter(ioWriter io.Writer) *Writer {
 	return &Writer{
-		writer: io.Writer(conn),
+		writer:   bufio.NewWriterSize(ioWriter, outputBufferSize),
+		protocol: 2,
+	}
+}
+
+func (w *Writer) Protocol() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.protocol
+}
+
+func (w *Writer) SetProtocol(protocol int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.protocol = protocol
+}
+
+// flushBeforeRead flushes the client's pending replies whenever its input is
+// drained and more has to be read from the connection, so the replies to a
+// pipelined batch of commands go out together once the whole batch ran.
+type flushBeforeRead struct {
+	reader io.Reader
+	writer *Writer
+}
+
+func (f flushBeforeRead) Read(p []byte) (int, error) {
+	if err := f.writer.Flush(); err != nil {
+		return 0, err
 	}
+
+	return f.reader.Read(p)
 }
 
 func (v StringValue) Marshal() (bytes []byte) {
@@ -159,37 +535,124 @@ func (v BulkStringValue) Marshal() (bytes []byte) {
 	return bytes
 }
 
-func (v ArrayValue) Marshal() (bytes []byte) {
-	bytes = append(bytes, ARRAY)
-	bytes = append(bytes, strconv.Itoa(len(v.Val))...)
+func (v ArrayValue) Marshal() []byte {
+	return marshalAggregate(ARRAY, len(v.Val), v.Val)
+}
+
+func (v NullValue) Marshal() (bytes []byte) {
+	bytes = append(bytes, NULL)
 	bytes = append(bytes, '\r', '\n')
 
-	for _, value := range v.Val {
+	return bytes
+}
+
+func (v NullArrayValue) Marshal() []byte {
+	return NullValue{}.Marshal()
+}
+
+func (v nullBulkString) Marshal() []byte {
+	return []byte("$-1\r\n")
+}
+
+func (v nullArray) Marshal() []byte {
+	return []byte("*-1\r\n")
+}
+
+func (v EmptyValue) Marshal() (bytes []byte) {
+	return []byte{}
+}
+
+// marshalAggregate marshals the header of an aggregate type followed by its elements.
+func marshalAggregate(_type byte, count int, values []Value) (bytes []byte) {
+	bytes = append(bytes, _type)
+	bytes = append(bytes, strconv.Itoa(count)...)
+	bytes = append(bytes, '\r', '\n')
+
+	for _, value := range values {
 		bytes = append(bytes, value.Marshal()...)
 	}
 
 	return bytes
 }
 
-func (v NullValue) Marshal() (bytes []byte) {
-	bytes = append(bytes, NULL)
+func (v MapValue) Marshal() []byte {
+	return marshalAggregate(MAP, len(v.Val)/2, v.Val)
+}
+
+func (v SetValue) Marshal() []byte {
+	return marshalAggregate(SET, len(v.Val), v.Val)
+}
+
+func (v PushValue) Marshal() []byte {
+	return marshalAggregate(PUSH, len(v.Val), v.Val)
+}
+
+func (v AttributeValue) Marshal() []byte {
+	return append(marshalAggregate(ATTRIBUTE, len(v.Attributes)/2, v.Attributes), v.Val.Marshal()...)
+}
+
+func (v DoubleValue) Marshal() (bytes []byte) {
+	bytes = append(bytes, DOUBLE)
+	if math.IsNaN(v.Val) {
+		bytes = append(bytes, "nan"...)
+	} else {
+		bytes = append(bytes, formatScore(v.Val)...)
+	}
 	bytes = append(bytes, '\r', '\n')
 
 	return bytes
 }
 
-func (v EmptyValue) Marshal() (bytes []byte) {
-	return []byte{}
+func (v BooleanValue) Marshal() (bytes []byte) {
+	bytes = append(bytes, BOOLEAN)
+	if v.Val {
+		bytes = append(bytes, 't')
+	} else {
+		bytes = append(bytes, 'f')
+	}
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
+func (v BigNumberValue) Marshal() (bytes []byte) {
+	bytes = append(bytes, BIG_NUMBER)
+	bytes = append(bytes, v.Val...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
 }
 
+func (v VerbatimStringValue) Marshal() (bytes []byte) {
+	bytes = append(bytes, VERBATIM)
+	bytes = append(bytes, strconv.Itoa(len(v.Format)+1+len(v.Val))...)
+	bytes = append(bytes, '\r', '\n')
+	bytes = append(bytes, v.Format...)
+	bytes = append(bytes, ':')
+	bytes = append(bytes, v.Val...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
+// WriteAsRespString appends the value to the output buffer, in the client's
+// protocol. It's only sent once the buffer fills up or is flushed.
 func (w *Writer) WriteAsRespString(value Value) error {
-	bytes := value.Marshal()
-	println("Writing bytes:", string(bytes))
-	_, err := w.writer.Write(bytes)
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	if err != nil {
-		return err
+	if w.protocol == 2 {
+		value = toResp2(value)
 	}
 
-	return nil
+	_, err := w.writer.Write(value.Marshal())
+
+	return err
+}
+
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writer.Flush()
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+var parserSeeds = []string{
+	"*1\r\n$4\r\nPING\r\n",
+	"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+	"*2\r\n$3\r\nGET\r\n$0\r\n\r\n",
+	"*0\r\n*-1\r\n",
+	"*999999999\r\n",
+	"*1\r\n$999999999\r\n",
+	"*1\r\n$-5\r\n",
+	"*1\r\n+PING\r\n",
+	"*abc\r\n",
+	"PING\r\n",
+	"SET key \"hello\\x41 world\" 'it\\'s'\n",
+	"SET key \"unbalanced\r\n",
+	"+OK\r\n-ERR oops\r\n:42\r\n$-1\r\n*-1\r\n_\r\n",
+	"*2\r\n*1\r\n:1\r\n$3\r\nfoo\r\n",
+}
+
+// checkParseError fails unless err is the end of the input or a protocol error.
+func checkParseError(t *testing.T, err error) {
+	var protocolErr ProtocolError
+	if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &protocolErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// FuzzReadCommand checks that any input is either parsed into commands, which
+// parse back to the same arguments once encoded as arrays of bulk strings,
+// or rejected with a protocol error.
+func FuzzReadCommand(f *testing.F) {
+	for _, seed := range parserSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := NewReader(bytes.NewReader(data))
+
+		for {
+			argv, err := reader.ReadCommand()
+			if err != nil {
+				checkParseError(t, err)
+				return
+			}
+
+			if len(argv) == 0 {
+				t.Fatal("empty command")
+			}
+
+			encoded := ArrayValue{Val: commandArgs(argv)}.Marshal()
+
+			again, err := NewReader(bytes.NewReader(encoded)).ReadCommand()
+			if err != nil {
+				t.Fatalf("can't parse %q back: %v", encoded, err)
+			}
+
+			if !reflect.DeepEqual(argv, again) {
+				t.Fatalf("%q parsed back as %q", argv, again)
+			}
+		}
+	})
+}
+
+// TestCommandArgsShareBytes checks that the arguments handed to the handlers
+// are the bytes the Reader read rather than copies, and that they're left
+// alone by the commands read after them.
+func TestCommandArgsShareBytes(t *testing.T) {
+	large := string(bytes.Repeat([]byte("x"), 3*bulkPreallocLimit))
+	input := ArrayValue{Val: []Value{BulkStringValue{Val: "SET"}, BulkStringValue{Val: large}}}.Marshal()
+	input = append(input, "SET yyyyyyyy\r\n"...)
+
+	reader := NewReader(bytes.NewReader(input))
+
+	argv, err := reader.ReadCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := commandArgs(argv)
+	value := args[1].(BulkStringValue).Val
+
+	if unsafe.StringData(value) != unsafe.SliceData(argv[1]) {
+		t.Fatal("the argument was copied")
+	}
+
+	if cap(argv[1]) > len(large)+2 {
+		t.Fatalf("the argument keeps %d bytes for %d", cap(argv[1]), len(large))
+	}
+
+	if _, err := reader.ReadCommand(); err != nil {
+		t.Fatal(err)
+	}
+
+	if value != large {
+		t.Fatal("the argument changed when the next command was read")
+	}
+}
+
+// FuzzParseFromRespString checks that any input is either parsed into values,
+// which parse back to the same values once marshaled, or rejected with an error.
+func FuzzParseFromRespString(f *testing.F) {
+	for _, seed := range parserSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := NewReader(bytes.NewReader(data))
+
+		for {
+			value, err := reader.ParseFromRespString()
+			if err != nil {
+				checkParseError(t, err)
+				return
+			}
+
+			encoded := toResp2(value).Marshal()
+
+			again, err := NewReader(bytes.NewReader(encoded)).ParseFromRespString()
+			if err != nil {
+				t.Fatalf("can't parse %q back: %v", encoded, err)
+			}
+
+			if !reflect.DeepEqual(value, again) {
+				t.Fatalf("%#v parsed back as %#v", value, again)
+			}
+		}
+	})
+}
+
+// BenchmarkReadCommand measures parsing commands into the arguments handed to
+// the handlers. The "lying-length" case is a bulk string announcing far more
+// than it sends, whose cost stays in line with what actually arrives.
+func BenchmarkReadCommand(b *testing.B) {
+	set := ArrayValue{Val: []Value{
+		BulkStringValue{Val: "SET"},
+		BulkStringValue{Val: "key"},
+		BulkStringValue{Val: "value"},
+	}}.Marshal()
+	large := ArrayValue{Val: []Value{
+		BulkStringValue{Val: "SET"},
+		BulkStringValue{Val: "key"},
+		BulkStringValue{Val: string(bytes.Repeat([]byte("x"), 1024*1024))},
+	}}.Marshal()
+	lyingLength := append([]byte("*1\r\n$500000000\r\n"), bytes.Repeat([]byte("x"), 1024)...)
+
+	for _, bench := range []struct {
+		name  string
+		input []byte
+	}{
+		{"set", set},
+		{"inline", []byte("SET key value\r\n")},
+		{"large", large},
+		{"lying-length", lyingLength},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bench.input)))
+
+			input := bytes.NewReader(bench.input)
+			reader := NewReader(input)
+
+			for i := 0; i < b.N; i++ {
+				input.Reset(bench.input)
+				reader.reader.Reset(input)
+
+				argv, err := reader.ReadCommand()
+				if err != nil && err != io.ErrUnexpectedEOF {
+					b.Fatal(err)
+				}
+				commandArgs(argv)
+			}
+		})
+	}
+}
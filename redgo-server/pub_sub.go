@@ -11,6 +11,16 @@ type Client struct {
 	Subscriptions map[string]*PubSubChannel
 	Reader        *Reader
 	Writer        *Writer
+	// Name is set with HELLO SETNAME.
+	Name string
+	// Authenticated is set once the client gave the requirepass password.
+	Authenticated bool
+	// Blocked is set while the client waits in a blocking command such as BLPOP.
+	Blocked *BlockState
+	// Multi is set between MULTI and EXEC or DISCARD.
+	Multi *MultiState
+	// Watched maps the keys the client watches to their version when watched.
+	Watched map[string]uint64
 }
 
 type PubSubChannelClient struct {
@@ -115,7 +125,7 @@ func subscribe(args []Value, client *Client) Value {
 		commandResponse[1] = BulkStringValue{Val: channel}
 		commandResponse[2] = IntegerValue{Val: len(client.Subscriptions)}
 
-		client.Writer.WriteAsRespString(ArrayValue{Val: commandResponse})
+		client.Writer.WriteAsRespString(PushValue{Val: commandResponse})
 	}
 
 	return EmptyValue{}
@@ -138,9 +148,16 @@ func unsubscribe(args []Value, client *Client) Value {
 				delete(PubSubChannels, channel)
 			}
 		}
+
+		commandResponse := make([]Value, 3)
+		commandResponse[0] = BulkStringValue{Val: "unsubscribe"}
+		commandResponse[1] = BulkStringValue{Val: channel}
+		commandResponse[2] = IntegerValue{Val: len(client.Subscriptions)}
+
+		client.Writer.WriteAsRespString(PushValue{Val: commandResponse})
 	}
 
-	return StringValue{Val: "OK"}
+	return EmptyValue{}
 }
 
 func publish(args []Value, _ *Client) Value {
@@ -170,7 +187,10 @@ func publish(args []Value, _ *Client) Value {
 		subscriberResponse[1] = BulkStringValue{Val: channel}
 		subscriberResponse[2] = BulkStringValue{Val: message}
 
-		client.Writer.WriteAsRespString(ArrayValue{Val: subscriberResponse})
+		// The subscriber may be idle waiting for input, so its buffer isn't
+		// flushed by its own connection.
+		client.Writer.WriteAsRespString(PushValue{Val: subscriberResponse})
+		client.Writer.Flush()
 		head = head.Next
 		len++
 	}
@@ -0,0 +1,344 @@
+package main
+
+// Maximum number of entries stored in a single quicklist node.
+const quicklistNodeSize = 128
+
+type quicklistNode struct {
+	entries []string
+	prev    *quicklistNode
+	next    *quicklistNode
+}
+
+// Quicklist is a doubly linked list of small slices, the structure backing the
+// list type. Pushing and popping at either end only touches the head or tail
+// node, while the chunking keeps the per-entry overhead of the links low.
+type Quicklist struct {
+	head  *quicklistNode
+	tail  *quicklistNode
+	count int
+}
+
+func NewQuicklist() *Quicklist {
+	return &Quicklist{}
+}
+
+func (ql *Quicklist) Len() int {
+	return ql.count
+}
+
+func (ql *Quicklist) PushHead(value string) {
+	if ql.head == nil || len(ql.head.entries) >= quicklistNodeSize {
+		ql.insertNodeBefore(ql.head, &quicklistNode{entries: make([]string, 0, 8)})
+	}
+
+	// The node is bounded by quicklistNodeSize, so shifting it stays cheap.
+	ql.head.entries = append(ql.head.entries, "")
+	copy(ql.head.entries[1:], ql.head.entries)
+	ql.head.entries[0] = value
+	ql.count++
+}
+
+func (ql *Quicklist) PushTail(value string) {
+	if ql.tail == nil || len(ql.tail.entries) >= quicklistNodeSize {
+		ql.insertNodeAfter(ql.tail, &quicklistNode{entries: make([]string, 0, 8)})
+	}
+
+	ql.tail.entries = append(ql.tail.entries, value)
+	ql.count++
+}
+
+func (ql *Quicklist) PopHead() (string, bool) {
+	if ql.count == 0 {
+		return "", false
+	}
+
+	value := ql.head.entries[0]
+	ql.deleteAt(ql.head, 0)
+
+	return value, true
+}
+
+func (ql *Quicklist) PopTail() (string, bool) {
+	if ql.count == 0 {
+		return "", false
+	}
+
+	value := ql.tail.entries[len(ql.tail.entries)-1]
+	ql.deleteAt(ql.tail, len(ql.tail.entries)-1)
+
+	return value, true
+}
+
+// Index returns the entry at the given position. Negative indexes count from
+// the tail, -1 being the last entry.
+func (ql *Quicklist) Index(index int) (string, bool) {
+	node, offset := ql.locate(index)
+	if node == nil {
+		return "", false
+	}
+
+	return node.entries[offset], true
+}
+
+// Set replaces the entry at the given position, returning false if it's out of range.
+func (ql *Quicklist) Set(index int, value string) bool {
+	node, offset := ql.locate(index)
+	if node == nil {
+		return false
+	}
+
+	node.entries[offset] = value
+
+	return true
+}
+
+// Range returns the entries between start and stop inclusive. Indexes are
+// interpreted like Index and clamped to the bounds of the list.
+func (ql *Quicklist) Range(start, stop int) []string {
+	start, stop, ok := ql.normalizeRange(start, stop)
+	if !ok {
+		return []string{}
+	}
+
+	values := make([]string, 0, stop-start+1)
+
+	node, offset := ql.locate(start)
+	for node != nil && len(values) < stop-start+1 {
+		values = append(values, node.entries[offset])
+
+		offset++
+		if offset == len(node.entries) {
+			node, offset = node.next, 0
+		}
+	}
+
+	return values
+}
+
+// Trim keeps only the entries between start and stop inclusive.
+func (ql *Quicklist) Trim(start, stop int) {
+	start, stop, ok := ql.normalizeRange(start, stop)
+	if !ok {
+		ql.head, ql.tail, ql.count = nil, nil, 0
+		return
+	}
+
+	for i := 0; i < start; i++ {
+		ql.PopHead()
+	}
+
+	for ql.count > stop-start+1 {
+		ql.PopTail()
+	}
+}
+
+// Insert adds value right before or after the first occurrence of pivot.
+// It returns false if pivot isn't in the list.
+func (ql *Quicklist) Insert(pivot string, value string, after bool) bool {
+	for node := ql.head; node != nil; node = node.next {
+		for offset, entry := range node.entries {
+			if entry != pivot {
+				continue
+			}
+
+			if after {
+				offset++
+			}
+
+			ql.insertAt(node, offset, value)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove deletes up to count occurrences of value, starting from the head when
+// count is positive and from the tail when it's negative. A count of zero
+// removes every occurrence. It returns the number of removed entries.
+func (ql *Quicklist) Remove(count int, value string) int {
+	removed := 0
+	fromTail := count < 0
+	if fromTail {
+		count = -count
+	}
+
+	node := ql.head
+	if fromTail {
+		node = ql.tail
+	}
+
+	for node != nil && (count == 0 || removed < count) {
+		// Grab the neighbour first, as deleting the last entry unlinks the node.
+		next := node.next
+		if fromTail {
+			next = node.prev
+		}
+
+		if fromTail {
+			for offset := len(node.entries) - 1; offset >= 0 && (count == 0 || removed < count); offset-- {
+				if node.entries[offset] == value {
+					ql.deleteAt(node, offset)
+					removed++
+				}
+			}
+		} else {
+			for offset := 0; offset < len(node.entries) && (count == 0 || removed < count); {
+				if node.entries[offset] == value {
+					ql.deleteAt(node, offset)
+					removed++
+					continue
+				}
+				offset++
+			}
+		}
+
+		node = next
+	}
+
+	return removed
+}
+
+// Each calls fn for every entry from head to tail until fn returns false.
+func (ql *Quicklist) Each(fn func(index int, value string) bool) {
+	index := 0
+	for node := ql.head; node != nil; node = node.next {
+		for _, entry := range node.entries {
+			if !fn(index, entry) {
+				return
+			}
+			index++
+		}
+	}
+}
+
+// normalizeRange turns possibly negative start and stop indexes into absolute
+// ones clamped to the list bounds. It returns false if the range is empty.
+func (ql *Quicklist) normalizeRange(start, stop int) (int, int, bool) {
+	if start < 0 {
+		start += ql.count
+	}
+	if stop < 0 {
+		stop += ql.count
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= ql.count {
+		stop = ql.count - 1
+	}
+
+	if start > stop || start >= ql.count {
+		return 0, 0, false
+	}
+
+	return start, stop, true
+}
+
+// locate finds the node and the offset within it of the entry at index,
+// walking from whichever end of the list is closer.
+func (ql *Quicklist) locate(index int) (*quicklistNode, int) {
+	if index < 0 {
+		index += ql.count
+	}
+
+	if index < 0 || index >= ql.count {
+		return nil, 0
+	}
+
+	if index < ql.count/2 {
+		for node := ql.head; node != nil; node = node.next {
+			if index < len(node.entries) {
+				return node, index
+			}
+			index -= len(node.entries)
+		}
+	} else {
+		index = ql.count - 1 - index
+		for node := ql.tail; node != nil; node = node.prev {
+			if index < len(node.entries) {
+				return node, len(node.entries) - 1 - index
+			}
+			index -= len(node.entries)
+		}
+	}
+
+	return nil, 0
+}
+
+func (ql *Quicklist) insertAt(node *quicklistNode, offset int, value string) {
+	if len(node.entries) >= quicklistNodeSize {
+		// Split the full node in two halves and insert into the right one.
+		half := len(node.entries) / 2
+		split := &quicklistNode{entries: append(make([]string, 0, quicklistNodeSize), node.entries[half:]...)}
+		node.entries = node.entries[:half:half]
+		ql.insertNodeAfter(node, split)
+
+		if offset > half {
+			node, offset = split, offset-half
+		}
+	}
+
+	node.entries = append(node.entries, "")
+	copy(node.entries[offset+1:], node.entries[offset:])
+	node.entries[offset] = value
+	ql.count++
+}
+
+func (ql *Quicklist) deleteAt(node *quicklistNode, offset int) {
+	node.entries = append(node.entries[:offset], node.entries[offset+1:]...)
+	ql.count--
+
+	if len(node.entries) == 0 {
+		ql.unlinkNode(node)
+	}
+}
+
+func (ql *Quicklist) insertNodeBefore(old *quicklistNode, node *quicklistNode) {
+	node.next = old
+
+	if old == nil {
+		ql.head, ql.tail = node, node
+		return
+	}
+
+	node.prev = old.prev
+	if old.prev != nil {
+		old.prev.next = node
+	} else {
+		ql.head = node
+	}
+	old.prev = node
+}
+
+func (ql *Quicklist) insertNodeAfter(old *quicklistNode, node *quicklistNode) {
+	node.prev = old
+
+	if old == nil {
+		ql.head, ql.tail = node, node
+		return
+	}
+
+	node.next = old.next
+	if old.next != nil {
+		old.next.prev = node
+	} else {
+		ql.tail = node
+	}
+	old.next = node
+}
+
+func (ql *Quicklist) unlinkNode(node *quicklistNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		ql.head = node.next
+	}
+
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		ql.tail = node.prev
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// checkQuicklist fails the test unless the list holds want, its nodes are
+// linked both ways, and none of them is empty or holds more than
+// quicklistNodeSize entries.
+func checkQuicklist(t *testing.T, ql *Quicklist, want []string) {
+	t.Helper()
+
+	if got := ql.Range(0, -1); !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if ql.Len() != len(want) {
+		t.Fatalf("got length %d, want %d", ql.Len(), len(want))
+	}
+
+	count := 0
+	var prev *quicklistNode
+	for node := ql.head; node != nil; prev, node = node, node.next {
+		if node.prev != prev {
+			t.Fatal("a node isn't linked back to the one before it")
+		}
+
+		if len(node.entries) == 0 || len(node.entries) > quicklistNodeSize {
+			t.Fatalf("a node holds %d entries", len(node.entries))
+		}
+
+		count += len(node.entries)
+	}
+
+	if ql.tail != prev {
+		t.Fatal("the tail isn't the last node")
+	}
+
+	if count != len(want) {
+		t.Fatalf("the nodes hold %d entries, want %d", count, len(want))
+	}
+}
+
+// TestQuicklistSplit checks that inserting into a full node splits it, at
+// either side of the middle.
+func TestQuicklistSplit(t *testing.T) {
+	for _, offset := range []int{0, quicklistNodeSize / 2, quicklistNodeSize/2 + 1, quicklistNodeSize} {
+		t.Run(strconv.Itoa(offset), func(t *testing.T) {
+			ql := NewQuicklist()
+			var want []string
+			for i := 0; i < quicklistNodeSize; i++ {
+				ql.PushTail(strconv.Itoa(i))
+				want = append(want, strconv.Itoa(i))
+			}
+
+			if ql.head != ql.tail {
+				t.Fatal("a full list should fit in a single node")
+			}
+
+			after := offset == quicklistNodeSize
+			pivot := want[min(offset, quicklistNodeSize-1)]
+			ql.Insert(pivot, "new", after)
+			want = slices.Insert(want, offset, "new")
+
+			checkQuicklist(t, ql, want)
+
+			if ql.head == ql.tail {
+				t.Fatal("inserting into a full node should split it")
+			}
+		})
+	}
+}
+
+// TestQuicklistOperations runs random operations against a quicklist and a
+// slice, which must always hold the same entries.
+func TestQuicklistOperations(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	ql := NewQuicklist()
+	var want []string
+
+	for i := 0; i < 20000; i++ {
+		value := strconv.Itoa(random.Intn(50))
+		index := 0
+		if len(want) > 0 {
+			index = random.Intn(len(want))
+		}
+
+		switch op := random.Intn(10); {
+		case op < 3:
+			ql.PushHead(value)
+			want = slices.Insert(want, 0, value)
+		case op < 6:
+			ql.PushTail(value)
+			want = append(want, value)
+		case op == 6 && len(want) > 0:
+			pivot := want[index]
+			ql.Insert(pivot, value, index%2 == 0)
+			at := slices.Index(want, pivot)
+			if index%2 == 0 {
+				at++
+			}
+			want = slices.Insert(want, at, value)
+		case op == 7:
+			count := random.Intn(5) - 2
+			removed := ql.Remove(count, value)
+
+			n := 0
+			if count < 0 {
+				for j := len(want) - 1; j >= 0 && n < -count; j-- {
+					if want[j] == value {
+						want = slices.Delete(want, j, j+1)
+						n++
+					}
+				}
+			} else {
+				for j := 0; j < len(want) && (count == 0 || n < count); {
+					if want[j] == value {
+						want = slices.Delete(want, j, j+1)
+						n++
+						continue
+					}
+					j++
+				}
+			}
+
+			if removed != n {
+				t.Fatalf("removed %d entries, want %d", removed, n)
+			}
+		case op == 8 && len(want) > 0:
+			if random.Intn(2) == 0 {
+				got, _ := ql.PopHead()
+				if got != want[0] {
+					t.Fatalf("popped %q from the head, want %q", got, want[0])
+				}
+				want = want[1:]
+			} else {
+				got, _ := ql.PopTail()
+				if got != want[len(want)-1] {
+					t.Fatalf("popped %q from the tail, want %q", got, want[len(want)-1])
+				}
+				want = want[:len(want)-1]
+			}
+		case op == 9 && len(want) > 0:
+			ql.Set(index-len(want), value)
+			want[index] = value
+		}
+
+		checkQuicklist(t, ql, want)
+	}
+}
+
+// TestQuicklistTrim checks that trimming drops the nodes left empty.
+func TestQuicklistTrim(t *testing.T) {
+	ql := NewQuicklist()
+	var want []string
+	for i := 0; i < 5*quicklistNodeSize; i++ {
+		ql.PushTail(strconv.Itoa(i))
+		want = append(want, strconv.Itoa(i))
+	}
+
+	ql.Trim(quicklistNodeSize+1, -quicklistNodeSize-2)
+	checkQuicklist(t, ql, want[quicklistNodeSize+1:len(want)-quicklistNodeSize-1])
+
+	ql.Trim(5, 1)
+	checkQuicklist(t, ql, nil)
+
+	ql.PushHead("a")
+	checkQuicklist(t, ql, []string{"a"})
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot starts with "REDGO" and the format version as four digits, then
+// holds one record per function library and key. A key's record is its value
+// type, its name and its value, preceded by RDB_OPCODE_EXPIRETIME_MS if it has
+// an expiration. The file ends with RDB_OPCODE_EOF and the CRC-64 of all that
+// comes before it. Lengths and integers are varints, floats 8 bytes.
+const (
+	rdbMagic    = "REDGO"
+	RDB_VERSION = 1
+)
+
+const (
+	RDB_TYPE_STRING = iota
+	RDB_TYPE_LIST
+	RDB_TYPE_SET
+	RDB_TYPE_ZSET
+	RDB_TYPE_HASH
+	RDB_TYPE_STREAM
+)
+
+const (
+	RDB_OPCODE_FUNCTION      = 0xF5
+	RDB_OPCODE_EXPIRETIME_MS = 0xFC
+	RDB_OPCODE_EOF           = 0xFF
+)
+
+var rdbCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// After a failed background save, save points wait this long before trying again.
+const rdbRetryDelay = 5 * time.Second
+
+// The state of the snapshots, guarded by the keyspace lock. dirty counts the
+// changes to the dataset since the last successful save.
+var (
+	dirty              int64
+	lastSave           = time.Now()
+	lastBgsaveTry      time.Time
+	lastBgsaveErr      error
+	lastBgsaveDuration time.Duration
+	bgsaveStart        time.Time
+)
+
+// bgsaveRuns is set while a background save runs. Unlike the rest it's read by
+// SHUTDOWN NOSAVE while a busy script holds the keyspace lock.
+var bgsaveRuns atomic.Bool
+
+// SavePoint is a save setting: the dataset is saved after Seconds if there
+// were at least Changes changes.
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
+type rdbEncoder struct {
+	chunkedBuffer
+	now int64
+}
+
+func (e *rdbEncoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *rdbEncoder) uvarint(n uint64) {
+	e.buf = binary.AppendUvarint(e.buf, n)
+}
+
+func (e *rdbEncoder) varint(n int64) {
+	e.buf = binary.AppendVarint(e.buf, n)
+}
+
+func (e *rdbEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *rdbEncoder) float(f float64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(f))
+}
+
+func (e *rdbEncoder) streamID(id StreamID) {
+	e.uvarint(id.ms)
+	e.uvarint(id.seq)
+}
+
+// rdbEncodeDataset returns the snapshot of the function libraries and every
+// key, leaving out what already expired. The keyspace must be locked by the
+// caller.
+func rdbEncodeDataset() []byte {
+	e := newRdbEncoder()
+
+	for key, obj := range DB.objects {
+		when, expires := DB.expires[key]
+		e.key(key, obj, when, expires)
+	}
+
+	return e.finish()
+}
+
+// newRdbEncoder starts a snapshot with its header and the function libraries.
+// Keys already expired when it's created are left out. The keyspace must be
+// locked by the caller.
+func newRdbEncoder() *rdbEncoder {
+	e := &rdbEncoder{now: nowMs()}
+	e.buf = append(e.buf, fmt.Sprintf("%s%04d", rdbMagic, RDB_VERSION)...)
+
+	for _, library := range libraries {
+		e.byte(RDB_OPCODE_FUNCTION)
+		e.string(library.Code)
+	}
+
+	return e
+}
+
+func (e *rdbEncoder) key(key string, obj *Object, when int64, expires bool) {
+	if expires {
+		if when <= e.now {
+			return
+		}
+
+		e.byte(RDB_OPCODE_EXPIRETIME_MS)
+		e.varint(when)
+	}
+
+	switch obj.Type {
+	case OBJ_STRING:
+		e.byte(RDB_TYPE_STRING)
+		e.string(key)
+		e.string(obj.Data.(string))
+	case OBJ_LIST:
+		list := obj.Data.(*Quicklist)
+		e.byte(RDB_TYPE_LIST)
+		e.string(key)
+		e.uvarint(uint64(list.Len()))
+		list.Each(func(_ int, value string) bool {
+			e.string(value)
+			return true
+		})
+	case OBJ_SET:
+		set := obj.Data.(map[string]struct{})
+		e.byte(RDB_TYPE_SET)
+		e.string(key)
+		e.uvarint(uint64(len(set)))
+		for member := range set {
+			e.string(member)
+		}
+	case OBJ_ZSET:
+		zs := obj.Data.(*SortedSet)
+		e.byte(RDB_TYPE_ZSET)
+		e.string(key)
+		e.uvarint(uint64(zs.Len()))
+		for member, score := range zs.dict {
+			e.string(member)
+			e.float(score)
+		}
+	case OBJ_HASH:
+		// Each field is followed by its expiration, 0 if it has none. Expired
+		// fields are written too, they're dropped when loading.
+		h := obj.Data.(*Hash)
+		e.byte(RDB_TYPE_HASH)
+		e.string(key)
+		e.uvarint(uint64(h.Len()))
+		for field, value := range h.fields {
+			e.string(field)
+			e.string(value)
+			fieldWhen, _ := h.GetExpire(field)
+			e.varint(fieldWhen)
+		}
+	case OBJ_STREAM:
+		e.byte(RDB_TYPE_STREAM)
+		e.string(key)
+		e.encodeStream(obj.Data.(*Stream))
+	}
+
+	e.cut()
+}
+
+// finish ends the snapshot with its checksum.
+func (e *rdbEncoder) finish() []byte {
+	data := append(e.bytes(), RDB_OPCODE_EOF)
+
+	return binary.LittleEndian.AppendUint64(data, crc64.Checksum(data, rdbCRCTable))
+}
+
+func (e *rdbEncoder) encodeStream(s *Stream) {
+	e.uvarint(uint64(len(s.entries)))
+	for _, entry := range s.entries {
+		e.streamID(entry.ID)
+		e.uvarint(uint64(len(entry.Fields)))
+		for _, field := range entry.Fields {
+			e.string(field)
+		}
+	}
+
+	e.streamID(s.lastID)
+
+	e.uvarint(uint64(len(s.groups)))
+	for name, g := range s.groups {
+		e.string(name)
+		e.streamID(g.lastID)
+
+		e.uvarint(uint64(len(g.consumers)))
+		for _, consumer := range g.consumers {
+			e.string(consumer.name)
+		}
+
+		e.uvarint(uint64(len(g.pel)))
+		for id, pe := range g.pel {
+			e.streamID(id)
+			e.string(pe.consumer.name)
+			e.varint(pe.deliveryTime)
+			e.varint(pe.deliveryCount)
+		}
+	}
+}
+
+// rdbDecoder reads a snapshot. Once it fails, err is set and every read
+// returns a zero value, so errors only need to be checked once per record.
+type rdbDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *rdbDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+}
+
+var errRdbShortRead = errors.New("unexpected end of the snapshot")
+
+func (d *rdbDecoder) byte() byte {
+	if len(d.data) == 0 {
+		d.fail(errRdbShortRead)
+		return 0
+	}
+
+	b := d.data[0]
+	d.data = d.data[1:]
+
+	return b
+}
+
+func (d *rdbDecoder) uvarint() uint64 {
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		d.fail(errRdbShortRead)
+		return 0
+	}
+	d.data = d.data[size:]
+
+	return n
+}
+
+func (d *rdbDecoder) varint() int64 {
+	n, size := binary.Varint(d.data)
+	if size <= 0 {
+		d.fail(errRdbShortRead)
+		return 0
+	}
+	d.data = d.data[size:]
+
+	return n
+}
+
+// length reads the number of elements of a collection, each of which takes at
+// least a byte, so a corrupt length can't make us allocate more than the size
+// of the snapshot.
+func (d *rdbDecoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail(errRdbShortRead)
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *rdbDecoder) string() string {
+	n := d.length()
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+
+	return s
+}
+
+func (d *rdbDecoder) float() float64 {
+	if len(d.data) < 8 {
+		d.fail(errRdbShortRead)
+		return 0
+	}
+
+	f := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+
+	return f
+}
+
+func (d *rdbDecoder) streamID() StreamID {
+	return StreamID{ms: d.uvarint(), seq: d.uvarint()}
+}
+
+// rdbDecodeDataset loads a snapshot into the keyspace, which must be locked
+// by the caller, and its function libraries. Keys and hash fields that expired
+// meanwhile are left out.
+func rdbDecodeDataset(data []byte) error {
+	return rdbDecode(data, func(library *Library) error {
+		if errValue := addLibrary(library, false); errValue != nil {
+			return errors.New(errValue.(ErrorValue).Val)
+		}
+		return nil
+	}, func(key string, obj *Object, when int64) {
+		DB.Set(key, obj)
+		if when >= 0 {
+			DB.SetExpire(key, when)
+		}
+	})
+}
+
+// rdbCheck checks that a snapshot can be loaded into an empty server, without
+// touching the keyspace or the function libraries. Its libraries are compiled
+// and dropped.
+func rdbCheck(data []byte) error {
+	libraryNames, functionNames := make(map[string]struct{}), make(map[string]struct{})
+
+	return rdbDecode(data, func(library *Library) error {
+		library.state.Close()
+
+		if _, found := libraryNames[library.Name]; found {
+			return fmt.Errorf("ERR Library '%s' already exists", library.Name)
+		}
+		libraryNames[library.Name] = struct{}{}
+
+		for name := range library.Functions {
+			if _, found := functionNames[name]; found {
+				return fmt.Errorf("ERR Function %s already exists", name)
+			}
+			functionNames[name] = struct{}{}
+		}
+
+		return nil
+	}, func(string, *Object, int64) {})
+}
+
+// rdbDecode reads a snapshot, passing each function library to useLibrary and
+// each key to useKey, with its expiration or -1. Keys and hash fields that
+// expired meanwhile are left out.
+func rdbDecode(data []byte, useLibrary func(*Library) error, useKey func(key string, obj *Object, when int64)) error {
+	header := len(rdbMagic) + 4
+	if len(data) < header+9 || string(data[:len(rdbMagic)]) != rdbMagic {
+		return errors.New("wrong signature trying to load the snapshot")
+	}
+
+	version, err := strconv.Atoi(string(data[len(rdbMagic):header]))
+	if err != nil || version < 1 || version > RDB_VERSION {
+		return fmt.Errorf("can't handle snapshot format version %q", data[len(rdbMagic):header])
+	}
+
+	body, trailer := data[:len(data)-8], data[len(data)-8:]
+	expected, got := binary.LittleEndian.Uint64(trailer), crc64.Checksum(body, rdbCRCTable)
+	if expected != got {
+		return fmt.Errorf("wrong snapshot checksum expected: (%x) got (%x)", expected, got)
+	}
+
+	d := &rdbDecoder{data: body[header:]}
+	now := nowMs()
+
+	for {
+		when := int64(-1)
+
+		typ := d.byte()
+		switch typ {
+		case RDB_OPCODE_EOF:
+			if d.err == nil && len(d.data) > 0 {
+				return errors.New("unexpected data after the end of the snapshot")
+			}
+			return d.err
+		case RDB_OPCODE_FUNCTION:
+			code := d.string()
+			if d.err != nil {
+				return d.err
+			}
+
+			library, errValue := loadLibrary(code)
+			if errValue != nil {
+				return fmt.Errorf("can't load a function library: %s", errValue.(ErrorValue).Val)
+			}
+
+			if err := useLibrary(library); err != nil {
+				return fmt.Errorf("can't load a function library: %v", err)
+			}
+
+			continue
+		case RDB_OPCODE_EXPIRETIME_MS:
+			when = d.varint()
+			typ = d.byte()
+		}
+
+		key := d.string()
+		obj := d.object(typ, now)
+		if d.err != nil {
+			return d.err
+		}
+
+		if obj == nil || (when >= 0 && when <= now) {
+			continue
+		}
+
+		useKey(key, obj, when)
+	}
+}
+
+// object reads a value of the given type. It returns nil for a hash whose
+// fields all expired.
+func (d *rdbDecoder) object(typ byte, now int64) *Object {
+	switch typ {
+	case RDB_TYPE_STRING:
+		return &Object{Type: OBJ_STRING, Data: d.string()}
+	case RDB_TYPE_LIST:
+		list := NewQuicklist()
+		for n := d.length(); n > 0; n-- {
+			list.PushTail(d.string())
+		}
+		return &Object{Type: OBJ_LIST, Data: list}
+	case RDB_TYPE_SET:
+		set := make(map[string]struct{})
+		for n := d.length(); n > 0; n-- {
+			set[d.string()] = struct{}{}
+		}
+		return &Object{Type: OBJ_SET, Data: set}
+	case RDB_TYPE_ZSET:
+		zs := NewSortedSet()
+		for n := d.length(); n > 0; n-- {
+			member := d.string()
+			zs.Add(member, d.float())
+		}
+		return &Object{Type: OBJ_ZSET, Data: zs}
+	case RDB_TYPE_HASH:
+		h := NewHash()
+		for n := d.length(); n > 0; n-- {
+			field, value, when := d.string(), d.string(), d.varint()
+			if when > 0 && when <= now {
+				continue
+			}
+
+			h.Set(field, value)
+			if when > 0 {
+				h.SetExpire(field, when)
+			}
+		}
+		if h.Len() == 0 {
+			return nil
+		}
+		return &Object{Type: OBJ_HASH, Data: h}
+	case RDB_TYPE_STREAM:
+		return &Object{Type: OBJ_STREAM, Data: d.stream()}
+	}
+
+	d.fail(fmt.Errorf("unknown value type %d in the snapshot", typ))
+
+	return nil
+}
+
+func (d *rdbDecoder) stream() *Stream {
+	s := NewStream()
+
+	for n := d.length(); n > 0; n-- {
+		id := d.streamID()
+		fields := make([]string, d.length())
+		for i := range fields {
+			fields[i] = d.string()
+		}
+		s.entries = append(s.entries, StreamEntry{ID: id, Fields: fields})
+	}
+
+	s.lastID = d.streamID()
+
+	for groups := d.length(); groups > 0; groups-- {
+		name := d.string()
+		g := NewConsumerGroup(d.streamID())
+		s.groups[name] = g
+
+		for n := d.length(); n > 0; n-- {
+			g.lookupOrCreateConsumer(d.string())
+		}
+
+		for n := d.length(); n > 0; n-- {
+			id := d.streamID()
+			consumer, _ := g.lookupOrCreateConsumer(d.string())
+			pe := &PendingEntry{consumer: consumer, deliveryTime: d.varint(), deliveryCount: d.varint()}
+			g.pel[id] = pe
+			consumer.pel[id] = pe
+		}
+	}
+
+	return s
+}
+
+// rdbPath is where the snapshot is saved and loaded from.
+func rdbPath() string {
+	config := serverConfig()
+	return filepath.Join(config.Dir, config.DBFilename)
+}
+
+// rdbTempPath is where a snapshot is written until it's complete. Background
+// saves use their own file so a SAVE on shutdown doesn't write over theirs.
+func rdbTempPath(background bool) string {
+	name := fmt.Sprintf("temp-%d.rdb", os.Getpid())
+	if background {
+		name = fmt.Sprintf("temp-bgsave-%d.rdb", os.Getpid())
+	}
+
+	return filepath.Join(serverConfig().Dir, name)
+}
+
+// writeSyncedFile writes a file, e.g. a snapshot to its temporary file, and
+// syncs it. The file is removed if that fails.
+func writeSyncedFile(temp string, data []byte) error {
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(temp)
+	}
+
+	return err
+}
+
+// renameSynced puts a complete file, e.g. a snapshot, in place of the previous one.
+func renameSynced(temp, path string) error {
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	// Make the rename itself durable.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// rdbSave saves the dataset right away. The keyspace must be locked by the caller.
+func rdbSave() error {
+	temp := rdbTempPath(false)
+
+	err := writeSyncedFile(temp, rdbEncodeDataset())
+	if err == nil {
+		err = renameSynced(temp, rdbPath())
+	}
+
+	if err != nil {
+		serverLog(LOG_WARNING, "Failed saving the DB: %v", err)
+		return err
+	}
+
+	serverLog(LOG_NOTICE, "DB saved on disk")
+
+	dirty = 0
+	lastSave = time.Now()
+
+	return nil
+}
+
+// rdbSaveBackground takes a snapshot of the dataset, which is then encoded and
+// written in the background while commands go on, see datasetSnapshot. The
+// keyspace must be locked by the caller.
+func rdbSaveBackground() error {
+	if bgsaveRuns.Load() {
+		return errors.New("Background save already in progress")
+	}
+
+	serverLog(LOG_NOTICE, "Background saving started")
+
+	snapshot := DB.startSnapshot(newRdbEncoder())
+	dirtyBefore := dirty
+
+	bgsaveRuns.Store(true)
+	bgsaveStart = time.Now()
+	lastBgsaveTry = bgsaveStart
+
+	go func() {
+		temp := rdbTempPath(true)
+		err := writeSyncedFile(temp, snapshot.encode())
+
+		// The rename is done with the keyspace locked, so it can't replace a
+		// snapshot saved by SHUTDOWN since.
+		DB.Lock()
+		defer DB.Unlock()
+
+		if err == nil {
+			err = renameSynced(temp, rdbPath())
+		}
+
+		if err != nil {
+			serverLog(LOG_WARNING, "Background saving error: %v", err)
+		} else {
+			serverLog(LOG_NOTICE, "Background saving terminated with success")
+			dirty -= dirtyBefore
+			lastSave = bgsaveStart
+		}
+
+		lastBgsaveErr = err
+		lastBgsaveDuration = time.Since(bgsaveStart)
+		bgsaveRuns.Store(false)
+	}()
+
+	return nil
+}
+
+// rdbLoad loads the snapshot into the empty keyspace, if there's one.
+func rdbLoad() error {
+	data, err := os.ReadFile(rdbPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	if err := rdbDecodeDataset(data); err != nil {
+		return err
+	}
+
+	serverLog(LOG_NOTICE, "DB loaded from disk: %.3f seconds", time.Since(start).Seconds())
+
+	return nil
+}
+
+// StartSaveScheduler saves the dataset in the background once a save point is
+// reached.
+func StartSaveScheduler() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			DB.Lock()
+			rdbSaveIfNeeded()
+			DB.Unlock()
+		}
+	}()
+}
+
+func rdbSaveIfNeeded() {
+	if bgsaveRuns.Load() || (lastBgsaveErr != nil && time.Since(lastBgsaveTry) < rdbRetryDelay) {
+		return
+	}
+
+	for _, point := range serverConfig().Save {
+		if dirty >= point.Changes && time.Since(lastSave) >= time.Duration(point.Seconds)*time.Second {
+			serverLog(LOG_NOTICE, "%d changes in %d seconds. Saving...", point.Changes, point.Seconds)
+			rdbSaveBackground()
+			return
+		}
+	}
+}
+
+// rdbInfo returns the snapshot fields of the persistence section of INFO.
+func rdbInfo() []string {
+	status := "ok"
+	if lastBgsaveErr != nil {
+		status = "err"
+	}
+
+	inProgress, currentTime := 0, -1
+	if bgsaveRuns.Load() {
+		inProgress, currentTime = 1, int(time.Since(bgsaveStart).Seconds())
+	}
+
+	lastTime := -1
+	if !lastBgsaveTry.IsZero() && !bgsaveRuns.Load() {
+		lastTime = int(lastBgsaveDuration.Seconds())
+	}
+
+	return []string{
+		"rdb_changes_since_last_save:" + strconv.FormatInt(dirty, 10),
+		"rdb_bgsave_in_progress:" + strconv.Itoa(inProgress),
+		"rdb_last_save_time:" + strconv.FormatInt(lastSave.Unix(), 10),
+		"rdb_last_bgsave_status:" + status,
+		"rdb_last_bgsave_time_sec:" + strconv.Itoa(lastTime),
+		"rdb_current_bgsave_time_sec:" + strconv.Itoa(currentTime),
+	}
+}
+
+func save(_ []Value, _ *Client) Value {
+	if bgsaveRuns.Load() {
+		return ErrorValue{Val: "ERR Background save already in progress"}
+	}
+
+	if err := rdbSave(); err != nil {
+		return ErrorValue{Val: "ERR " + err.Error()}
+	}
+
+	return StringValue{Val: "OK"}
+}
+
+// bgsave accepts SCHEDULE for compatibility: a background save can always
+// start right away.
+func bgsave(args []Value, _ *Client) Value {
+	if len(args) > 1 || (len(args) == 1 && !strings.EqualFold(args[0].(BulkStringValue).Val, "SCHEDULE")) {
+		return SyntaxError
+	}
+
+	if err := rdbSaveBackground(); err != nil {
+		return ErrorValue{Val: "ERR " + err.Error()}
+	}
+
+	return StringValue{Val: "Background saving started"}
+}
+
+func lastsave(_ []Value, _ *Client) Value {
+	return IntegerValue{Val: int(lastSave.Unix())}
+}
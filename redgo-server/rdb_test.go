@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestRdbRoundTrip checks that a snapshot holding every type loads back, as on
+// startup, into the same dataset, expirations included.
+func TestRdbRoundTrip(t *testing.T) {
+	useTempDir(t)
+
+	addr := startTestServer(t)
+	client := dialTestClient(t, addr)
+
+	keys := []string{"test:rdb:string", "test:rdb:hash", "test:rdb:list", "test:rdb:set", "test:rdb:zset", "test:rdb:stream"}
+	t.Cleanup(func() {
+		client.send(append([]string{"DEL"}, keys...)...)
+		client.reply()
+		client.do("+OK\r\n", "FUNCTION", "FLUSH")
+	})
+
+	when := strconv.FormatInt(nowMs()+1_000_000, 10)
+	fieldWhen := strconv.FormatInt(nowMs()+2_000_000, 10)
+
+	for _, command := range []string{
+		"SET test:rdb:string value",
+		"PEXPIREAT test:rdb:string " + when,
+		"HSET test:rdb:hash a 1 b 2 c 3",
+		"HPEXPIREAT test:rdb:hash " + fieldWhen + " FIELDS 2 a b",
+		"RPUSH test:rdb:list a b c",
+		"SADD test:rdb:set a b c",
+		"ZADD test:rdb:zset 1 a 2.5 b -inf c",
+		"XADD test:rdb:stream 1-1 f v",
+		"XADD test:rdb:stream 2-1 g w",
+		"XADD test:rdb:stream 3-1 h x",
+		"XDEL test:rdb:stream 3-1",
+		"XGROUP CREATE test:rdb:stream group 0",
+		"XGROUP CREATE test:rdb:stream other $",
+		"XREADGROUP GROUP group consumer COUNT 1 STREAMS test:rdb:stream >",
+		"XGROUP CREATECONSUMER test:rdb:stream group idle",
+	} {
+		client.send(strings.Fields(command)...)
+		if reply, isError := client.reply().(ErrorValue); isError {
+			t.Fatalf("%s failed: %s", command, reply.Val)
+		}
+	}
+
+	client.do("$7\r\ntestrdb\r\n", "FUNCTION", "LOAD", "#!lua name=testrdb\nredis.register_function('test_rdb', function() return 'loaded' end)")
+
+	reads := []string{
+		"GET test:rdb:string",
+		"HMGET test:rdb:hash a b c",
+		"HLEN test:rdb:hash",
+		"LRANGE test:rdb:list 0 -1",
+		"SMISMEMBER test:rdb:set a b c d",
+		"ZRANGE test:rdb:zset 0 -1 WITHSCORES",
+		"XRANGE test:rdb:stream - +",
+		"XPENDING test:rdb:stream group",
+		"XPENDING test:rdb:stream other",
+	}
+
+	replies := func() []Value {
+		values := make([]Value, len(reads))
+		for i, read := range reads {
+			client.send(strings.Fields(read)...)
+			values[i] = client.reply()
+		}
+		return values
+	}
+
+	expected := replies()
+
+	client.do("+OK\r\n", "SAVE")
+
+	// Start from an empty server, as the snapshot is loaded on startup.
+	client.send(append([]string{"DEL"}, keys...)...)
+	client.reply()
+	client.do("+OK\r\n", "FUNCTION", "FLUSH")
+
+	if err := rdbLoad(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := replies(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	client.do("$6\r\nloaded\r\n", "FCALL", "test_rdb", "0")
+
+	// The group resumes after the entry it last delivered, the consumer without
+	// pending entries is kept, and so is the last ID of the stream, whose entry
+	// was deleted.
+	client.do("*1\r\n*2\r\n$15\r\ntest:rdb:stream\r\n*1\r\n*2\r\n$3\r\n2-1\r\n*2\r\n$1\r\ng\r\n$1\r\nw\r\n",
+		"XREADGROUP", "GROUP", "group", "consumer", "COUNT", "1", "STREAMS", "test:rdb:stream", ">")
+	client.do(":0\r\n", "XGROUP", "CREATECONSUMER", "test:rdb:stream", "group", "idle")
+	client.do("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n", "XADD", "test:rdb:stream", "3-1", "h", "x")
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	if got, _ := DB.GetExpire("test:rdb:string"); strconv.FormatInt(got, 10) != when {
+		t.Fatalf("expected the key to expire at %s, got %d", when, got)
+	}
+
+	hash := DB.objects["test:rdb:hash"].Data.(*Hash)
+	for field, expected := range map[string]string{"a": fieldWhen, "b": fieldWhen, "c": ""} {
+		got, found := hash.GetExpire(field)
+		if (expected == "" && found) || (expected != "" && strconv.FormatInt(got, 10) != expected) {
+			t.Fatalf("expected field %s to expire at %q, got %d", field, expected, got)
+		}
+	}
+
+	if _, found := DB.hashFieldExpires["test:rdb:hash"]; !found {
+		t.Fatal("the hash should be tracked by the active expire cycle")
+	}
+}
+
+// TestRdbCorruption checks that a snapshot with the wrong signature, version
+// or checksum is refused.
+func TestRdbCorruption(t *testing.T) {
+	useTempDir(t)
+
+	e := newRdbEncoder()
+	e.key("test:rdb:corrupted", &Object{Type: OBJ_STRING, Data: "value"}, 0, false)
+	data := e.finish()
+
+	if err := rdbCheck(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// withChecksum returns the snapshot with the trailer matching its body.
+	withChecksum := func(data []byte) []byte {
+		body := data[:len(data)-8]
+		return binary.LittleEndian.AppendUint64(append([]byte{}, body...), crc64.Checksum(body, rdbCRCTable))
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-12] ^= 1
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"body changed", flipped, "wrong snapshot checksum"},
+		{"trailer changed", append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^1), "wrong snapshot checksum"},
+		{"truncated", data[:len(data)-3], "wrong snapshot checksum"},
+		{"newer version", withChecksum([]byte("REDGO0002" + string(data[9:]))), `can't handle snapshot format version "0002"`},
+		{"version not a number", withChecksum([]byte("REDGOabcd" + string(data[9:]))), `can't handle snapshot format version "abcd"`},
+		{"wrong signature", withChecksum([]byte("REDIS0001" + string(data[9:]))), "wrong signature"},
+		{"too short", []byte("REDGO0001"), "wrong signature"},
+	}
+
+	for _, test := range tests {
+		if err := rdbCheck(test.data); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.wantErr, err)
+		}
+	}
+
+	// A corrupted snapshot isn't loaded on startup, and loads none of its keys.
+	if err := os.WriteFile(rdbPath(), flipped, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rdbLoad(); err == nil {
+		t.Fatal("the corrupted snapshot should have been refused")
+	}
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	if _, found := DB.objects["test:rdb:corrupted"]; found {
+		t.Fatal("the keys of the corrupted snapshot shouldn't be loaded")
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// scripts caches the compiled scripts by the SHA1 of their body. It's guarded by
+// the keyspace lock.
+var scripts = make(map[string]*lua.FunctionProto)
+
+// RunningScript describes the script being executed. Scripts run with the
+// keyspace locked, so it's guarded by its own mutex for other clients to see
+// it and kill it.
+type RunningScript struct {
+	start  time.Time
+	cancel context.CancelFunc
+	// wrote is set once the script runs a write command, after which it can't
+	// be killed.
+	wrote    bool
+	killed   bool
+	readOnly bool
+}
+
+var (
+	runningScriptMutex sync.Mutex
+	runningScript      *RunningScript
+)
+
+var (
+	NoScriptError = ErrorValue{Val: "NOSCRIPT No matching script. Please use EVAL."}
+	BusyError     = ErrorValue{Val: "BUSY redgo is busy running a script. You can only call SCRIPT KILL."}
+)
+
+// Commands that make no sense in a script, or that need a real client.
+var scriptDeniedCommands = map[string]bool{
+	"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
+	"SUBSCRIBE": true, "UNSUBSCRIBE": true, "HELLO": true, "AUTH": true, "CONFIG": true,
+	"SHUTDOWN": true, "BGREWRITEAOF": true, "SAVE": true, "BGSAVE": true,
+	"EVAL": true, "EVALSHA": true, "SCRIPT": true, "FCALL": true, "FCALL_RO": true, "FUNCTION": true,
+}
+
+// EVAL and EVALSHA run other commands through the command table, so they can't
+// be part of the table's initializer.
+func init() {
+	Handlers["EVAL"] = Command{Handler: evalCommand, Arity: -3, GetKeys: evalKeys}
+	Handlers["EVALSHA"] = Command{Handler: evalsha, Arity: -3, GetKeys: evalKeys}
+}
+
+func scriptSHA1(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadScript compiles the script and adds it to the cache, returning its SHA1.
+func loadScript(body string) (string, Value) {
+	sha := scriptSHA1(body)
+	if _, found := scripts[sha]; found {
+		return sha, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(body), "user_script")
+	if err != nil {
+		return "", ErrorValue{Val: "ERR Error compiling script (new function): " + firstLine(err.Error())}
+	}
+
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return "", ErrorValue{Val: "ERR Error compiling script (new function): " + firstLine(err.Error())}
+	}
+
+	scripts[sha] = proto
+
+	return sha, nil
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+
+	return s
+}
+
+// scriptBusyReply answers the commands sent while a script runs past the time
+// limit, which would otherwise wait for the keyspace lock. Only SCRIPT KILL,
+// FUNCTION KILL and SHUTDOWN NOSAVE are served. It returns false once the
+// command can wait for its turn.
+func scriptBusyReply(command string, args []Value) (Value, bool) {
+	runningScriptMutex.Lock()
+	defer runningScriptMutex.Unlock()
+
+	if runningScript == nil || time.Since(runningScript.start) < serverConfig().LuaTimeLimit {
+		return nil, false
+	}
+
+	if (command == "SCRIPT" || command == "FUNCTION") && len(args) == 1 && strings.ToUpper(args[0].(BulkStringValue).Val) == "KILL" {
+		return killScript(), true
+	}
+
+	if command == "SHUTDOWN" {
+		if flags, errValue := parseShutdownFlags(args); errValue == nil && flags.noSave {
+			return shutdown(args, nil), true
+		}
+	}
+
+	return BusyError, true
+}
+
+// killScript stops the running script. The caller must hold runningScriptMutex.
+func killScript() Value {
+	if runningScript == nil {
+		return ErrorValue{Val: "NOTBUSY No scripts in execution right now."}
+	}
+
+	if runningScript.wrote {
+		return ErrorValue{Val: "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way."}
+	}
+
+	runningScript.killed = true
+	runningScript.cancel()
+
+	return StringValue{Val: "OK"}
+}
+
+func evalCommand(args []Value, client *Client) Value {
+	sha, errValue := loadScript(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	return evalGeneric(sha, args[1:], client)
+}
+
+func evalsha(args []Value, client *Client) Value {
+	return evalGeneric(strings.ToLower(args[0].(BulkStringValue).Val), args[1:], client)
+}
+
+func evalKeys(argv []Value) []string {
+	return keysAfterNumkeys(argv, 2)
+}
+
+// evalGeneric runs a cached script given numkeys followed by the keys and the
+// arguments.
+func evalGeneric(sha string, args []Value, client *Client) Value {
+	proto, found := scripts[sha]
+	if !found {
+		return NoScriptError
+	}
+
+	numkeys, err := strconv.Atoi(args[0].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	if numkeys < 0 {
+		return ErrorValue{Val: "ERR Number of keys can't be negative"}
+	}
+
+	if numkeys > len(args)-1 {
+		return ErrorValue{Val: "ERR Number of keys can't be greater than number of args"}
+	}
+
+	L := newScriptState()
+	defer L.Close()
+
+	L.SetGlobal("KEYS", stringsToLuaTable(L, args[1:1+numkeys]))
+	L.SetGlobal("ARGV", stringsToLuaTable(L, args[1+numkeys:]))
+
+	return runScript(L, L.NewFunctionFromProto(proto), nil, client, false)
+}
+
+// runScript calls fn with the given arguments and converts what it returns to
+// a reply. The writes the script makes are propagated instead of the script
+// itself, wrapped in MULTI/EXEC so they replay atomically. A read-only script
+// is denied write commands.
+func runScript(L *lua.LState, fn lua.LValue, args []lua.LValue, client *Client, readOnly bool) Value {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	running := &RunningScript{start: time.Now(), cancel: cancel, readOnly: readOnly}
+
+	runningScriptMutex.Lock()
+	runningScript = running
+	runningScriptMutex.Unlock()
+
+	// Inside EXEC the transaction already wraps what the script propagates.
+	wrap := client == nil || client.Multi == nil
+	if wrap {
+		alsoPropagate(BulkStringValue{Val: "MULTI"})
+	}
+	propagated := len(pendingPropagation)
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	err := L.PCall(len(args), 1, nil)
+
+	runningScriptMutex.Lock()
+	runningScript = nil
+	runningScriptMutex.Unlock()
+
+	if wrap {
+		if len(pendingPropagation) == propagated {
+			pendingPropagation = pendingPropagation[:propagated-1]
+		} else {
+			alsoPropagate(BulkStringValue{Val: "EXEC"})
+		}
+	}
+
+	if running.killed {
+		return ErrorValue{Val: "ERR Script killed by user with SCRIPT KILL..."}
+	}
+
+	if err != nil {
+		return scriptErrorValue(err)
+	}
+
+	reply := luaToValue(L.Get(-1))
+	L.Pop(1)
+
+	return reply
+}
+
+// scriptErrorValue turns an error raised by a script into a reply. Errors
+// raised by redis.call are replied as they are.
+func scriptErrorValue(err error) Value {
+	msg, fromCall := luaErrorMessage(err)
+	if fromCall {
+		return ErrorValue{Val: msg}
+	}
+
+	return ErrorValue{Val: "ERR Error running script: " + msg}
+}
+
+// luaErrorMessage returns the message of an error raised by a script, and
+// whether it was raised by redis.call, which raises a table with an err field.
+func luaErrorMessage(err error) (string, bool) {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		if table, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := table.RawGetString("err").(lua.LString); ok {
+				return string(msg), true
+			}
+		}
+
+		return apiErr.Object.String(), false
+	}
+
+	return firstLine(err.Error()), false
+}
+
+// newScriptState creates a sandboxed interpreter with the redis library. Scripts
+// get a fresh one each time so they can't leak globals into each other.
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// Scripts only get to the outside world through redis.call.
+	for _, name := range []string{"dofile", "loadfile", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":         scriptCall,
+		"pcall":        scriptPcall,
+		"error_reply":  scriptErrorReply,
+		"status_reply": scriptStatusReply,
+		"sha1hex":      scriptSha1hex,
+	})
+	L.SetGlobal("redis", redis)
+
+	return L
+}
+
+func stringsToLuaTable(L *lua.LState, args []Value) *lua.LTable {
+	table := L.CreateTable(len(args), 0)
+	for _, arg := range args {
+		table.Append(lua.LString(arg.(BulkStringValue).Val))
+	}
+
+	return table
+}
+
+// scriptCall implements redis.call, which raises command errors as a Lua error.
+func scriptCall(L *lua.LState) int {
+	reply := runScriptCommand(L)
+
+	if errValue, ok := reply.(ErrorValue); ok {
+		L.Error(errorTable(L, errValue.Val), 1)
+		return 0
+	}
+
+	L.Push(valueToLua(L, reply))
+
+	return 1
+}
+
+// scriptPcall implements redis.pcall, which returns command errors as an
+// error table instead.
+func scriptPcall(L *lua.LState) int {
+	L.Push(valueToLua(L, runScriptCommand(L)))
+
+	return 1
+}
+
+// runScriptCommand runs the command given as arguments to redis.call. Scripts
+// run commands without a client, so blocking commands don't block.
+func runScriptCommand(L *lua.LState) Value {
+	if L.GetTop() == 0 {
+		return ErrorValue{Val: "ERR Please specify at least one argument for this redis lib call"}
+	}
+
+	argv := make([]Value, L.GetTop())
+	for i := range argv {
+		switch arg := L.Get(i + 1).(type) {
+		case lua.LString:
+			argv[i] = BulkStringValue{Val: string(arg)}
+		case lua.LNumber:
+			argv[i] = BulkStringValue{Val: arg.String()}
+		default:
+			return ErrorValue{Val: "ERR Lua redis lib command arguments must be strings or integers"}
+		}
+	}
+
+	command := strings.ToUpper(argv[0].(BulkStringValue).Val)
+
+	cmd, found := Handlers[command]
+	if !found {
+		return ErrorValue{Val: "ERR Unknown Redis command called from script"}
+	}
+
+	if !cmd.checkArity(len(argv)) {
+		return ErrorValue{Val: "ERR Wrong number of args calling Redis command from script"}
+	}
+
+	if scriptDeniedCommands[command] {
+		return ErrorValue{Val: "ERR This Redis command is not allowed from script"}
+	}
+
+	if errValue := markScriptCommand(command); errValue != nil {
+		return errValue
+	}
+
+	command, args := absoluteExpiryCommand(command, argv[1:])
+
+	// Scripts always get RESP2 replies, whatever the protocol of the caller.
+	return toResp2(propagateCall(command, args, nil))
+}
+
+// markScriptCommand checks that the running script may run the command and
+// records whether it wrote to the dataset.
+func markScriptCommand(command string) Value {
+	runningScriptMutex.Lock()
+	defer runningScriptMutex.Unlock()
+
+	// Libraries can't run commands while being loaded.
+	if runningScript == nil {
+		return ErrorValue{Val: "ERR redis.call can only be called inside a script invocation"}
+	}
+
+	if Handlers[command].Write {
+		if runningScript.readOnly {
+			return ErrorValue{Val: "ERR Write commands are not allowed from read-only scripts."}
+		}
+
+		runningScript.wrote = true
+	}
+
+	return nil
+}
+
+func errorTable(L *lua.LState, msg string) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("err", lua.LString(msg))
+
+	return table
+}
+
+func scriptErrorReply(L *lua.LState) int {
+	L.Push(errorTable(L, L.CheckString(1)))
+
+	return 1
+}
+
+func scriptStatusReply(L *lua.LState) int {
+	table := L.NewTable()
+	table.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(table)
+
+	return 1
+}
+
+func scriptSha1hex(L *lua.LState) int {
+	L.Push(lua.LString(scriptSHA1(L.CheckString(1))))
+
+	return 1
+}
+
+// valueToLua converts a reply to Lua the way Redis does: nulls become false,
+// and status and error replies tables with an ok or err field.
+func valueToLua(L *lua.LState, value Value) lua.LValue {
+	switch v := value.(type) {
+	case IntegerValue:
+		return lua.LNumber(v.Val)
+	case BulkStringValue:
+		return lua.LString(v.Val)
+	case StringValue:
+		table := L.NewTable()
+		table.RawSetString("ok", lua.LString(v.Val))
+		return table
+	case ErrorValue:
+		return errorTable(L, v.Val)
+	case ArrayValue:
+		table := L.CreateTable(len(v.Val), 0)
+		for _, element := range v.Val {
+			table.Append(valueToLua(L, element))
+		}
+		return table
+	default:
+		return lua.LFalse
+	}
+}
+
+// luaToValue converts the value returned by a script to a reply. Numbers are
+// truncated to integers and arrays stop at the first nil, as in Redis.
+func luaToValue(lv lua.LValue) Value {
+	switch v := lv.(type) {
+	case lua.LNumber:
+		return IntegerValue{Val: int(math.Trunc(float64(v)))}
+	case lua.LString:
+		return BulkStringValue{Val: string(v)}
+	case lua.LBool:
+		if v {
+			return IntegerValue{Val: 1}
+		}
+		return NullValue{}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return ErrorValue{Val: string(msg)}
+		}
+
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return StringValue{Val: string(msg)}
+		}
+
+		array := []Value{}
+		for i := 1; ; i++ {
+			element := v.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+			array = append(array, luaToValue(element))
+		}
+		return ArrayValue{Val: array}
+	default:
+		return NullValue{}
+	}
+}
+
+func script(args []Value, _ *Client) Value {
+	subcommand := strings.ToUpper(args[0].(BulkStringValue).Val)
+
+	switch {
+	case subcommand == "LOAD" && len(args) == 2:
+		sha, errValue := loadScript(args[1].(BulkStringValue).Val)
+		if errValue != nil {
+			return errValue
+		}
+
+		return BulkStringValue{Val: sha}
+	case subcommand == "EXISTS" && len(args) >= 2:
+		array := make([]Value, len(args)-1)
+		for i, arg := range args[1:] {
+			if _, found := scripts[strings.ToLower(arg.(BulkStringValue).Val)]; found {
+				array[i] = IntegerValue{Val: 1}
+			} else {
+				array[i] = IntegerValue{Val: 0}
+			}
+		}
+
+		return ArrayValue{Val: array}
+	case subcommand == "FLUSH" && len(args) <= 2:
+		if len(args) == 2 {
+			mode := strings.ToUpper(args[1].(BulkStringValue).Val)
+			if mode != "ASYNC" && mode != "SYNC" {
+				return ErrorValue{Val: "ERR SCRIPT FLUSH only support SYNC|ASYNC option"}
+			}
+		}
+
+		scripts = make(map[string]*lua.FunctionProto)
+
+		return StringValue{Val: "OK"}
+	case subcommand == "KILL" && len(args) == 1:
+		runningScriptMutex.Lock()
+		defer runningScriptMutex.Unlock()
+
+		return killScript()
+	default:
+		return ErrorValue{Val: "ERR unknown subcommand or wrong number of arguments for '" + args[0].(BulkStringValue).Val + "'. Try SCRIPT HELP."}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// setLuaTimeLimit makes scripts busy after the given time for the rest of the
+// test.
+func setLuaTimeLimit(t *testing.T, client *testClient, limit string) {
+	t.Helper()
+
+	previous := serverConfig().LuaTimeLimit.Milliseconds()
+	client.do("+OK\r\n", "CONFIG", "SET", "lua-time-limit", limit)
+	t.Cleanup(func() {
+		client.do("+OK\r\n", "CONFIG", "SET", "lua-time-limit", fmt.Sprint(previous))
+	})
+}
+
+// waitForBusyScript waits until the running script is past the time limit,
+// when other clients get a BUSY error.
+func waitForBusyScript(t *testing.T, client *testClient) {
+	t.Helper()
+
+	busy := "-BUSY redgo is busy running a script. You can only call SCRIPT KILL.\r\n"
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		client.send("PING")
+
+		reply := make([]byte, len(busy))
+		client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(client.reader, reply[:1]); err != nil {
+			t.Fatal(err)
+		}
+
+		if reply[0] == '-' {
+			client.expect(busy[1:])
+			return
+		}
+
+		client.expect("PONG\r\n")
+		if time.Now().After(deadline) {
+			t.Fatal("the script never got busy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestScriptKill checks that a script running past the time limit answers the
+// other clients with BUSY until SCRIPT KILL stops it.
+func TestScriptKill(t *testing.T) {
+	addr := startTestServer(t)
+	runner := dialTestClient(t, addr)
+	other := dialTestClient(t, addr)
+	setLuaTimeLimit(t, other, "10")
+
+	other.do("-NOTBUSY No scripts in execution right now.\r\n", "SCRIPT", "KILL")
+
+	runner.send("EVAL", "while true do end", "0")
+	waitForBusyScript(t, other)
+
+	other.do("-BUSY redgo is busy running a script. You can only call SCRIPT KILL.\r\n", "GET", "test:busy")
+	other.do("+OK\r\n", "SCRIPT", "KILL")
+	runner.expect("-ERR Script killed by user with SCRIPT KILL...\r\n")
+	other.do("$-1\r\n", "GET", "test:busy")
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const (
+	SET_OP_UNION = iota
+	SET_OP_INTER
+	SET_OP_DIFF
+)
+
+// lookupSet returns the set stored at key, nil if the key doesn't exist, or
+// WrongTypeError if it holds something else.
+func lookupSet(key string) (map[string]struct{}, Value) {
+	obj, errValue := DB.LookupType(key, OBJ_SET)
+	if errValue != nil || obj == nil {
+		return nil, errValue
+	}
+
+	return obj.Data.(map[string]struct{}), nil
+}
+
+// deleteSetIfEmpty removes the key once its last member is gone, as empty sets don't exist.
+func deleteSetIfEmpty(key string, set map[string]struct{}) {
+	if len(set) == 0 {
+		DB.Delete(key)
+	}
+}
+
+func setMembersArray(set map[string]struct{}) Value {
+	array := make([]Value, 0, len(set))
+	for member := range set {
+		array = append(array, BulkStringValue{Val: member})
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// randomSetMembers returns count distinct random members, or all of them if
+// the set is smaller.
+func randomSetMembers(set map[string]struct{}, count int) []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+
+	rand.Shuffle(len(members), func(i, j int) {
+		members[i], members[j] = members[j], members[i]
+	})
+
+	return members[:min(count, len(members))]
+}
+
+func sadd(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'sadd' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	set, errValue := lookupSet(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if set == nil {
+		set = make(map[string]struct{})
+		DB.Set(key, &Object{Type: OBJ_SET, Data: set})
+	}
+
+	added := 0
+	for _, arg := range args[1:] {
+		member := arg.(BulkStringValue).Val
+
+		if _, found := set[member]; !found {
+			set[member] = struct{}{}
+			added++
+		}
+	}
+
+	if added == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	return IntegerValue{Val: added}
+}
+
+func srem(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'srem' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	set, errValue := lookupSet(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if set == nil {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	removed := 0
+	for _, arg := range args[1:] {
+		member := arg.(BulkStringValue).Val
+
+		if _, found := set[member]; found {
+			delete(set, member)
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	deleteSetIfEmpty(key, set)
+
+	return IntegerValue{Val: removed}
+}
+
+func smembers(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'smembers' command"}
+	}
+
+	set, errValue := lookupSet(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	return setMembersArray(set)
+}
+
+func sismember(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'sismember' command"}
+	}
+
+	set, errValue := lookupSet(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if _, found := set[args[1].(BulkStringValue).Val]; found {
+		return IntegerValue{Val: 1}
+	}
+
+	return IntegerValue{Val: 0}
+}
+
+func smismember(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'smismember' command"}
+	}
+
+	set, errValue := lookupSet(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	array := make([]Value, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if _, found := set[arg.(BulkStringValue).Val]; found {
+			array = append(array, IntegerValue{Val: 1})
+		} else {
+			array = append(array, IntegerValue{Val: 0})
+		}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func scard(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'scard' command"}
+	}
+
+	set, errValue := lookupSet(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	return IntegerValue{Val: len(set)}
+}
+
+func smove(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'smove' command"}
+	}
+
+	source := args[0].(BulkStringValue).Val
+	destination := args[1].(BulkStringValue).Val
+	member := args[2].(BulkStringValue).Val
+
+	sourceSet, errValue := lookupSet(source)
+	if errValue != nil {
+		return errValue
+	}
+
+	destinationSet, errValue := lookupSet(destination)
+	if errValue != nil {
+		return errValue
+	}
+
+	if _, found := sourceSet[member]; !found {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	if source == destination {
+		preventCommandPropagation()
+		return IntegerValue{Val: 1}
+	}
+
+	delete(sourceSet, member)
+	signalModifiedKey(source)
+	deleteSetIfEmpty(source, sourceSet)
+
+	if destinationSet == nil {
+		destinationSet = make(map[string]struct{})
+		DB.Set(destination, &Object{Type: OBJ_SET, Data: destinationSet})
+	}
+
+	destinationSet[member] = struct{}{}
+	signalModifiedKey(destination)
+
+	return IntegerValue{Val: 1}
+}
+
+// maxRandomRepetitions caps the members returned by SRANDMEMBER, and the
+// fields by HRANDFIELD, when a negative count allows repetitions. Redis
+// streams such a reply, but ours is built in memory before it's sent, so a
+// huge count would exhaust the memory.
+const maxRandomRepetitions = 1 << 20
+
+// parseRandomCount parses the count of SRANDMEMBER and HRANDFIELD. As in
+// Redis, its opposite must be a valid count too.
+func parseRandomCount(arg Value) (int, Value) {
+	count, err := strconv.Atoi(arg.(BulkStringValue).Val)
+	if err != nil {
+		return 0, NotIntegerError
+	}
+
+	if count < -maxRandomRepetitions {
+		return 0, ErrorValue{Val: "ERR value is out of range"}
+	}
+
+	return count, nil
+}
+
+func srandmember(args []Value, _ *Client) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'srandmember' command"}
+	}
+
+	count := 1
+	if len(args) == 2 {
+		var errValue Value
+		if count, errValue = parseRandomCount(args[1]); errValue != nil {
+			return errValue
+		}
+	}
+
+	set, errValue := lookupSet(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if len(args) == 1 {
+		if set == nil {
+			return NullValue{}
+		}
+
+		return BulkStringValue{Val: randomSetMembers(set, 1)[0]}
+	}
+
+	if set == nil || count == 0 {
+		return ArrayValue{Val: []Value{}}
+	}
+
+	// A positive count returns distinct members, a negative one allows
+	// repetitions and always returns exactly -count members.
+	if count > 0 {
+		members := randomSetMembers(set, count)
+
+		array := make([]Value, len(members))
+		for i, member := range members {
+			array[i] = BulkStringValue{Val: member}
+		}
+
+		return ArrayValue{Val: array}
+	}
+
+	members := randomSetMembers(set, len(set))
+
+	array := make([]Value, -count)
+	for i := range array {
+		array[i] = BulkStringValue{Val: members[rand.Intn(len(members))]}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func spop(args []Value, _ *Client) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'spop' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	count := -1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+		if err != nil || n < 0 {
+			return ErrorValue{Val: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	set, errValue := lookupSet(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if set == nil || count == 0 {
+		preventCommandPropagation()
+
+		if count == -1 {
+			return NullValue{}
+		}
+		return ArrayValue{Val: []Value{}}
+	}
+
+	members := randomSetMembers(set, max(count, 1))
+
+	// The members are picked at random, so the AOF records which ones were removed.
+	preventCommandPropagation()
+
+	propagation := []Value{BulkStringValue{Val: "SREM"}, BulkStringValue{Val: key}}
+	array := make([]Value, len(members))
+
+	for i, member := range members {
+		delete(set, member)
+		array[i] = BulkStringValue{Val: member}
+		propagation = append(propagation, BulkStringValue{Val: member})
+	}
+
+	if len(members) > 0 {
+		alsoPropagate(propagation...)
+		signalModifiedKey(key)
+	}
+
+	deleteSetIfEmpty(key, set)
+
+	if count == -1 {
+		return array[0]
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// setOperation computes the union, intersection or difference of the sets
+// stored at keys. Missing keys are treated as empty sets.
+func setOperation(keys []string, op int) (map[string]struct{}, Value) {
+	sets := make([]map[string]struct{}, len(keys))
+
+	for i, key := range keys {
+		set, errValue := lookupSet(key)
+		if errValue != nil {
+			return nil, errValue
+		}
+		sets[i] = set
+	}
+
+	result := make(map[string]struct{})
+
+	switch op {
+	case SET_OP_UNION:
+		for _, set := range sets {
+			for member := range set {
+				result[member] = struct{}{}
+			}
+		}
+	case SET_OP_INTER:
+		for member := range sets[0] {
+			inAll := true
+			for _, set := range sets[1:] {
+				if _, found := set[member]; !found {
+					inAll = false
+					break
+				}
+			}
+
+			if inAll {
+				result[member] = struct{}{}
+			}
+		}
+	case SET_OP_DIFF:
+		for member := range sets[0] {
+			inOther := false
+			for _, set := range sets[1:] {
+				if _, found := set[member]; found {
+					inOther = true
+					break
+				}
+			}
+
+			if !inOther {
+				result[member] = struct{}{}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func sunion(args []Value, _ *Client) Value {
+	return setOperationCommand(args, "sunion", SET_OP_UNION)
+}
+
+func sinter(args []Value, _ *Client) Value {
+	return setOperationCommand(args, "sinter", SET_OP_INTER)
+}
+
+func sdiff(args []Value, _ *Client) Value {
+	return setOperationCommand(args, "sdiff", SET_OP_DIFF)
+}
+
+func setOperationCommand(args []Value, name string, op int) Value {
+	if len(args) < 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	result, errValue := setOperation(keysFromArgs(args), op)
+	if errValue != nil {
+		return errValue
+	}
+
+	return setMembersArray(result)
+}
+
+func sunionstore(args []Value, _ *Client) Value {
+	return setOperationStoreCommand(args, "sunionstore", SET_OP_UNION)
+}
+
+func sinterstore(args []Value, _ *Client) Value {
+	return setOperationStoreCommand(args, "sinterstore", SET_OP_INTER)
+}
+
+func sdiffstore(args []Value, _ *Client) Value {
+	return setOperationStoreCommand(args, "sdiffstore", SET_OP_DIFF)
+}
+
+// setOperationStoreCommand implements the *STORE variants, which overwrite the
+// destination with the result and reply with its cardinality.
+func setOperationStoreCommand(args []Value, name string, op int) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	destination := args[0].(BulkStringValue).Val
+
+	result, errValue := setOperation(keysFromArgs(args[1:]), op)
+	if errValue != nil {
+		return errValue
+	}
+
+	if len(result) == 0 {
+		if !DB.Delete(destination) {
+			preventCommandPropagation()
+		}
+	} else {
+		DB.Set(destination, &Object{Type: OBJ_SET, Data: result})
+	}
+
+	return IntegerValue{Val: len(result)}
+}
+
+func sintercardKeys(argv []Value) []string {
+	return keysAfterNumkeys(argv, 1)
+}
+
+func sintercard(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'sintercard' command"}
+	}
+
+	numkeys, err := strconv.Atoi(args[0].(BulkStringValue).Val)
+	if err != nil || numkeys <= 0 {
+		return ErrorValue{Val: "ERR numkeys should be greater than 0"}
+	}
+
+	if len(args) < numkeys+1 {
+		return ErrorValue{Val: "ERR Number of keys can't be greater than number of args"}
+	}
+
+	limit := 0
+	rest := args[numkeys+1:]
+
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0].(BulkStringValue).Val) == "LIMIT":
+		limit, err = strconv.Atoi(rest[1].(BulkStringValue).Val)
+		if err != nil || limit < 0 {
+			return ErrorValue{Val: "ERR LIMIT can't be negative"}
+		}
+	default:
+		return SyntaxError
+	}
+
+	result, errValue := setOperation(keysFromArgs(args[1:numkeys+1]), SET_OP_INTER)
+	if errValue != nil {
+		return errValue
+	}
+
+	if limit > 0 && len(result) > limit {
+		return IntegerValue{Val: limit}
+	}
+
+	return IntegerValue{Val: len(result)}
+}
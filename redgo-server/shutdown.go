@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The listeners and the AOF of the running server, which SHUTDOWN closes.
+var (
+	serverListeners []net.Listener
+	serverAof       *Aof
+)
+
+type shutdownFlags struct {
+	save   bool
+	noSave bool
+	force  bool
+}
+
+func parseShutdownFlags(args []Value) (shutdownFlags, Value) {
+	var flags shutdownFlags
+
+	for _, arg := range args {
+		switch strings.ToUpper(arg.(BulkStringValue).Val) {
+		case "SAVE":
+			flags.save = true
+		case "NOSAVE":
+			flags.noSave = true
+		case "NOW":
+			// There are no replicas to wait for.
+		case "FORCE":
+			flags.force = true
+		default:
+			return flags, SyntaxError
+		}
+	}
+
+	if flags.save && flags.noSave {
+		return flags, SyntaxError
+	}
+
+	return flags, nil
+}
+
+// shutdown only replies if the server couldn't be stopped, otherwise the
+// connection is closed as the server exits.
+func shutdown(args []Value, _ *Client) Value {
+	flags, errValue := parseShutdownFlags(args)
+	if errValue != nil {
+		return errValue
+	}
+
+	serverLog(LOG_WARNING, "User requested shutdown...")
+
+	if err := prepareForShutdown(flags); err != nil {
+		return ErrorValue{Val: "ERR Errors trying to SHUTDOWN. Check logs."}
+	}
+
+	os.Exit(0)
+
+	return nil
+}
+
+// prepareForShutdown syncs and closes the AOF and saves a snapshot if SAVE is
+// given, or if save points are configured and NOSAVE isn't. It then stops
+// accepting connections and sends the replies still buffered for the clients,
+// so that the server can exit. Unless FORCE is given, it gives up if the AOF
+// can't be synced or the snapshot saved.
+//
+// The keyspace must be locked by the caller, which makes sure no command is
+// running and none will. SHUTDOWN NOSAVE sent while a script runs past the
+// time limit is the exception, as the script holds the lock: with no snapshot
+// to save, only the AOF, the listeners and the clients' writers are used,
+// which have locks of their own, and bgsaveRuns, which is atomic. The writes
+// of the script aren't in the AOF yet and are lost.
+func prepareForShutdown(flags shutdownFlags) error {
+	// The background save can't complete once the keyspace is locked, and is
+	// superseded by the snapshot saved below if there's one.
+	if bgsaveRuns.Load() {
+		serverLog(LOG_WARNING, "There is a background save in progress. Abandoning it!")
+		os.Remove(rdbTempPath(true))
+	}
+
+	if serverAof != nil {
+		serverLog(LOG_NOTICE, "Calling fsync() on the AOF file.")
+
+		if err := serverAof.Sync(); err != nil {
+			serverLog(LOG_WARNING, "Error syncing the AOF file on shutdown: %v", err)
+
+			if !flags.force {
+				serverLog(LOG_WARNING, "Errors trying to shut down the server. Check the logs for more information.")
+				return err
+			}
+		}
+	}
+
+	if flags.save || (!flags.noSave && len(serverConfig().Save) > 0) {
+		serverLog(LOG_NOTICE, "Saving the final RDB snapshot before exiting.")
+
+		if err := rdbSave(); err != nil && !flags.force {
+			serverLog(LOG_WARNING, "Error trying to save the DB, can't exit.")
+			return err
+		}
+	}
+
+	if serverAof != nil {
+		serverAof.Close()
+	}
+
+	for _, listener := range serverListeners {
+		listener.Close()
+	}
+
+	ClientsMutex.Lock()
+	for _, client := range Clients {
+		// Don't wait forever for a client that doesn't read its replies.
+		client.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		client.Writer.Flush()
+	}
+	ClientsMutex.Unlock()
+
+	serverLog(LOG_WARNING, "RedGo is now ready to exit, bye bye...")
+
+	return nil
+}
+
+// handleShutdownSignals shuts the server down on SIGINT or SIGTERM once the
+// running command completes. If that fails the server keeps running, and a
+// second signal received while still waiting exits right away.
+func handleShutdownSignals(signals <-chan os.Signal) {
+	failed := make(chan struct{})
+	requested := false
+
+	for {
+		select {
+		case sig := <-signals:
+			if requested {
+				serverLog(LOG_WARNING, "You insist... exiting now.")
+				os.Exit(1)
+			}
+
+			requested = true
+			serverLog(LOG_WARNING, "Received %s, scheduling shutdown...", signalName(sig))
+
+			go func() {
+				DB.Lock()
+				defer DB.Unlock()
+
+				if prepareForShutdown(shutdownFlags{}) == nil {
+					os.Exit(0)
+				}
+
+				failed <- struct{}{}
+			}()
+		case <-failed:
+			requested = false
+		}
+	}
+}
+
+func signalName(sig os.Signal) string {
+	if sig == os.Interrupt {
+		return "SIGINT"
+	}
+
+	return "SIGTERM"
+}
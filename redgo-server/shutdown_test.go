@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	osexec "os/exec"
+	"testing"
+	"time"
+)
+
+// TestShutdownNoSaveBusyScript checks that SHUTDOWN NOSAVE exits the server
+// while a script runs past the time limit, holding the keyspace lock. The
+// server exits, so the test runs it in a copy of the test binary.
+func TestShutdownNoSaveBusyScript(t *testing.T) {
+	if os.Getenv("REDGO_TEST_SHUTDOWN") == "" {
+		cmd := osexec.Command(os.Args[0], "-test.run=^TestShutdownNoSaveBusyScript$")
+		cmd.Env = append(os.Environ(), "REDGO_TEST_SHUTDOWN=1")
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		return
+	}
+
+	addr := startTestServer(t)
+	runner := dialTestClient(t, addr)
+	other := dialTestClient(t, addr)
+	setLuaTimeLimit(t, other, "10")
+
+	// A background save can't complete with the keyspace locked, and is abandoned.
+	bgsaveRuns.Store(true)
+
+	runner.send("EVAL", "while true do end", "0")
+	waitForBusyScript(t, other)
+
+	other.send("SHUTDOWN", "NOSAVE")
+	time.Sleep(2 * time.Second)
+	t.Fatal("the server didn't exit")
+}
@@ -0,0 +1,379 @@
+package main
+
+import "math/rand"
+
+const (
+	skiplistMaxLevel = 32
+	// Probability of a node having one more level than the previous one.
+	skiplistP = 0.25
+)
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	// span is the number of nodes skipped by forward, used to compute ranks.
+	span int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+// Skiplist keeps the members of a sorted set ordered by score, then by member,
+// and supports finding a member's rank and the node at a rank in O(log n).
+// Ranks are 1-based, like in the Redis implementation this is modeled after.
+type Skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+// scoreRange is a score interval whose bounds may be exclusive, e.g. (1 5].
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+// lexBound is one end of a lexRange. inf is -1 for "-", the bound lower than
+// any member, 1 for "+", the bound greater than any member, and 0 otherwise.
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+// lexRange is a member interval, used on sorted sets whose members all share
+// the same score.
+type lexRange struct {
+	min, max lexBound
+}
+
+func NewSkiplist() *Skiplist {
+	return &Skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomSkiplistLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+
+	return level
+}
+
+// lessThan tells whether the node sorts before the given score and member.
+func (node *skiplistNode) lessThan(score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+func (zsl *Skiplist) Len() int {
+	return zsl.length
+}
+
+// Insert adds a member, which must not already be in the skiplist.
+func (zsl *Skiplist) Insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+
+		for x.level[i].forward != nil && x.level[i].forward.lessThan(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomSkiplistLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	// Levels above the new node now skip one more node.
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+
+	zsl.length++
+
+	return x
+}
+
+func (zsl *Skiplist) deleteNode(x *skiplistNode, update []*skiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+
+	zsl.length--
+}
+
+// Delete removes the node with the given score and member, returning false if there's none.
+func (zsl *Skiplist) Delete(score float64, member string) bool {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.lessThan(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	zsl.deleteNode(x, update)
+
+	return true
+}
+
+// Rank returns the 1-based rank of the member with the given score, or 0 if
+// it isn't in the skiplist.
+func (zsl *Skiplist) Rank(score float64, member string) int {
+	rank := 0
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !scoreMemberGreater(x.level[i].forward, score, member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if x != zsl.header && x.score == score && x.member == member {
+			return rank
+		}
+	}
+
+	return 0
+}
+
+func scoreMemberGreater(node *skiplistNode, score float64, member string) bool {
+	return node.score > score || (node.score == score && node.member > member)
+}
+
+// ByRank returns the node at the given 1-based rank, or nil if it's out of range.
+func (zsl *Skiplist) ByRank(rank int) *skiplistNode {
+	traversed := 0
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if traversed == rank {
+			if x == zsl.header {
+				return nil
+			}
+			return x
+		}
+	}
+
+	return nil
+}
+
+func (r scoreRange) gteMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r scoreRange) lteMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+func (r scoreRange) isEmpty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minex || r.maxex))
+}
+
+// FirstInScoreRange returns the first node within the range, or nil.
+func (zsl *Skiplist) FirstInScoreRange(r scoreRange) *skiplistNode {
+	if r.isEmpty() {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.score) {
+		return nil
+	}
+
+	return x
+}
+
+// LastInScoreRange returns the last node within the range, or nil.
+func (zsl *Skiplist) LastInScoreRange(r scoreRange) *skiplistNode {
+	if r.isEmpty() {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == zsl.header || !r.gteMin(x.score) {
+		return nil
+	}
+
+	return x
+}
+
+func (r lexRange) gteMin(member string) bool {
+	switch {
+	case r.min.inf != 0:
+		return r.min.inf < 0
+	case r.min.exclusive:
+		return member > r.min.value
+	default:
+		return member >= r.min.value
+	}
+}
+
+func (r lexRange) lteMax(member string) bool {
+	switch {
+	case r.max.inf != 0:
+		return r.max.inf > 0
+	case r.max.exclusive:
+		return member < r.max.value
+	default:
+		return member <= r.max.value
+	}
+}
+
+func (r lexRange) isEmpty() bool {
+	if r.min.inf > 0 || r.max.inf < 0 {
+		return true
+	}
+
+	if r.min.inf < 0 || r.max.inf > 0 {
+		return false
+	}
+
+	return r.min.value > r.max.value || (r.min.value == r.max.value && (r.min.exclusive || r.max.exclusive))
+}
+
+// FirstInLexRange returns the first node within the range, or nil.
+func (zsl *Skiplist) FirstInLexRange(r lexRange) *skiplistNode {
+	if r.isEmpty() {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.member) {
+		return nil
+	}
+
+	return x
+}
+
+// LastInLexRange returns the last node within the range, or nil.
+func (zsl *Skiplist) LastInLexRange(r lexRange) *skiplistNode {
+	if r.isEmpty() {
+		return nil
+	}
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == zsl.header || !r.gteMin(x.member) {
+		return nil
+	}
+
+	return x
+}
+
+// First returns the node with the lowest score, or nil if the skiplist is empty.
+func (zsl *Skiplist) First() *skiplistNode {
+	return zsl.header.level[0].forward
+}
+
+// Last returns the node with the highest score, or nil if the skiplist is empty.
+func (zsl *Skiplist) Last() *skiplistNode {
+	return zsl.tail
+}
+
+// Next returns the node following this one, or nil.
+func (node *skiplistNode) Next() *skiplistNode {
+	return node.level[0].forward
+}
+
+// Prev returns the node preceding this one, or nil.
+func (node *skiplistNode) Prev() *skiplistNode {
+	return node.backward
+}
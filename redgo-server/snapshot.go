@@ -0,0 +1,123 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+	"time"
+)
+
+// The keyspace is locked for this long at most at a time while a snapshot is
+// encoded in the background, before commands get their turn.
+const snapshotStepTime = time.Millisecond
+
+// Encoders cut what they encoded into chunks of about this size, see
+// chunkedBuffer.
+const snapshotChunkSize = 64 * 1024
+
+// chunkedBuffer is where an encoder appends the file it encodes. Growing a
+// single buffer would copy all of it, while the keyspace is locked when it's
+// a snapshot, so the encoder cuts it into chunks between keys.
+type chunkedBuffer struct {
+	chunks [][]byte
+	buf    []byte
+}
+
+// cut starts a new chunk once the current one is full, returning true if it
+// did.
+func (b *chunkedBuffer) cut() bool {
+	if len(b.buf) < snapshotChunkSize {
+		return false
+	}
+
+	b.chunks = append(b.chunks, b.buf)
+	b.buf = make([]byte, 0, 2*snapshotChunkSize)
+
+	return true
+}
+
+// bytes returns the chunks joined into one, with the current one.
+func (b *chunkedBuffer) bytes() []byte {
+	return slices.Concat(append(b.chunks, b.buf)...)
+}
+
+// snapshotEncoder encodes the dataset into a file, e.g. a snapshot or the base
+// of the AOF. The function libraries are encoded when it's created.
+type snapshotEncoder interface {
+	// key appends a key, with its expiration if it has one.
+	key(key string, obj *Object, when int64, expires bool)
+	// finish returns the whole file once every key was appended.
+	finish() []byte
+}
+
+// datasetSnapshot is the dataset as it was when the snapshot was taken, which
+// is encoded a step at a time while commands go on. Before a command changes a
+// key that isn't encoded yet, its value is encoded first, see Keyspace.preserve,
+// so the changes made meanwhile are left out, like the keys created meanwhile.
+type datasetSnapshot struct {
+	ks      *Keyspace
+	encoder snapshotEncoder
+	// settled holds the keys encoded already, and those that didn't exist when
+	// the snapshot was taken.
+	settled map[string]struct{}
+}
+
+// startSnapshot takes a snapshot of the dataset, encoded by encoder. The
+// keyspace must be locked by the caller.
+func (ks *Keyspace) startSnapshot(encoder snapshotEncoder) *datasetSnapshot {
+	s := &datasetSnapshot{ks: ks, encoder: encoder, settled: make(map[string]struct{})}
+	ks.snapshots = append(ks.snapshots, s)
+
+	return s
+}
+
+// preserve encodes the key into the snapshots being taken before it changes,
+// unless they hold it already or it didn't exist when they were taken. The
+// methods handing out or changing the values of the keyspace call it.
+func (ks *Keyspace) preserve(key string) {
+	for _, s := range ks.snapshots {
+		s.settle(key, ks.objects[key])
+	}
+}
+
+func (s *datasetSnapshot) settle(key string, obj *Object) {
+	if _, found := s.settled[key]; found {
+		return
+	}
+	s.settled[key] = struct{}{}
+
+	if obj != nil {
+		when, expires := s.ks.expires[key]
+		s.encoder.key(key, obj, when, expires)
+	}
+}
+
+// encode encodes the keys no command changed and returns the whole file. It
+// locks the keyspace for snapshotStepTime at most at a time, so the keyspace
+// must not be locked by the caller.
+func (s *datasetSnapshot) encode() []byte {
+	s.ks.Lock()
+
+	step := time.Now()
+
+	// The keys deleted before the loop gets to them were encoded by preserve,
+	// and the keys created meanwhile, which it may or may not get to, are
+	// settled already.
+	for key, obj := range s.ks.objects {
+		s.settle(key, obj)
+
+		if time.Since(step) > snapshotStepTime {
+			// Let the clients waiting for the lock run, rather than taking it
+			// back before they get to, e.g. with a single CPU.
+			s.ks.Unlock()
+			runtime.Gosched()
+			s.ks.Lock()
+			step = time.Now()
+		}
+	}
+
+	s.ks.snapshots = slices.DeleteFunc(s.ks.snapshots, func(other *datasetSnapshot) bool { return other == s })
+
+	s.ks.Unlock()
+
+	return s.encoder.finish()
+}
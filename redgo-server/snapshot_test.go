@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// snapshotRecorder records the keys of a snapshot as they're encoded.
+type snapshotRecorder map[string]string
+
+func (r snapshotRecorder) key(key string, obj *Object, when int64, expires bool) {
+	if !strings.HasPrefix(key, "test:snapshot:") {
+		return
+	}
+
+	value := ""
+	switch data := obj.Data.(type) {
+	case string:
+		value = data
+	case *Quicklist:
+		value = strings.Join(data.Range(0, -1), ",")
+	}
+
+	if expires {
+		value += fmt.Sprintf(" PXAT %d", when)
+	}
+
+	r[key] = value
+}
+
+func (r snapshotRecorder) finish() []byte {
+	return nil
+}
+
+// TestSnapshotChangedKeys checks that a snapshot holds the keys as they were
+// when it was taken, whatever the commands run before they're encoded do.
+func TestSnapshotChangedKeys(t *testing.T) {
+	when := nowMs() + 100_000
+	list := NewQuicklist()
+	list.PushTail("a")
+
+	DB.Lock()
+
+	DB.Set("test:snapshot:kept", &Object{Type: OBJ_STRING, Data: "1"})
+	DB.Set("test:snapshot:deleted", &Object{Type: OBJ_STRING, Data: "2"})
+	DB.Set("test:snapshot:overwritten", &Object{Type: OBJ_STRING, Data: "3"})
+	DB.Set("test:snapshot:pushed", &Object{Type: OBJ_LIST, Data: list})
+	DB.Set("test:snapshot:persisted", &Object{Type: OBJ_STRING, Data: "4"})
+	DB.SetExpire("test:snapshot:persisted", when)
+
+	recorder := snapshotRecorder{}
+	snapshot := DB.startSnapshot(recorder)
+
+	DB.Delete("test:snapshot:deleted")
+	DB.Set("test:snapshot:overwritten", &Object{Type: OBJ_STRING, Data: "new"})
+	DB.Lookup("test:snapshot:pushed").Data.(*Quicklist).PushTail("b")
+	DB.Persist("test:snapshot:persisted")
+	DB.Set("test:snapshot:created", &Object{Type: OBJ_STRING, Data: "5"})
+	DB.Delete("test:snapshot:created")
+	DB.Set("test:snapshot:created", &Object{Type: OBJ_STRING, Data: "6"})
+
+	DB.Unlock()
+
+	snapshot.encode()
+
+	expected := snapshotRecorder{
+		"test:snapshot:kept":        "1",
+		"test:snapshot:deleted":     "2",
+		"test:snapshot:overwritten": "3",
+		"test:snapshot:pushed":      "a",
+		"test:snapshot:persisted":   fmt.Sprintf("4 PXAT %d", when),
+	}
+	if !reflect.DeepEqual(recorder, expected) {
+		t.Fatalf("expected %v, got %v", expected, recorder)
+	}
+
+	DB.Lock()
+	defer DB.Unlock()
+
+	if len(DB.snapshots) != 0 {
+		t.Fatal("the snapshot should no longer be taken once encoded")
+	}
+
+	for _, key := range []string{"kept", "overwritten", "pushed", "persisted", "created"} {
+		DB.Delete("test:snapshot:" + key)
+	}
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	STREAM_TRIM_NONE = iota
+	STREAM_TRIM_MAXLEN
+	STREAM_TRIM_MINID
+)
+
+var InvalidStreamIDError = ErrorValue{Val: "ERR Invalid stream ID specified as stream command argument"}
+
+// StreamID identifies a stream entry: the millisecond time it was added at and
+// a sequence number telling apart entries added in the same millisecond.
+type StreamID struct {
+	ms, seq uint64
+}
+
+var maxStreamID = StreamID{ms: math.MaxUint64, seq: math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.ms < other.ms:
+		return -1
+	case id.ms > other.ms:
+		return 1
+	case id.seq < other.seq:
+		return -1
+	case id.seq > other.seq:
+		return 1
+	}
+
+	return 0
+}
+
+// incr returns the ID following this one, or false if this is the greatest ID.
+func (id StreamID) incr() (StreamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return StreamID{ms: id.ms, seq: id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return StreamID{ms: id.ms + 1}, true
+	}
+
+	return id, false
+}
+
+// decr returns the ID preceding this one, or false if this is 0-0.
+func (id StreamID) decr() (StreamID, bool) {
+	switch {
+	case id.seq > 0:
+		return StreamID{ms: id.ms, seq: id.seq - 1}, true
+	case id.ms > 0:
+		return StreamID{ms: id.ms - 1, seq: math.MaxUint64}, true
+	}
+
+	return id, false
+}
+
+// parseStreamID parses an ID in the <ms>-<seq> form. An ID without a sequence
+// number gets missingSeq.
+func parseStreamID(s string, missingSeq uint64) (StreamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, false
+	}
+
+	if !hasSeq {
+		return StreamID{ms: ms, seq: missingSeq}, true
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, false
+	}
+
+	return StreamID{ms: ms, seq: seq}, true
+}
+
+// parseRangeStreamID parses one end of an XRANGE-like interval, which may be
+// "-", "+", an ID without a sequence number, or an ID prefixed by "(" to make
+// it exclusive.
+func parseRangeStreamID(arg Value, isStart bool) (StreamID, Value) {
+	s := arg.(BulkStringValue).Val
+
+	switch s {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+
+	var missingSeq uint64
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+
+	id, ok := parseStreamID(s, missingSeq)
+	if !ok {
+		return StreamID{}, InvalidStreamIDError
+	}
+
+	if !exclusive {
+		return id, nil
+	}
+
+	if isStart {
+		if id, ok = id.incr(); !ok {
+			return StreamID{}, ErrorValue{Val: "ERR invalid start ID for the interval"}
+		}
+	} else {
+		if id, ok = id.decr(); !ok {
+			return StreamID{}, ErrorValue{Val: "ERR invalid end ID for the interval"}
+		}
+	}
+
+	return id, nil
+}
+
+type StreamEntry struct {
+	ID StreamID
+	// Fields holds the field names and values of the entry, interleaved.
+	Fields []string
+}
+
+// Stream is an append-only log of entries ordered by ID. Entries are only ever
+// appended with a greater ID than the last one, so the slice stays sorted and
+// ranges are found with a binary search.
+type Stream struct {
+	entries []StreamEntry
+	// lastID is the greatest ID ever added, even if that entry was since deleted.
+	lastID StreamID
+	groups map[string]*ConsumerGroup
+}
+
+func NewStream() *Stream {
+	return &Stream{groups: make(map[string]*ConsumerGroup)}
+}
+
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// search returns the index of the first entry whose ID is greater than or
+// equal to id, or greater than id if exclusive is set.
+func (s *Stream) search(id StreamID, exclusive bool) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		cmp := s.entries[i].ID.Compare(id)
+		return cmp > 0 || (cmp == 0 && !exclusive)
+	})
+}
+
+func (s *Stream) Lookup(id StreamID) (StreamEntry, bool) {
+	i := s.search(id, false)
+	if i == len(s.entries) || s.entries[i].ID != id {
+		return StreamEntry{}, false
+	}
+
+	return s.entries[i], true
+}
+
+func (s *Stream) Append(id StreamID, fields []string) {
+	s.entries = append(s.entries, StreamEntry{ID: id, Fields: fields})
+	s.lastID = id
+}
+
+func (s *Stream) Delete(id StreamID) bool {
+	i := s.search(id, false)
+	if i == len(s.entries) || s.entries[i].ID != id {
+		return false
+	}
+
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+
+	return true
+}
+
+// Range returns the entries between start and end, both inclusive, from the
+// end when reverse is set. A count of 0 means no limit.
+func (s *Stream) Range(start, end StreamID, count int, reverse bool) []StreamEntry {
+	if start.Compare(end) > 0 {
+		return nil
+	}
+
+	entries := s.entries[s.search(start, false):s.search(end, true)]
+	if count > 0 && len(entries) > count {
+		if reverse {
+			entries = entries[len(entries)-count:]
+		} else {
+			entries = entries[:count]
+		}
+	}
+
+	result := make([]StreamEntry, len(entries))
+	copy(result, entries)
+
+	if reverse {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+
+	return result
+}
+
+// After returns up to count entries with an ID greater than id. A count of 0
+// means no limit.
+func (s *Stream) After(id StreamID, count int) []StreamEntry {
+	start, ok := id.incr()
+	if !ok {
+		return nil
+	}
+
+	return s.Range(start, maxStreamID, count, false)
+}
+
+// nextID returns the ID of the entry XADD is adding, given its ID argument:
+// "*" generates the whole ID and "<ms>-*" only the sequence number. The ID
+// must be greater than any ID ever added to the stream.
+func (s *Stream) nextID(arg string) (StreamID, Value) {
+	smallerError := ErrorValue{Val: "ERR The ID specified in XADD is equal or smaller than the target stream top item"}
+
+	if arg == "*" {
+		ms := uint64(nowMs())
+		if ms > s.lastID.ms {
+			return StreamID{ms: ms}, nil
+		}
+
+		// The clock went backwards or we're still in the same millisecond.
+		id, ok := s.lastID.incr()
+		if !ok {
+			return StreamID{}, ErrorValue{Val: "ERR The stream has exhausted the last possible ID, unable to add more items"}
+		}
+
+		return id, nil
+	}
+
+	if msPart, found := strings.CutSuffix(arg, "-*"); found {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return StreamID{}, InvalidStreamIDError
+		}
+
+		switch {
+		case ms > s.lastID.ms:
+			return StreamID{ms: ms}, nil
+		case ms == s.lastID.ms && s.lastID.seq < math.MaxUint64:
+			return StreamID{ms: ms, seq: s.lastID.seq + 1}, nil
+		}
+
+		return StreamID{}, smallerError
+	}
+
+	id, ok := parseStreamID(arg, 0)
+	if !ok {
+		return StreamID{}, InvalidStreamIDError
+	}
+
+	if id == (StreamID{}) {
+		return StreamID{}, ErrorValue{Val: "ERR The ID specified in XADD must be greater than 0-0"}
+	}
+
+	if id.Compare(s.lastID) <= 0 {
+		return StreamID{}, smallerError
+	}
+
+	return id, nil
+}
+
+// streamTrim describes how XADD and XTRIM trim a stream: down to maxlen
+// entries, or evicting the entries with an ID lower than minid. At most limit
+// entries are evicted, unless limit is 0.
+type streamTrim struct {
+	strategy int
+	maxlen   int
+	minid    StreamID
+	limit    int
+}
+
+// Trim evicts the oldest entries as described by trim and returns how many it
+// evicted. Approximate trimming ("~") is always done exactly.
+func (s *Stream) Trim(trim streamTrim) int {
+	evict := 0
+
+	switch trim.strategy {
+	case STREAM_TRIM_MAXLEN:
+		evict = max(len(s.entries)-trim.maxlen, 0)
+	case STREAM_TRIM_MINID:
+		evict = s.search(trim.minid, false)
+	}
+
+	if trim.limit > 0 && evict > trim.limit {
+		evict = trim.limit
+	}
+
+	s.entries = s.entries[evict:]
+
+	return evict
+}
+
+// parseStreamTrim parses "MAXLEN|MINID [=|~] threshold [LIMIT count]" starting
+// at args[i] and returns the index of the first argument following it.
+func parseStreamTrim(args []Value, i int, trim *streamTrim) (int, Value) {
+	switch strings.ToUpper(args[i].(BulkStringValue).Val) {
+	case "MAXLEN":
+		trim.strategy = STREAM_TRIM_MAXLEN
+	case "MINID":
+		trim.strategy = STREAM_TRIM_MINID
+	default:
+		return i, SyntaxError
+	}
+	i++
+
+	approx := false
+	if i < len(args) {
+		switch args[i].(BulkStringValue).Val {
+		case "~":
+			approx = true
+			i++
+		case "=":
+			i++
+		}
+	}
+
+	if i >= len(args) {
+		return i, SyntaxError
+	}
+
+	threshold := args[i].(BulkStringValue).Val
+	i++
+
+	if trim.strategy == STREAM_TRIM_MAXLEN {
+		maxlen, err := strconv.Atoi(threshold)
+		if err != nil {
+			return i, NotIntegerError
+		}
+
+		if maxlen < 0 {
+			return i, ErrorValue{Val: "ERR The MAXLEN argument must be >= 0."}
+		}
+
+		trim.maxlen = maxlen
+	} else {
+		minid, ok := parseStreamID(threshold, 0)
+		if !ok {
+			return i, InvalidStreamIDError
+		}
+
+		trim.minid = minid
+	}
+
+	if i+1 < len(args) && strings.ToUpper(args[i].(BulkStringValue).Val) == "LIMIT" {
+		if !approx {
+			return i, ErrorValue{Val: "ERR syntax error, LIMIT cannot be used without the special ~ option"}
+		}
+
+		limit, err := strconv.Atoi(args[i+1].(BulkStringValue).Val)
+		if err != nil {
+			return i, NotIntegerError
+		}
+
+		if limit < 0 {
+			return i, ErrorValue{Val: "ERR The LIMIT argument must be >= 0."}
+		}
+
+		trim.limit = limit
+		i += 2
+	}
+
+	return i, nil
+}
+
+// lookupStream returns the stream stored at key, nil if the key doesn't exist,
+// or WrongTypeError if it holds something else.
+func lookupStream(key string) (*Stream, Value) {
+	obj, errValue := DB.LookupType(key, OBJ_STREAM)
+	if errValue != nil || obj == nil {
+		return nil, errValue
+	}
+
+	return obj.Data.(*Stream), nil
+}
+
+func streamEntryValue(entry StreamEntry) Value {
+	fields := make([]Value, len(entry.Fields))
+	for i, field := range entry.Fields {
+		fields[i] = BulkStringValue{Val: field}
+	}
+
+	return ArrayValue{Val: []Value{BulkStringValue{Val: entry.ID.String()}, ArrayValue{Val: fields}}}
+}
+
+func streamEntriesValue(entries []StreamEntry) Value {
+	array := make([]Value, len(entries))
+	for i, entry := range entries {
+		array[i] = streamEntryValue(entry)
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func xadd(args []Value, _ *Client) Value {
+	if len(args) < 4 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xadd' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	nomkstream := false
+	trim := streamTrim{strategy: STREAM_TRIM_NONE}
+
+	i := 1
+options:
+	for i < len(args) {
+		switch strings.ToUpper(args[i].(BulkStringValue).Val) {
+		case "NOMKSTREAM":
+			nomkstream = true
+			i++
+		case "MAXLEN", "MINID":
+			var errValue Value
+			if i, errValue = parseStreamTrim(args, i, &trim); errValue != nil {
+				return errValue
+			}
+		default:
+			break options
+		}
+	}
+
+	// What's left is the ID followed by the field value pairs.
+	if len(args)-i < 3 || (len(args)-i)%2 != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xadd' command"}
+	}
+
+	s, errValue := lookupStream(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	created := false
+	if s == nil {
+		if nomkstream {
+			preventCommandPropagation()
+			return NullValue{}
+		}
+
+		s = NewStream()
+		created = true
+	}
+
+	id, errValue := s.nextID(args[i].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if created {
+		DB.Set(key, &Object{Type: OBJ_STREAM, Data: s})
+	}
+
+	fields := make([]string, 0, len(args)-i-1)
+	for _, arg := range args[i+1:] {
+		fields = append(fields, arg.(BulkStringValue).Val)
+	}
+
+	s.Append(id, fields)
+	s.Trim(trim)
+
+	signalModifiedKey(key)
+	signalKeyAsReady(key)
+
+	// The AOF records the ID that was actually added, so replaying the command
+	// adds the same entry even if the ID was generated.
+	preventCommandPropagation()
+
+	propagation := append([]Value{BulkStringValue{Val: "XADD"}}, args...)
+	propagation[i+1] = BulkStringValue{Val: id.String()}
+	alsoPropagate(propagation...)
+
+	return BulkStringValue{Val: id.String()}
+}
+
+func xlen(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xlen' command"}
+	}
+
+	s, errValue := lookupStream(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if s == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	return IntegerValue{Val: s.Len()}
+}
+
+func xrange(args []Value, _ *Client) Value {
+	return xrangeGeneric(args, "xrange", false)
+}
+
+func xrevrange(args []Value, _ *Client) Value {
+	return xrangeGeneric(args, "xrevrange", true)
+}
+
+// xrangeGeneric implements XRANGE and XREVRANGE, the latter taking the end of
+// the interval first.
+func xrangeGeneric(args []Value, name string, reverse bool) Value {
+	if len(args) != 3 && len(args) != 5 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	startArg, endArg := args[1], args[2]
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, errValue := parseRangeStreamID(startArg, true)
+	if errValue != nil {
+		return errValue
+	}
+
+	end, errValue := parseRangeStreamID(endArg, false)
+	if errValue != nil {
+		return errValue
+	}
+
+	count := 0
+	if len(args) == 5 {
+		if strings.ToUpper(args[3].(BulkStringValue).Val) != "COUNT" {
+			return SyntaxError
+		}
+
+		n, err := strconv.Atoi(args[4].(BulkStringValue).Val)
+		if err != nil {
+			return NotIntegerError
+		}
+
+		if n <= 0 {
+			return ArrayValue{Val: []Value{}}
+		}
+
+		count = n
+	}
+
+	s, errValue := lookupStream(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if s == nil {
+		return ArrayValue{Val: []Value{}}
+	}
+
+	return streamEntriesValue(s.Range(start, end, count, reverse))
+}
+
+// parseStreamIDs parses a list of IDs, failing if any of them is invalid.
+func parseStreamIDs(args []Value) ([]StreamID, Value) {
+	ids := make([]StreamID, len(args))
+
+	for i, arg := range args {
+		id, ok := parseStreamID(arg.(BulkStringValue).Val, 0)
+		if !ok {
+			return nil, InvalidStreamIDError
+		}
+		ids[i] = id
+	}
+
+	return ids, nil
+}
+
+func xdel(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xdel' command"}
+	}
+
+	ids, errValue := parseStreamIDs(args[1:])
+	if errValue != nil {
+		return errValue
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	s, errValue := lookupStream(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if s == nil {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	// Unlike other types, a stream stays around once its last entry is deleted,
+	// so it keeps its last ID and consumer groups.
+	deleted := 0
+	for _, id := range ids {
+		if s.Delete(id) {
+			deleted++
+		}
+	}
+
+	if deleted == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	return IntegerValue{Val: deleted}
+}
+
+// xsetid sets the last ID of a stream, which can't be lower than the ID of its
+// last entry.
+func xsetid(args []Value, _ *Client) Value {
+	id, ok := parseStreamID(args[1].(BulkStringValue).Val, 0)
+	if !ok {
+		return InvalidStreamIDError
+	}
+
+	s, errValue := lookupStream(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if s == nil {
+		return ErrorValue{Val: "ERR no such key"}
+	}
+
+	if len(s.entries) > 0 && id.Compare(s.entries[len(s.entries)-1].ID) < 0 {
+		return ErrorValue{Val: "ERR The ID specified in XSETID is smaller than the target stream top item"}
+	}
+
+	s.lastID = id
+	signalModifiedKey(args[0].(BulkStringValue).Val)
+
+	return StringValue{Val: "OK"}
+}
+
+func xtrim(args []Value, _ *Client) Value {
+	if len(args) < 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xtrim' command"}
+	}
+
+	var trim streamTrim
+
+	next, errValue := parseStreamTrim(args, 1, &trim)
+	if errValue != nil {
+		return errValue
+	}
+
+	if next != len(args) {
+		return SyntaxError
+	}
+
+	s, errValue := lookupStream(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	evicted := 0
+	if s != nil {
+		evicted = s.Trim(trim)
+	}
+
+	if evicted == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(args[0].(BulkStringValue).Val)
+	}
+
+	return IntegerValue{Val: evicted}
+}
+
+// streamRead holds the arguments of XREAD and XREADGROUP.
+type streamRead struct {
+	count   int
+	block   bool
+	timeout time.Duration
+	// The options below are only accepted by XREADGROUP.
+	group    string
+	consumer string
+	noack    bool
+	keys     []string
+	ids      []string
+}
+
+// parseStreamRead parses "[GROUP group consumer] [COUNT count] [BLOCK ms]
+// [NOACK] STREAMS key [key ...] id [id ...]". GROUP and NOACK are only
+// accepted when withGroup is set.
+func parseStreamRead(args []Value, name string, withGroup bool) (streamRead, Value) {
+	var read streamRead
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].(BulkStringValue).Val)
+
+		switch {
+		case option == "COUNT" && i+1 < len(args):
+			count, err := strconv.Atoi(args[i+1].(BulkStringValue).Val)
+			if err != nil {
+				return read, NotIntegerError
+			}
+
+			read.count = max(count, 0)
+			i++
+		case option == "BLOCK" && i+1 < len(args):
+			ms, err := strconv.ParseInt(args[i+1].(BulkStringValue).Val, 10, 64)
+			if err != nil || ms > math.MaxInt64/int64(time.Millisecond) {
+				return read, ErrorValue{Val: "ERR timeout is not an integer or out of range"}
+			}
+
+			if ms < 0 {
+				return read, ErrorValue{Val: "ERR timeout is negative"}
+			}
+
+			read.block = true
+			read.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case withGroup && option == "GROUP" && i+2 < len(args):
+			read.group = args[i+1].(BulkStringValue).Val
+			read.consumer = args[i+2].(BulkStringValue).Val
+			i += 2
+		case withGroup && option == "NOACK":
+			read.noack = true
+		case option == "STREAMS" && i+1 < len(args):
+			rest := args[i+1:]
+			if len(rest)%2 != 0 {
+				expected := "'$'"
+				if withGroup {
+					expected = "'>'"
+				}
+
+				return read, ErrorValue{Val: "ERR Unbalanced '" + name + "' list of streams: for each stream key an ID or " + expected + " must be specified."}
+			}
+
+			read.keys = keysFromArgs(rest[:len(rest)/2])
+			read.ids = keysFromArgs(rest[len(rest)/2:])
+
+			if withGroup && read.group == "" {
+				return read, ErrorValue{Val: "ERR Missing GROUP option for XREADGROUP"}
+			}
+
+			return read, nil
+		default:
+			return read, SyntaxError
+		}
+	}
+
+	return read, SyntaxError
+}
+
+// indexOfKey returns the position of key in keys, which a blocked XREAD or
+// XREADGROUP uses to find the ID it's waiting after.
+func indexOfKey(keys []string, key string) int {
+	for i, k := range keys {
+		if k == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func xreadKeys(argv []Value) []string {
+	read, _ := parseStreamRead(argv[1:], "xread", false)
+	return read.keys
+}
+
+func xread(args []Value, client *Client) Value {
+	read, errValue := parseStreamRead(args, "xread", false)
+	if errValue != nil {
+		return errValue
+	}
+
+	// Resolve "$" now, so a blocked client only gets the entries added after it blocked.
+	ids := make([]StreamID, len(read.keys))
+	for i, key := range read.keys {
+		s, errValue := lookupStream(key)
+		if errValue != nil {
+			return errValue
+		}
+
+		if read.ids[i] == "$" {
+			if s != nil {
+				ids[i] = s.lastID
+			}
+			continue
+		}
+
+		id, ok := parseStreamID(read.ids[i], 0)
+		if !ok {
+			return InvalidStreamIDError
+		}
+		ids[i] = id
+	}
+
+	results := []Value{}
+	for i, key := range read.keys {
+		s, _ := lookupStream(key)
+		if s == nil {
+			continue
+		}
+
+		if entries := s.After(ids[i], read.count); len(entries) > 0 {
+			results = append(results, ArrayValue{Val: []Value{BulkStringValue{Val: key}, streamEntriesValue(entries)}})
+		}
+	}
+
+	if len(results) > 0 {
+		return ArrayValue{Val: results}
+	}
+
+	if !read.block || !canBlock(client) {
+		return NullArrayValue{}
+	}
+
+	serve := func(key string) (Value, bool) {
+		s, errValue := lookupStream(key)
+		if errValue != nil || s == nil {
+			return nil, false
+		}
+
+		entries := s.After(ids[indexOfKey(read.keys, key)], read.count)
+		if len(entries) == 0 {
+			return nil, false
+		}
+
+		return ArrayValue{Val: []Value{
+			ArrayValue{Val: []Value{BulkStringValue{Val: key}, streamEntriesValue(entries)}},
+		}}, true
+	}
+
+	blockForKeys(client, read.keys, read.timeout, serve)
+
+	return EmptyValue{}
+}
@@ -0,0 +1,892 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConsumerGroup delivers the entries of a stream to its consumers, each entry
+// going to a single consumer, and tracks the delivered entries that weren't
+// acknowledged yet in its pending entries list (PEL).
+type ConsumerGroup struct {
+	// lastID is the ID of the last entry delivered to the group.
+	lastID    StreamID
+	pel       map[StreamID]*PendingEntry
+	consumers map[string]*Consumer
+}
+
+type Consumer struct {
+	name string
+	// pel holds the subset of the group's pending entries owned by this consumer.
+	pel map[StreamID]*PendingEntry
+}
+
+type PendingEntry struct {
+	consumer      *Consumer
+	deliveryTime  int64
+	deliveryCount int64
+}
+
+func NewConsumerGroup(lastID StreamID) *ConsumerGroup {
+	return &ConsumerGroup{
+		lastID:    lastID,
+		pel:       make(map[StreamID]*PendingEntry),
+		consumers: make(map[string]*Consumer),
+	}
+}
+
+// lookupOrCreateConsumer returns the named consumer, creating it if needed,
+// and whether it was created.
+func (g *ConsumerGroup) lookupOrCreateConsumer(name string) (*Consumer, bool) {
+	if consumer, found := g.consumers[name]; found {
+		return consumer, false
+	}
+
+	consumer := &Consumer{name: name, pel: make(map[StreamID]*PendingEntry)}
+	g.consumers[name] = consumer
+
+	return consumer, true
+}
+
+// assign makes the consumer own the pending entry for id, taking it from its
+// previous owner or creating it.
+func (g *ConsumerGroup) assign(id StreamID, consumer *Consumer) *PendingEntry {
+	pe, found := g.pel[id]
+	if !found {
+		pe = &PendingEntry{}
+		g.pel[id] = pe
+	} else {
+		delete(pe.consumer.pel, id)
+	}
+
+	pe.consumer = consumer
+	consumer.pel[id] = pe
+
+	return pe
+}
+
+// ack removes the entry from the PEL, returning false if it wasn't pending.
+func (g *ConsumerGroup) ack(id StreamID) bool {
+	pe, found := g.pel[id]
+	if !found {
+		return false
+	}
+
+	delete(pe.consumer.pel, id)
+	delete(g.pel, id)
+
+	return true
+}
+
+// sortedPendingIDs returns the IDs of the pending entries in the PEL in order.
+func sortedPendingIDs(pel map[StreamID]*PendingEntry) []StreamID {
+	ids := make([]StreamID, 0, len(pel))
+	for id := range pel {
+		ids = append(ids, id)
+	}
+
+	slices.SortFunc(ids, StreamID.Compare)
+
+	return ids
+}
+
+// lookupStreamGroup returns the stream stored at key and its named consumer
+// group, either of them being nil if it doesn't exist.
+func lookupStreamGroup(key, group string) (*Stream, *ConsumerGroup, Value) {
+	s, errValue := lookupStream(key)
+	if errValue != nil || s == nil {
+		return nil, nil, errValue
+	}
+
+	return s, s.groups[group], nil
+}
+
+func noGroupError(key, group string) Value {
+	return ErrorValue{Val: "NOGROUP No such key '" + key + "' or consumer group '" + group + "'"}
+}
+
+// propagateStreamClaim appends an XCLAIM to the AOF that gives the pending
+// entry to its consumer with its delivery time and count, so replaying it
+// rebuilds the PEL exactly whenever the replay happens.
+func propagateStreamClaim(key, group string, g *ConsumerGroup, id StreamID, pe *PendingEntry) {
+	argv := streamClaimArgs(key, group, g, id, pe)
+
+	args := make([]Value, len(argv))
+	for i, arg := range argv {
+		args[i] = BulkStringValue{Val: arg}
+	}
+
+	alsoPropagate(args...)
+}
+
+// streamClaimArgs returns the XCLAIM that rebuilds a pending entry, see
+// propagateStreamClaim.
+func streamClaimArgs(key, group string, g *ConsumerGroup, id StreamID, pe *PendingEntry) []string {
+	return []string{
+		"XCLAIM", key, group, pe.consumer.name, "0", id.String(),
+		"TIME", strconv.FormatInt(pe.deliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatInt(pe.deliveryCount, 10),
+		"FORCE", "JUSTID",
+		"LASTID", g.lastID.String(),
+	}
+}
+
+// propagateStreamAck appends an XACK to the AOF for an entry dropped from the
+// PEL because it was deleted from the stream.
+func propagateStreamAck(key, group string, id StreamID) {
+	alsoPropagate(BulkStringValue{Val: "XACK"}, BulkStringValue{Val: key}, BulkStringValue{Val: group}, BulkStringValue{Val: id.String()})
+}
+
+func xgroup(args []Value, _ *Client) Value {
+	if len(args) < 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xgroup' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].(BulkStringValue).Val)
+
+	arity := map[string]int{"CREATE": 4, "SETID": 4, "DESTROY": 3, "CREATECONSUMER": 4, "DELCONSUMER": 4}
+	expected, found := arity[subcommand]
+	if !found {
+		return ErrorValue{Val: "ERR unknown subcommand '" + args[0].(BulkStringValue).Val + "'"}
+	}
+
+	// CREATE also accepts MKSTREAM.
+	if len(args) != expected && !(subcommand == "CREATE" && len(args) == expected+1) {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xgroup|" + strings.ToLower(subcommand) + "' command"}
+	}
+
+	key := args[1].(BulkStringValue).Val
+	group := args[2].(BulkStringValue).Val
+
+	mkstream := false
+	if len(args) == 5 {
+		if strings.ToUpper(args[4].(BulkStringValue).Val) != "MKSTREAM" {
+			return SyntaxError
+		}
+		mkstream = true
+	}
+
+	s, g, errValue := lookupStreamGroup(key, group)
+	if errValue != nil {
+		return errValue
+	}
+
+	if s == nil && !mkstream {
+		return ErrorValue{Val: "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."}
+	}
+
+	if g == nil && subcommand != "CREATE" && subcommand != "DESTROY" {
+		return ErrorValue{Val: "NOGROUP No such consumer group '" + group + "' for key name '" + key + "'"}
+	}
+
+	// parseGroupID parses the ID of CREATE and SETID, where "$" is the last ID of the stream.
+	parseGroupID := func(arg Value) (StreamID, Value) {
+		if arg.(BulkStringValue).Val == "$" {
+			if s == nil {
+				return StreamID{}, nil
+			}
+			return s.lastID, nil
+		}
+
+		id, ok := parseStreamID(arg.(BulkStringValue).Val, 0)
+		if !ok {
+			return StreamID{}, InvalidStreamIDError
+		}
+
+		return id, nil
+	}
+
+	switch subcommand {
+	case "CREATE":
+		id, errValue := parseGroupID(args[3])
+		if errValue != nil {
+			return errValue
+		}
+
+		if g != nil {
+			return ErrorValue{Val: "BUSYGROUP Consumer Group name already exists"}
+		}
+
+		if s == nil {
+			s = NewStream()
+			DB.Set(key, &Object{Type: OBJ_STREAM, Data: s})
+		}
+
+		s.groups[group] = NewConsumerGroup(id)
+		signalModifiedKey(key)
+
+		return StringValue{Val: "OK"}
+	case "SETID":
+		id, errValue := parseGroupID(args[3])
+		if errValue != nil {
+			return errValue
+		}
+
+		g.lastID = id
+		signalModifiedKey(key)
+
+		return StringValue{Val: "OK"}
+	case "DESTROY":
+		if g == nil {
+			preventCommandPropagation()
+			return IntegerValue{Val: 0}
+		}
+
+		delete(s.groups, group)
+		signalModifiedKey(key)
+
+		return IntegerValue{Val: 1}
+	case "CREATECONSUMER":
+		if _, created := g.lookupOrCreateConsumer(args[3].(BulkStringValue).Val); created {
+			signalModifiedKey(key)
+			return IntegerValue{Val: 1}
+		}
+
+		preventCommandPropagation()
+
+		return IntegerValue{Val: 0}
+	case "DELCONSUMER":
+		consumer, found := g.consumers[args[3].(BulkStringValue).Val]
+		if !found {
+			preventCommandPropagation()
+			return IntegerValue{Val: 0}
+		}
+
+		// The consumer's pending entries are dropped with it.
+		pending := len(consumer.pel)
+		for id := range consumer.pel {
+			g.ack(id)
+		}
+
+		delete(g.consumers, consumer.name)
+		signalModifiedKey(key)
+
+		return IntegerValue{Val: pending}
+	}
+
+	return nil
+}
+
+// streamDeliverNew delivers the entries the group hasn't delivered yet to the
+// consumer, adding them to the PEL unless noack is set.
+func streamDeliverNew(key, group string, s *Stream, g *ConsumerGroup, consumer *Consumer, count int, noack bool) []StreamEntry {
+	entries := s.After(g.lastID, count)
+	now := nowMs()
+
+	for _, entry := range entries {
+		g.lastID = entry.ID
+
+		if noack {
+			continue
+		}
+
+		pe := g.assign(entry.ID, consumer)
+		pe.deliveryTime = now
+		pe.deliveryCount = 1
+
+		propagateStreamClaim(key, group, g, entry.ID, pe)
+	}
+
+	if len(entries) > 0 {
+		signalModifiedKey(key)
+	}
+
+	if noack && len(entries) > 0 {
+		alsoPropagate(
+			BulkStringValue{Val: "XGROUP"},
+			BulkStringValue{Val: "SETID"},
+			BulkStringValue{Val: key},
+			BulkStringValue{Val: group},
+			BulkStringValue{Val: g.lastID.String()},
+		)
+	}
+
+	return entries
+}
+
+// streamDeliverHistory delivers again the consumer's pending entries with an
+// ID greater than id. Entries deleted from the stream since are replied with
+// nil fields.
+func streamDeliverHistory(key, group string, s *Stream, g *ConsumerGroup, consumer *Consumer, id StreamID, count int) Value {
+	array := []Value{}
+	now := nowMs()
+
+	for _, pendingID := range sortedPendingIDs(consumer.pel) {
+		if pendingID.Compare(id) <= 0 {
+			continue
+		}
+
+		if count > 0 && len(array) == count {
+			break
+		}
+
+		entry, found := s.Lookup(pendingID)
+		if !found {
+			array = append(array, ArrayValue{Val: []Value{BulkStringValue{Val: pendingID.String()}, NullArrayValue{}}})
+			continue
+		}
+
+		pe := consumer.pel[pendingID]
+		pe.deliveryTime = now
+		pe.deliveryCount++
+		signalModifiedKey(key)
+
+		propagateStreamClaim(key, group, g, pendingID, pe)
+
+		array = append(array, streamEntryValue(entry))
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// xreadgroup reads on behalf of a consumer: the ID ">" gets the entries never
+// delivered to the group, blocking if there are none, while any other ID gets
+// the consumer's pending entries after it. Deliveries are logged to the AOF as
+// XCLAIMs rather than the command itself, which depends on when it runs.
+func xreadgroupKeys(argv []Value) []string {
+	read, _ := parseStreamRead(argv[1:], "xreadgroup", true)
+	return read.keys
+}
+
+func xreadgroup(args []Value, client *Client) Value {
+	read, errValue := parseStreamRead(args, "xreadgroup", true)
+	if errValue != nil {
+		return errValue
+	}
+
+	ids := make([]StreamID, len(read.keys))
+	for i, key := range read.keys {
+		_, g, errValue := lookupStreamGroup(key, read.group)
+		if errValue != nil {
+			return errValue
+		}
+
+		if g == nil {
+			return ErrorValue{Val: "NOGROUP No such key '" + key + "' or consumer group '" + read.group + "' in XREADGROUP with GROUP option"}
+		}
+
+		switch read.ids[i] {
+		case ">":
+			continue
+		case "$":
+			return ErrorValue{Val: "ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set."}
+		}
+
+		id, ok := parseStreamID(read.ids[i], 0)
+		if !ok {
+			return InvalidStreamIDError
+		}
+		ids[i] = id
+	}
+
+	preventCommandPropagation()
+
+	results := []Value{}
+	for i, key := range read.keys {
+		s, g, _ := lookupStreamGroup(key, read.group)
+
+		consumer, created := g.lookupOrCreateConsumer(read.consumer)
+		if created {
+			signalModifiedKey(key)
+			alsoPropagate(
+				BulkStringValue{Val: "XGROUP"},
+				BulkStringValue{Val: "CREATECONSUMER"},
+				BulkStringValue{Val: key},
+				BulkStringValue{Val: read.group},
+				BulkStringValue{Val: read.consumer},
+			)
+		}
+
+		if read.ids[i] != ">" {
+			history := streamDeliverHistory(key, read.group, s, g, consumer, ids[i], read.count)
+			results = append(results, ArrayValue{Val: []Value{BulkStringValue{Val: key}, history}})
+			continue
+		}
+
+		if entries := streamDeliverNew(key, read.group, s, g, consumer, read.count, read.noack); len(entries) > 0 {
+			results = append(results, ArrayValue{Val: []Value{BulkStringValue{Val: key}, streamEntriesValue(entries)}})
+		}
+	}
+
+	if len(results) > 0 {
+		return ArrayValue{Val: results}
+	}
+
+	if !read.block || !canBlock(client) {
+		return NullArrayValue{}
+	}
+
+	serve := func(key string) (Value, bool) {
+		s, g, errValue := lookupStreamGroup(key, read.group)
+		if errValue != nil || s == nil {
+			return nil, false
+		}
+
+		if g == nil {
+			return ErrorValue{Val: "NOGROUP the consumer group this client was blocked on no longer exists"}, true
+		}
+
+		consumer, _ := g.lookupOrCreateConsumer(read.consumer)
+
+		entries := streamDeliverNew(key, read.group, s, g, consumer, read.count, read.noack)
+		if len(entries) == 0 {
+			return nil, false
+		}
+
+		return ArrayValue{Val: []Value{
+			ArrayValue{Val: []Value{BulkStringValue{Val: key}, streamEntriesValue(entries)}},
+		}}, true
+	}
+
+	blockForKeys(client, read.keys, read.timeout, serve)
+
+	return EmptyValue{}
+}
+
+func xack(args []Value, _ *Client) Value {
+	if len(args) < 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xack' command"}
+	}
+
+	ids, errValue := parseStreamIDs(args[2:])
+	if errValue != nil {
+		return errValue
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	_, g, errValue := lookupStreamGroup(key, args[1].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if g == nil {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+
+	if acked == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	return IntegerValue{Val: acked}
+}
+
+// xpending replies with a summary of the group's PEL, or with the pending
+// entries in a range when given one.
+func xpending(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xpending' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+	group := args[1].(BulkStringValue).Val
+
+	var minIdle int64
+	rest := args[2:]
+
+	if len(rest) > 0 && strings.ToUpper(rest[0].(BulkStringValue).Val) == "IDLE" {
+		if len(rest) < 2 {
+			return SyntaxError
+		}
+
+		idle, err := strconv.ParseInt(rest[1].(BulkStringValue).Val, 10, 64)
+		if err != nil {
+			return NotIntegerError
+		}
+
+		minIdle = idle
+		rest = rest[2:]
+
+		if len(rest) == 0 {
+			return SyntaxError
+		}
+	}
+
+	if len(rest) != 0 && len(rest) != 3 && len(rest) != 4 {
+		return SyntaxError
+	}
+
+	var start, end StreamID
+	var count int
+
+	if len(rest) > 0 {
+		var errValue Value
+
+		if start, errValue = parseRangeStreamID(rest[0], true); errValue != nil {
+			return errValue
+		}
+
+		if end, errValue = parseRangeStreamID(rest[1], false); errValue != nil {
+			return errValue
+		}
+
+		n, err := strconv.Atoi(rest[2].(BulkStringValue).Val)
+		if err != nil {
+			return NotIntegerError
+		}
+
+		count = max(n, 0)
+	}
+
+	_, g, errValue := lookupStreamGroup(key, group)
+	if errValue != nil {
+		return errValue
+	}
+
+	if g == nil {
+		return noGroupError(key, group)
+	}
+
+	if len(rest) == 0 {
+		return streamPendingSummary(g)
+	}
+
+	pel := g.pel
+	if len(rest) == 4 {
+		consumer, found := g.consumers[rest[3].(BulkStringValue).Val]
+		if !found {
+			return ArrayValue{Val: []Value{}}
+		}
+		pel = consumer.pel
+	}
+
+	now := nowMs()
+	array := []Value{}
+
+	for _, id := range sortedPendingIDs(pel) {
+		if len(array) == count || id.Compare(end) > 0 {
+			break
+		}
+
+		pe := pel[id]
+		idle := now - pe.deliveryTime
+
+		if id.Compare(start) < 0 || idle < minIdle {
+			continue
+		}
+
+		array = append(array, ArrayValue{Val: []Value{
+			BulkStringValue{Val: id.String()},
+			BulkStringValue{Val: pe.consumer.name},
+			IntegerValue{Val: int(idle)},
+			IntegerValue{Val: int(pe.deliveryCount)},
+		}})
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// streamPendingSummary replies with the number of pending entries, the lowest
+// and greatest pending IDs, and how many entries each consumer has pending.
+func streamPendingSummary(g *ConsumerGroup) Value {
+	if len(g.pel) == 0 {
+		return ArrayValue{Val: []Value{IntegerValue{Val: 0}, NullValue{}, NullValue{}, NullArrayValue{}}}
+	}
+
+	ids := sortedPendingIDs(g.pel)
+
+	names := make([]string, 0, len(g.consumers))
+	for name, consumer := range g.consumers {
+		if len(consumer.pel) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	consumers := make([]Value, len(names))
+	for i, name := range names {
+		consumers[i] = ArrayValue{Val: []Value{
+			BulkStringValue{Val: name},
+			BulkStringValue{Val: strconv.Itoa(len(g.consumers[name].pel))},
+		}}
+	}
+
+	return ArrayValue{Val: []Value{
+		IntegerValue{Val: len(ids)},
+		BulkStringValue{Val: ids[0].String()},
+		BulkStringValue{Val: ids[len(ids)-1].String()},
+		ArrayValue{Val: consumers},
+	}}
+}
+
+// streamClaim gives the pending entry to the consumer, propagating the change
+// to the AOF. The delivery count is incremented unless justID is set.
+func streamClaim(key, group string, g *ConsumerGroup, consumer *Consumer, id StreamID, deliveryTime int64, retryCount int64, justID bool) {
+	pe := g.assign(id, consumer)
+	pe.deliveryTime = deliveryTime
+
+	switch {
+	case retryCount >= 0:
+		pe.deliveryCount = retryCount
+	case !justID:
+		pe.deliveryCount++
+	}
+
+	signalModifiedKey(key)
+	propagateStreamClaim(key, group, g, id, pe)
+}
+
+// xclaim transfers pending entries idle for at least min-idle-time to another
+// consumer. Each claim is logged to the AOF as its own XCLAIM with an absolute
+// delivery time, so replaying it doesn't depend on the time.
+func xclaim(args []Value, _ *Client) Value {
+	if len(args) < 5 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xclaim' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+	group := args[1].(BulkStringValue).Val
+	consumerName := args[2].(BulkStringValue).Val
+
+	minIdle, err := strconv.ParseInt(args[3].(BulkStringValue).Val, 10, 64)
+	if err != nil {
+		return ErrorValue{Val: "ERR Invalid min-idle-time argument for XCLAIM"}
+	}
+
+	// The IDs come first, the options start at the first argument that isn't one.
+	i := 4
+	ids := []StreamID{}
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i].(BulkStringValue).Val, 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := nowMs()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID *StreamID
+
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].(BulkStringValue).Val)
+		hasValue := i+1 < len(args)
+
+		switch {
+		case option == "FORCE":
+			force = true
+		case option == "JUSTID":
+			justID = true
+		case option == "IDLE" && hasValue:
+			idle, err := strconv.ParseInt(args[i+1].(BulkStringValue).Val, 10, 64)
+			if err != nil {
+				return ErrorValue{Val: "ERR Invalid IDLE option argument for XCLAIM"}
+			}
+			deliveryTime = now - idle
+			i++
+		case option == "TIME" && hasValue:
+			ms, err := strconv.ParseInt(args[i+1].(BulkStringValue).Val, 10, 64)
+			if err != nil {
+				return ErrorValue{Val: "ERR Invalid TIME option argument for XCLAIM"}
+			}
+			deliveryTime = ms
+			i++
+		case option == "RETRYCOUNT" && hasValue:
+			count, err := strconv.ParseInt(args[i+1].(BulkStringValue).Val, 10, 64)
+			if err != nil || count < 0 {
+				return ErrorValue{Val: "ERR Invalid RETRYCOUNT option argument for XCLAIM"}
+			}
+			retryCount = count
+			i++
+		case option == "LASTID" && hasValue:
+			id, ok := parseStreamID(args[i+1].(BulkStringValue).Val, 0)
+			if !ok {
+				return InvalidStreamIDError
+			}
+			lastID = &id
+			i++
+		default:
+			return ErrorValue{Val: "ERR Unrecognized XCLAIM option '" + args[i].(BulkStringValue).Val + "'"}
+		}
+	}
+
+	// A delivery time in the future would make the entry look negatively idle.
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	s, g, errValue := lookupStreamGroup(key, group)
+	if errValue != nil {
+		return errValue
+	}
+
+	if g == nil {
+		return noGroupError(key, group)
+	}
+
+	preventCommandPropagation()
+
+	lastIDPropagated := true
+	if lastID != nil && lastID.Compare(g.lastID) > 0 {
+		g.lastID = *lastID
+		lastIDPropagated = false
+		signalModifiedKey(key)
+	}
+
+	var consumer *Consumer
+	array := []Value{}
+
+	for _, id := range ids {
+		pe, pending := g.pel[id]
+		entry, exists := s.Lookup(id)
+
+		if !exists {
+			// The entry was deleted from the stream, so there's nothing left to claim.
+			if pending {
+				g.ack(id)
+				signalModifiedKey(key)
+				propagateStreamAck(key, group, id)
+			}
+			continue
+		}
+
+		if !pending && !force {
+			continue
+		}
+
+		if pending && minIdle > 0 && now-pe.deliveryTime < minIdle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer, _ = g.lookupOrCreateConsumer(consumerName)
+		}
+
+		streamClaim(key, group, g, consumer, id, deliveryTime, retryCount, justID)
+		lastIDPropagated = true
+
+		if justID {
+			array = append(array, BulkStringValue{Val: id.String()})
+		} else {
+			array = append(array, streamEntryValue(entry))
+		}
+	}
+
+	if !lastIDPropagated {
+		alsoPropagate(
+			BulkStringValue{Val: "XGROUP"},
+			BulkStringValue{Val: "SETID"},
+			BulkStringValue{Val: key},
+			BulkStringValue{Val: group},
+			BulkStringValue{Val: g.lastID.String()},
+		)
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// xautoclaim scans the PEL from start and claims up to count entries idle for
+// at least min-idle-time. It replies with the ID to resume the scan from (0-0
+// once done), the claimed entries, and the IDs of the pending entries it found
+// deleted from the stream, which are dropped from the PEL.
+func xautoclaim(args []Value, _ *Client) Value {
+	if len(args) < 5 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'xautoclaim' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+	group := args[1].(BulkStringValue).Val
+	consumerName := args[2].(BulkStringValue).Val
+
+	minIdle, err := strconv.ParseInt(args[3].(BulkStringValue).Val, 10, 64)
+	if err != nil {
+		return ErrorValue{Val: "ERR Invalid min-idle-time argument for XAUTOCLAIM"}
+	}
+
+	start, errValue := parseRangeStreamID(args[4], true)
+	if errValue != nil {
+		return errValue
+	}
+
+	count := 100
+	justID := false
+
+	for i := 5; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].(BulkStringValue).Val); {
+		case option == "JUSTID":
+			justID = true
+		case option == "COUNT" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1].(BulkStringValue).Val)
+			if err != nil || n < 1 || n > 1<<20 {
+				return ErrorValue{Val: "ERR COUNT must be > 0"}
+			}
+			count = n
+			i++
+		default:
+			return SyntaxError
+		}
+	}
+
+	s, g, errValue := lookupStreamGroup(key, group)
+	if errValue != nil {
+		return errValue
+	}
+
+	if g == nil {
+		return noGroupError(key, group)
+	}
+
+	preventCommandPropagation()
+
+	now := nowMs()
+	ids := sortedPendingIDs(g.pel)
+
+	// Bound the work done on a PEL full of entries that aren't idle enough.
+	attempts := count * 10
+
+	var consumer *Consumer
+	claimed, deleted := []Value{}, []Value{}
+
+	i := sort.Search(len(ids), func(i int) bool { return ids[i].Compare(start) >= 0 })
+	for ; i < len(ids) && attempts > 0 && len(claimed) < count; i++ {
+		attempts--
+
+		id := ids[i]
+
+		entry, exists := s.Lookup(id)
+		if !exists {
+			g.ack(id)
+			signalModifiedKey(key)
+			propagateStreamAck(key, group, id)
+			deleted = append(deleted, BulkStringValue{Val: id.String()})
+			continue
+		}
+
+		if now-g.pel[id].deliveryTime < minIdle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer, _ = g.lookupOrCreateConsumer(consumerName)
+		}
+
+		streamClaim(key, group, g, consumer, id, now, -1, justID)
+
+		if justID {
+			claimed = append(claimed, BulkStringValue{Val: id.String()})
+		} else {
+			claimed = append(claimed, streamEntryValue(entry))
+		}
+	}
+
+	next := StreamID{}
+	if i < len(ids) {
+		next = ids[i]
+	}
+
+	return ArrayValue{Val: []Value{BulkStringValue{Val: next.String()}, ArrayValue{Val: claimed}, ArrayValue{Val: deleted}}}
+}
@@ -1,19 +1,113 @@
 package main
 
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Strings can't grow past 512MB, like in Redis.
+const maxStringLength = 512 * 1024 * 1024
+
 func set(args []Value, _ *Client) Value {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return ErrorValue{Val: "ERR wrong number of arguments for 'set' command"}
 	}
 
 	key := args[0].(BulkStringValue).Val
 	value := args[1].(BulkStringValue).Val
 
-	SETsMutex.Lock()
-	defer SETsMutex.Unlock()
+	var nx, xx, returnOld, keepTTL, hasExpire bool
+	var when int64
 
-	SETs[key] = value
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].(BulkStringValue).Val); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			returnOld = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || i+1 >= len(args) {
+				return SyntaxError
+			}
+			i++
 
-	return StringValue{Val: "OK"}
+			n, err := strconv.ParseInt(args[i].(BulkStringValue).Val, 10, 64)
+			if err != nil {
+				return NotIntegerError
+			}
+
+			if n <= 0 {
+				return ErrorValue{Val: "ERR invalid expire time in 'set' command"}
+			}
+
+			var ok bool
+			switch option {
+			case "EX":
+				when, ok = toAbsoluteMs(n, 1000, nowMs())
+			case "PX":
+				when, ok = toAbsoluteMs(n, 1, nowMs())
+			case "EXAT":
+				when, ok = toAbsoluteMs(n, 1000, 0)
+			case "PXAT":
+				when, ok = n, true
+			}
+
+			if !ok {
+				return ErrorValue{Val: "ERR invalid expire time in 'set' command"}
+			}
+
+			hasExpire = true
+		default:
+			return SyntaxError
+		}
+	}
+
+	if (nx && xx) || (keepTTL && hasExpire) {
+		return SyntaxError
+	}
+
+	obj, errValue := DB.LookupType(key, OBJ_STRING)
+
+	// SET overwrites values of any type, unless GET needs to return the old one.
+	if errValue != nil && returnOld {
+		return errValue
+	}
+
+	var reply Value = StringValue{Val: "OK"}
+	if returnOld {
+		reply = NullValue{}
+		if obj != nil {
+			reply = BulkStringValue{Val: obj.Data.(string)}
+		}
+	}
+
+	found := DB.Exists(key)
+
+	if (nx && found) || (xx && !found) {
+		preventCommandPropagation()
+
+		if returnOld {
+			return reply
+		}
+		return NullValue{}
+	}
+
+	if keepTTL {
+		DB.SetKeepTTL(key, &Object{Type: OBJ_STRING, Data: value})
+	} else {
+		DB.Set(key, &Object{Type: OBJ_STRING, Data: value})
+	}
+
+	if hasExpire {
+		DB.SetExpire(key, when)
+	}
+
+	return reply
 }
 
 func get(args []Value, _ *Client) Value {
@@ -23,30 +117,468 @@ func get(args []Value, _ *Client) Value {
 
 	key := args[0].(BulkStringValue).Val
 
-	SETsMutex.RLock()
-	defer SETsMutex.RUnlock()
+	obj, errValue := DB.LookupType(key, OBJ_STRING)
+	if errValue != nil {
+		return errValue
+	}
+
+	if obj == nil {
+		return NullValue{}
+	}
+
+	return BulkStringValue{Val: obj.Data.(string)}
+}
 
-	if value, found := SETs[key]; found {
-		return BulkStringValue{Val: value}
+// lookupString returns the string stored at key and whether the key exists, or
+// WrongTypeError if it holds something else.
+func lookupString(key string) (string, bool, Value) {
+	obj, errValue := DB.LookupType(key, OBJ_STRING)
+	if errValue != nil || obj == nil {
+		return "", false, errValue
+	}
+
+	return obj.Data.(string), true, nil
+}
+
+// parseStrictInt parses a 64 bit integer the way Redis reads counters and
+// their increments, which rejects anything that doesn't format back to itself,
+// e.g. "+1", "01" or " 1".
+func parseStrictInt(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func incr(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'incr' command"}
 	}
 
-	return NullValue{}
+	return incrDecrGeneric(args[0].(BulkStringValue).Val, 1)
 }
 
-func del(args []Value, _ *Client) Value {
+func decr(args []Value, _ *Client) Value {
 	if len(args) != 1 {
-		return ErrorValue{Val: "ERR wrong number of arguments for 'del' command"}
+		return ErrorValue{Val: "ERR wrong number of arguments for 'decr' command"}
+	}
+
+	return incrDecrGeneric(args[0].(BulkStringValue).Val, -1)
+}
+
+func incrby(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'incrby' command"}
+	}
+
+	increment, ok := parseStrictInt(args[1].(BulkStringValue).Val)
+	if !ok {
+		return NotIntegerError
+	}
+
+	return incrDecrGeneric(args[0].(BulkStringValue).Val, increment)
+}
+
+func decrby(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'decrby' command"}
+	}
+
+	decrement, ok := parseStrictInt(args[1].(BulkStringValue).Val)
+	if !ok {
+		return NotIntegerError
+	}
+
+	if decrement == math.MinInt64 {
+		return ErrorValue{Val: "ERR decrement would overflow"}
+	}
+
+	return incrDecrGeneric(args[0].(BulkStringValue).Val, -decrement)
+}
+
+// incrDecrGeneric adds increment to the integer stored at key, a missing key
+// counting as 0. The key keeps its expiration.
+func incrDecrGeneric(key string, increment int64) Value {
+	value, found, errValue := lookupString(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	var current int64
+	if found {
+		var ok bool
+		if current, ok = parseStrictInt(value); !ok {
+			return NotIntegerError
+		}
+	}
+
+	if (increment > 0 && current > math.MaxInt64-increment) || (increment < 0 && current < math.MinInt64-increment) {
+		return ErrorValue{Val: "ERR increment or decrement would overflow"}
+	}
+
+	current += increment
+
+	DB.SetKeepTTL(key, &Object{Type: OBJ_STRING, Data: strconv.FormatInt(current, 10)})
+
+	return IntegerValue{Val: int(current)}
+}
+
+// formatIncrFloat formats the result of INCRBYFLOAT and HINCRBYFLOAT like
+// Redis, which uses %.17Lg: the exponent notation is only used past 17
+// digits. The shortest representation of the float64 stands in for the
+// digits of the long double Redis computes with.
+func formatIncrFloat(f float64) string {
+	exponent := strconv.FormatFloat(f, 'e', -1, 64)
+	if exp, _ := strconv.Atoi(exponent[strings.IndexByte(exponent, 'e')+1:]); exp < -4 || exp >= 17 {
+		return exponent
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func incrbyfloat(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'incrbyfloat' command"}
 	}
 
 	key := args[0].(BulkStringValue).Val
 
-	SETsMutex.Lock()
-	defer SETsMutex.Unlock()
+	increment, err := strconv.ParseFloat(args[1].(BulkStringValue).Val, 64)
+	if err != nil {
+		return ErrorValue{Val: "ERR value is not a valid float"}
+	}
+
+	value, found, errValue := lookupString(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	var current float64
+	if found {
+		if current, err = strconv.ParseFloat(value, 64); err != nil {
+			return ErrorValue{Val: "ERR value is not a valid float"}
+		}
+	}
+
+	current += increment
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return ErrorValue{Val: "ERR increment would produce NaN or Infinity"}
+	}
+
+	result := formatIncrFloat(current)
+
+	DB.SetKeepTTL(key, &Object{Type: OBJ_STRING, Data: result})
+
+	// Floating point results may differ between platforms, so the AOF records
+	// the resulting value instead of the increment.
+	preventCommandPropagation()
+	alsoPropagate(BulkStringValue{Val: "SET"}, BulkStringValue{Val: key}, BulkStringValue{Val: result}, BulkStringValue{Val: "KEEPTTL"})
+
+	return BulkStringValue{Val: result}
+}
+
+func appendCommand(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'append' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	value, _, errValue := lookupString(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	value += args[1].(BulkStringValue).Val
+	if len(value) > maxStringLength {
+		return ErrorValue{Val: "ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+	}
+
+	DB.SetKeepTTL(key, &Object{Type: OBJ_STRING, Data: value})
+
+	return IntegerValue{Val: len(value)}
+}
+
+func strlen(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'strlen' command"}
+	}
+
+	value, _, errValue := lookupString(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	return IntegerValue{Val: len(value)}
+}
+
+func getrange(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'getrange' command"}
+	}
+
+	start, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	end, err := strconv.Atoi(args[2].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	value, _, errValue := lookupString(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	// Negative offsets count from the end of the string, like in LRANGE.
+	length := len(value)
+	if start < 0 && end < 0 && start > end {
+		return BulkStringValue{Val: ""}
+	}
+	if start < 0 {
+		start = max(start+length, 0)
+	}
+	if end < 0 {
+		end = max(end+length, 0)
+	}
+	if end >= length {
+		end = length - 1
+	}
+
+	if length == 0 || start > end {
+		return BulkStringValue{Val: ""}
+	}
+
+	return BulkStringValue{Val: value[start : end+1]}
+}
+
+func setrange(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'setrange' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+	patch := args[2].(BulkStringValue).Val
+
+	offset, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	if offset < 0 {
+		return ErrorValue{Val: "ERR offset is out of range"}
+	}
+
+	value, found, errValue := lookupString(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	// Nothing to write leaves the key as is, and doesn't create it.
+	if len(patch) == 0 {
+		preventCommandPropagation()
+		return IntegerValue{Val: len(value)}
+	}
+
+	if offset > maxStringLength-len(patch) {
+		return ErrorValue{Val: "ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+	}
+
+	// The string is zero-padded if the offset is past its end.
+	buf := []byte(value)
+	if len(buf) < offset+len(patch) {
+		buf = append(buf, make([]byte, offset+len(patch)-len(buf))...)
+	}
+	copy(buf[offset:], patch)
+
+	if found {
+		DB.SetKeepTTL(key, &Object{Type: OBJ_STRING, Data: string(buf)})
+	} else {
+		DB.Set(key, &Object{Type: OBJ_STRING, Data: string(buf)})
+	}
+
+	return IntegerValue{Val: len(buf)}
+}
+
+func getset(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'getset' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	value, found, errValue := lookupString(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	DB.Set(key, &Object{Type: OBJ_STRING, Data: args[1].(BulkStringValue).Val})
+
+	if !found {
+		return NullValue{}
+	}
+
+	return BulkStringValue{Val: value}
+}
+
+func getdel(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'getdel' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	value, found, errValue := lookupString(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if !found {
+		preventCommandPropagation()
+		return NullValue{}
+	}
+
+	DB.Delete(key)
+
+	return BulkStringValue{Val: value}
+}
+
+// getex gets the value of a key and optionally changes its expiration. The AOF
+// records the expiration change as a PEXPIREAT or PERSIST, or nothing at all
+// for a plain read.
+func getex(args []Value, _ *Client) Value {
+	if len(args) < 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'getex' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	var persist, hasExpire bool
+	var when int64
+
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].(BulkStringValue).Val); option {
+		case "PERSIST":
+			if persist || hasExpire {
+				return SyntaxError
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if persist || hasExpire || i+1 >= len(args) {
+				return SyntaxError
+			}
+			i++
+
+			n, err := strconv.ParseInt(args[i].(BulkStringValue).Val, 10, 64)
+			if err != nil {
+				return NotIntegerError
+			}
+
+			if n <= 0 {
+				return ErrorValue{Val: "ERR invalid expire time in 'getex' command"}
+			}
+
+			var ok bool
+			switch option {
+			case "EX":
+				when, ok = toAbsoluteMs(n, 1000, nowMs())
+			case "PX":
+				when, ok = toAbsoluteMs(n, 1, nowMs())
+			case "EXAT":
+				when, ok = toAbsoluteMs(n, 1000, 0)
+			case "PXAT":
+				when, ok = n, true
+			}
+
+			if !ok {
+				return ErrorValue{Val: "ERR invalid expire time in 'getex' command"}
+			}
+
+			hasExpire = true
+		default:
+			return SyntaxError
+		}
+	}
+
+	value, found, errValue := lookupString(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	preventCommandPropagation()
+
+	if !found {
+		return NullValue{}
+	}
+
+	switch {
+	case hasExpire && when <= nowMs():
+		DB.Delete(key)
+		alsoPropagate(BulkStringValue{Val: "DEL"}, BulkStringValue{Val: key})
+	case hasExpire:
+		DB.SetExpire(key, when)
+		alsoPropagate(BulkStringValue{Val: "PEXPIREAT"}, BulkStringValue{Val: key}, BulkStringValue{Val: strconv.FormatInt(when, 10)})
+	case persist:
+		if DB.Persist(key) {
+			alsoPropagate(BulkStringValue{Val: "PERSIST"}, BulkStringValue{Val: key})
+		}
+	}
+
+	return BulkStringValue{Val: value}
+}
+
+func mget(args []Value, _ *Client) Value {
+	if len(args) < 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'mget' command"}
+	}
+
+	// Keys holding other types are reported as missing rather than failing the command.
+	array := make([]Value, len(args))
+	for i, arg := range args {
+		value, found, errValue := lookupString(arg.(BulkStringValue).Val)
+		if errValue != nil || !found {
+			array[i] = NullValue{}
+			continue
+		}
+
+		array[i] = BulkStringValue{Val: value}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func mset(args []Value, _ *Client) Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'mset' command"}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		DB.Set(args[i].(BulkStringValue).Val, &Object{Type: OBJ_STRING, Data: args[i+1].(BulkStringValue).Val})
+	}
+
+	return StringValue{Val: "OK"}
+}
+
+// msetnx sets all the keys only if none of them exists.
+func msetnx(args []Value, _ *Client) Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'msetnx' command"}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if DB.Exists(args[i].(BulkStringValue).Val) {
+			preventCommandPropagation()
+			return IntegerValue{Val: 0}
+		}
+	}
 
-	if _, found := SETs[key]; found {
-		delete(SETs, key)
-		return IntegerValue{Val: 1}
+	for i := 0; i < len(args); i += 2 {
+		DB.Set(args[i].(BulkStringValue).Val, &Object{Type: OBJ_STRING, Data: args[i+1].(BulkStringValue).Val})
 	}
 
-	return IntegerValue{Val: 0}
+	return IntegerValue{Val: 1}
 }
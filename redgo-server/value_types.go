@@ -9,6 +9,14 @@ const (
 	BULK_STRING = '$'
 	ARRAY       = '*'
 	NULL        = '_'
+	MAP         = '%'
+	SET         = '~'
+	DOUBLE      = ','
+	BOOLEAN     = '#'
+	BIG_NUMBER  = '('
+	VERBATIM    = '='
+	ATTRIBUTE   = '|'
+	PUSH        = '>'
 )
 
 const (
@@ -19,6 +27,14 @@ const (
 	R_ARRAY       ValueType = "array"
 	R_NULL        ValueType = "null"
 	R_EMPTY       ValueType = "empty"
+	R_MAP         ValueType = "map"
+	R_SET         ValueType = "set"
+	R_DOUBLE      ValueType = "double"
+	R_BOOLEAN     ValueType = "boolean"
+	R_BIG_NUMBER  ValueType = "big_number"
+	R_VERBATIM    ValueType = "verbatim_string"
+	R_ATTRIBUTE   ValueType = "attribute"
+	R_PUSH        ValueType = "push"
 )
 
 type Value interface {
@@ -56,10 +72,125 @@ type ArrayValue struct {
 
 func (a ArrayValue) Type() ValueType { return R_ARRAY }
 
+// NullValue is a missing value, sent as a null bulk string to RESP2 clients.
 type NullValue struct{}
 
 func (n NullValue) Type() ValueType { return R_NULL }
 
+// NullArrayValue is a missing array, like the reply of a BLPOP that timed out,
+// sent as a null array to RESP2 clients. RESP3 has a single null.
+type NullArrayValue struct{}
+
+func (n NullArrayValue) Type() ValueType { return R_NULL }
+
+// nullBulkString and nullArray are the RESP2 encodings of the nulls.
+type nullBulkString struct{}
+
+func (n nullBulkString) Type() ValueType { return R_NULL }
+
+type nullArray struct{}
+
+func (n nullArray) Type() ValueType { return R_NULL }
+
 type EmptyValue struct{}
 
 func (e EmptyValue) Type() ValueType { return R_EMPTY }
+
+// MapValue holds keys and values alternating, in the order they're replied.
+type MapValue struct {
+	Val []Value
+}
+
+func (m MapValue) Type() ValueType { return R_MAP }
+
+type SetValue struct {
+	Val []Value
+}
+
+func (s SetValue) Type() ValueType { return R_SET }
+
+type DoubleValue struct {
+	Val float64
+}
+
+func (d DoubleValue) Type() ValueType { return R_DOUBLE }
+
+type BooleanValue struct {
+	Val bool
+}
+
+func (b BooleanValue) Type() ValueType { return R_BOOLEAN }
+
+// BigNumberValue holds an integer too large for IntegerValue in base 10.
+type BigNumberValue struct {
+	Val string
+}
+
+func (b BigNumberValue) Type() ValueType { return R_BIG_NUMBER }
+
+// VerbatimStringValue is a string with a three letter format, like "txt" or "mkd".
+type VerbatimStringValue struct {
+	Format string
+	Val    string
+}
+
+func (v VerbatimStringValue) Type() ValueType { return R_VERBATIM }
+
+// AttributeValue attaches auxiliary data, keys and values alternating, to a reply.
+type AttributeValue struct {
+	Attributes []Value
+	Val        Value
+}
+
+func (a AttributeValue) Type() ValueType { return R_ATTRIBUTE }
+
+// PushValue is an out of band message, like the ones delivered to subscribers.
+type PushValue struct {
+	Val []Value
+}
+
+func (p PushValue) Type() ValueType { return R_PUSH }
+
+// toResp2 converts the RESP3 types in a value to their RESP2 equivalent, for
+// clients that didn't switch to RESP3 with HELLO.
+func toResp2(value Value) Value {
+	switch v := value.(type) {
+	case ArrayValue:
+		return ArrayValue{Val: toResp2Values(v.Val)}
+	case MapValue:
+		return ArrayValue{Val: toResp2Values(v.Val)}
+	case SetValue:
+		return ArrayValue{Val: toResp2Values(v.Val)}
+	case PushValue:
+		return ArrayValue{Val: toResp2Values(v.Val)}
+	case DoubleValue:
+		return BulkStringValue{Val: formatScore(v.Val)}
+	case BooleanValue:
+		if v.Val {
+			return IntegerValue{Val: 1}
+		}
+		return IntegerValue{Val: 0}
+	case BigNumberValue:
+		return BulkStringValue{Val: v.Val}
+	case VerbatimStringValue:
+		return BulkStringValue{Val: v.Val}
+	case NullValue:
+		return nullBulkString{}
+	case NullArrayValue:
+		return nullArray{}
+	case AttributeValue:
+		// RESP2 has no way to carry attributes, so they're dropped.
+		return toResp2(v.Val)
+	default:
+		return value
+	}
+}
+
+func toResp2Values(values []Value) []Value {
+	converted := make([]Value, len(values))
+	for i, value := range values {
+		converted[i] = toResp2(value)
+	}
+
+	return converted
+}
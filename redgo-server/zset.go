@@ -0,0 +1,1117 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	ZRANGE_RANK = iota
+	ZRANGE_SCORE
+	ZRANGE_LEX
+)
+
+const (
+	ZAGGREGATE_SUM = iota
+	ZAGGREGATE_MIN
+	ZAGGREGATE_MAX
+)
+
+// SortedSet pairs a skiplist, which keeps members ordered by score, with a map
+// from member to score for O(1) score lookups.
+type SortedSet struct {
+	dict map[string]float64
+	zsl  *Skiplist
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		dict: make(map[string]float64),
+		zsl:  NewSkiplist(),
+	}
+}
+
+func (zs *SortedSet) Len() int {
+	return len(zs.dict)
+}
+
+func (zs *SortedSet) Score(member string) (float64, bool) {
+	score, found := zs.dict[member]
+	return score, found
+}
+
+// Add inserts the member or updates its score, returning true if it was added.
+func (zs *SortedSet) Add(member string, score float64) bool {
+	current, found := zs.dict[member]
+
+	if found {
+		if current != score {
+			zs.zsl.Delete(current, member)
+			zs.zsl.Insert(score, member)
+			zs.dict[member] = score
+		}
+		return false
+	}
+
+	zs.zsl.Insert(score, member)
+	zs.dict[member] = score
+
+	return true
+}
+
+func (zs *SortedSet) Remove(member string) bool {
+	score, found := zs.dict[member]
+	if !found {
+		return false
+	}
+
+	zs.zsl.Delete(score, member)
+	delete(zs.dict, member)
+
+	return true
+}
+
+// Rank returns the 0-based rank of the member, counting from the highest
+// score when reverse is set.
+func (zs *SortedSet) Rank(member string, reverse bool) (int, bool) {
+	score, found := zs.dict[member]
+	if !found {
+		return 0, false
+	}
+
+	rank := zs.zsl.Rank(score, member)
+	if reverse {
+		return zs.Len() - rank, true
+	}
+
+	return rank - 1, true
+}
+
+// lookupZset returns the sorted set stored at key, nil if the key doesn't
+// exist, or WrongTypeError if it holds something else.
+func lookupZset(key string) (*SortedSet, Value) {
+	obj, errValue := DB.LookupType(key, OBJ_ZSET)
+	if errValue != nil || obj == nil {
+		return nil, errValue
+	}
+
+	return obj.Data.(*SortedSet), nil
+}
+
+// deleteZsetIfEmpty removes the key once its last member is gone, as empty
+// sorted sets don't exist.
+func deleteZsetIfEmpty(key string, zs *SortedSet) {
+	if zs.Len() == 0 {
+		DB.Delete(key)
+	}
+}
+
+// formatScore formats a score the way Redis replies with it.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseScore parses a score, accepting "inf", "+inf" and "-inf" but not NaN.
+func parseScore(arg Value) (float64, bool) {
+	score, err := strconv.ParseFloat(arg.(BulkStringValue).Val, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+
+	return score, true
+}
+
+// parseScoreRange parses the min and max of a score range, where a leading
+// "(" makes a bound exclusive.
+func parseScoreRange(minArg, maxArg Value) (scoreRange, bool) {
+	var r scoreRange
+	var ok bool
+
+	parseBound := func(arg string) (float64, bool, bool) {
+		exclusive := strings.HasPrefix(arg, "(")
+		if exclusive {
+			arg = arg[1:]
+		}
+
+		score, ok := parseScore(BulkStringValue{Val: arg})
+
+		return score, exclusive, ok
+	}
+
+	if r.min, r.minex, ok = parseBound(minArg.(BulkStringValue).Val); !ok {
+		return r, false
+	}
+
+	if r.max, r.maxex, ok = parseBound(maxArg.(BulkStringValue).Val); !ok {
+		return r, false
+	}
+
+	return r, true
+}
+
+// parseLexRange parses the min and max of a lex range, where each bound is
+// "-", "+", or a member prefixed by "[" (inclusive) or "(" (exclusive).
+func parseLexRange(minArg, maxArg Value) (lexRange, bool) {
+	parseBound := func(arg string) (lexBound, bool) {
+		switch {
+		case arg == "-":
+			return lexBound{inf: -1}, true
+		case arg == "+":
+			return lexBound{inf: 1}, true
+		case strings.HasPrefix(arg, "["):
+			return lexBound{value: arg[1:]}, true
+		case strings.HasPrefix(arg, "("):
+			return lexBound{value: arg[1:], exclusive: true}, true
+		}
+
+		return lexBound{}, false
+	}
+
+	min, ok := parseBound(minArg.(BulkStringValue).Val)
+	if !ok {
+		return lexRange{}, false
+	}
+
+	max, ok := parseBound(maxArg.(BulkStringValue).Val)
+	if !ok {
+		return lexRange{}, false
+	}
+
+	return lexRange{min: min, max: max}, true
+}
+
+func zadd(args []Value, _ *Client) Value {
+	if len(args) < 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'zadd' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	var nx, xx, gt, lt, ch, incr bool
+
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].(BulkStringValue).Val) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			goto pairs
+		}
+	}
+
+pairs:
+	elements := args[i:]
+
+	if len(elements) == 0 || len(elements)%2 != 0 {
+		return SyntaxError
+	}
+
+	if nx && xx {
+		return ErrorValue{Val: "ERR XX and NX options at the same time are not compatible"}
+	}
+
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		return ErrorValue{Val: "ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+
+	if incr && len(elements) > 2 {
+		return ErrorValue{Val: "ERR INCR option supports a single increment-element pair"}
+	}
+
+	// Parse every score before touching the sorted set, so the command is all or nothing.
+	scores := make([]float64, len(elements)/2)
+	for j := range scores {
+		score, ok := parseScore(elements[j*2])
+		if !ok {
+			return ErrorValue{Val: "ERR value is not a valid float"}
+		}
+		scores[j] = score
+	}
+
+	zs, errValue := lookupZset(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if zs == nil {
+		if xx {
+			preventCommandPropagation()
+
+			if incr {
+				return NullValue{}
+			}
+			return IntegerValue{Val: 0}
+		}
+
+		zs = NewSortedSet()
+		DB.Set(key, &Object{Type: OBJ_ZSET, Data: zs})
+	}
+
+	added, changed := 0, 0
+	var incrResult Value = NullValue{}
+
+	for j, score := range scores {
+		member := elements[j*2+1].(BulkStringValue).Val
+		current, found := zs.Score(member)
+
+		if (nx && found) || (xx && !found) {
+			continue
+		}
+
+		if incr {
+			score += current
+			if math.IsNaN(score) {
+				deleteZsetIfEmpty(key, zs)
+				return ErrorValue{Val: "ERR resulting score is not a number (NaN)"}
+			}
+		}
+
+		if found && ((gt && score <= current) || (lt && score >= current)) {
+			continue
+		}
+
+		if zs.Add(member, score) {
+			added++
+		} else if score != current {
+			changed++
+		}
+
+		incrResult = BulkStringValue{Val: formatScore(score)}
+	}
+
+	if added == 0 && changed == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	deleteZsetIfEmpty(key, zs)
+
+	if incr {
+		return incrResult
+	}
+
+	if ch {
+		return IntegerValue{Val: added + changed}
+	}
+
+	return IntegerValue{Val: added}
+}
+
+func zincrby(args []Value, _ *Client) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'zincrby' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+	member := args[2].(BulkStringValue).Val
+
+	increment, ok := parseScore(args[1])
+	if !ok {
+		return ErrorValue{Val: "ERR value is not a valid float"}
+	}
+
+	zs, errValue := lookupZset(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	current := 0.0
+	if zs != nil {
+		current, _ = zs.Score(member)
+	}
+
+	score := current + increment
+	if math.IsNaN(score) {
+		return ErrorValue{Val: "ERR resulting score is not a number (NaN)"}
+	}
+
+	if zs == nil {
+		zs = NewSortedSet()
+		DB.Set(key, &Object{Type: OBJ_ZSET, Data: zs})
+	}
+
+	zs.Add(member, score)
+	signalModifiedKey(key)
+
+	return BulkStringValue{Val: formatScore(score)}
+}
+
+func zrem(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'zrem' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	zs, errValue := lookupZset(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	if zs == nil {
+		preventCommandPropagation()
+		return IntegerValue{Val: 0}
+	}
+
+	removed := 0
+	for _, arg := range args[1:] {
+		if zs.Remove(arg.(BulkStringValue).Val) {
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	deleteZsetIfEmpty(key, zs)
+
+	return IntegerValue{Val: removed}
+}
+
+func zcard(args []Value, _ *Client) Value {
+	if len(args) != 1 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'zcard' command"}
+	}
+
+	zs, errValue := lookupZset(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if zs == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	return IntegerValue{Val: zs.Len()}
+}
+
+func zscore(args []Value, _ *Client) Value {
+	if len(args) != 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'zscore' command"}
+	}
+
+	zs, errValue := lookupZset(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if zs == nil {
+		return NullValue{}
+	}
+
+	score, found := zs.Score(args[1].(BulkStringValue).Val)
+	if !found {
+		return NullValue{}
+	}
+
+	return BulkStringValue{Val: formatScore(score)}
+}
+
+func zmscore(args []Value, _ *Client) Value {
+	if len(args) < 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'zmscore' command"}
+	}
+
+	zs, errValue := lookupZset(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	array := make([]Value, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if zs == nil {
+			array = append(array, NullValue{})
+			continue
+		}
+
+		if score, found := zs.Score(arg.(BulkStringValue).Val); found {
+			array = append(array, BulkStringValue{Val: formatScore(score)})
+		} else {
+			array = append(array, NullValue{})
+		}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+func zrank(args []Value, _ *Client) Value {
+	return zrankGeneric(args, "zrank", false)
+}
+
+func zrevrank(args []Value, _ *Client) Value {
+	return zrankGeneric(args, "zrevrank", true)
+}
+
+func zrankGeneric(args []Value, name string, reverse bool) Value {
+	if len(args) < 2 || len(args) > 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	withScore := false
+	if len(args) == 3 {
+		if strings.ToUpper(args[2].(BulkStringValue).Val) != "WITHSCORE" {
+			return SyntaxError
+		}
+		withScore = true
+	}
+
+	zs, errValue := lookupZset(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	// A missing member is a null array when an array is asked for.
+	var null Value = NullValue{}
+	if withScore {
+		null = NullArrayValue{}
+	}
+
+	if zs == nil {
+		return null
+	}
+
+	member := args[1].(BulkStringValue).Val
+
+	rank, found := zs.Rank(member, reverse)
+	if !found {
+		return null
+	}
+
+	if withScore {
+		score, _ := zs.Score(member)
+		return ArrayValue{Val: []Value{IntegerValue{Val: rank}, BulkStringValue{Val: formatScore(score)}}}
+	}
+
+	return IntegerValue{Val: rank}
+}
+
+// zrangeSpec describes the range requested by ZRANGE and its legacy variants.
+type zrangeSpec struct {
+	rangeType  int
+	min, max   Value
+	reverse    bool
+	offset     int
+	count      int
+	withScores bool
+}
+
+// zrangeNodes returns the nodes of the sorted set within the range, in reply order.
+func zrangeNodes(zs *SortedSet, spec zrangeSpec) ([]*skiplistNode, Value) {
+	nodes := []*skiplistNode{}
+
+	switch spec.rangeType {
+	case ZRANGE_RANK:
+		start, err := strconv.Atoi(spec.min.(BulkStringValue).Val)
+		if err != nil {
+			return nil, NotIntegerError
+		}
+
+		stop, err := strconv.Atoi(spec.max.(BulkStringValue).Val)
+		if err != nil {
+			return nil, NotIntegerError
+		}
+
+		if zs == nil {
+			return nodes, nil
+		}
+
+		length := zs.Len()
+		if start < 0 {
+			start += length
+		}
+		if stop < 0 {
+			stop += length
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= length {
+			stop = length - 1
+		}
+
+		if start > stop || start >= length {
+			return nodes, nil
+		}
+
+		var node *skiplistNode
+		if spec.reverse {
+			node = zs.zsl.ByRank(length - start)
+		} else {
+			node = zs.zsl.ByRank(start + 1)
+		}
+
+		for i := start; i <= stop && node != nil; i++ {
+			nodes = append(nodes, node)
+
+			if spec.reverse {
+				node = node.Prev()
+			} else {
+				node = node.Next()
+			}
+		}
+
+		return nodes, nil
+	case ZRANGE_SCORE:
+		// The REV form takes the max first, so min and max are already swapped back by the caller.
+		r, ok := parseScoreRange(spec.min, spec.max)
+		if !ok {
+			return nil, ErrorValue{Val: "ERR min or max is not a float"}
+		}
+
+		if zs == nil {
+			return nodes, nil
+		}
+
+		var node *skiplistNode
+		if spec.reverse {
+			node = zs.zsl.LastInScoreRange(r)
+		} else {
+			node = zs.zsl.FirstInScoreRange(r)
+		}
+
+		return collectRangeNodes(node, spec, func(n *skiplistNode) bool {
+			if spec.reverse {
+				return r.gteMin(n.score)
+			}
+			return r.lteMax(n.score)
+		}), nil
+	case ZRANGE_LEX:
+		r, ok := parseLexRange(spec.min, spec.max)
+		if !ok {
+			return nil, ErrorValue{Val: "ERR min or max not valid string range item"}
+		}
+
+		if zs == nil {
+			return nodes, nil
+		}
+
+		var node *skiplistNode
+		if spec.reverse {
+			node = zs.zsl.LastInLexRange(r)
+		} else {
+			node = zs.zsl.FirstInLexRange(r)
+		}
+
+		return collectRangeNodes(node, spec, func(n *skiplistNode) bool {
+			if spec.reverse {
+				return r.gteMin(n.member)
+			}
+			return r.lteMax(n.member)
+		}), nil
+	}
+
+	return nodes, nil
+}
+
+// collectRangeNodes walks from node while inRange holds, applying the LIMIT
+// offset and count of the spec. A negative count means no limit.
+func collectRangeNodes(node *skiplistNode, spec zrangeSpec, inRange func(*skiplistNode) bool) []*skiplistNode {
+	nodes := []*skiplistNode{}
+
+	for offset := spec.offset; node != nil && offset > 0 && inRange(node); offset-- {
+		if spec.reverse {
+			node = node.Prev()
+		} else {
+			node = node.Next()
+		}
+	}
+
+	for node != nil && spec.count != 0 && inRange(node) {
+		nodes = append(nodes, node)
+		spec.count--
+
+		if spec.reverse {
+			node = node.Prev()
+		} else {
+			node = node.Next()
+		}
+	}
+
+	return nodes
+}
+
+func zrangeReply(nodes []*skiplistNode, withScores bool) Value {
+	array := make([]Value, 0, len(nodes))
+
+	for _, node := range nodes {
+		array = append(array, BulkStringValue{Val: node.member})
+
+		if withScores {
+			array = append(array, BulkStringValue{Val: formatScore(node.score)})
+		}
+	}
+
+	return ArrayValue{Val: array}
+}
+
+// zrangeGeneric runs the range on the sorted set at key and builds the reply.
+func zrangeGeneric(key string, spec zrangeSpec) Value {
+	zs, errValue := lookupZset(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	nodes, errValue := zrangeNodes(zs, spec)
+	if errValue != nil {
+		return errValue
+	}
+
+	return zrangeReply(nodes, spec.withScores)
+}
+
+// parseZrangeOptions parses the trailing [WITHSCORES] [LIMIT offset count]
+// options. allowRangeType also accepts BYSCORE, BYLEX and REV, as ZRANGE does.
+func parseZrangeOptions(args []Value, spec *zrangeSpec, allowRangeType bool) Value {
+	hasLimit := false
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].(BulkStringValue).Val)
+
+		switch {
+		case option == "WITHSCORES":
+			spec.withScores = true
+		case option == "LIMIT" && i+2 < len(args):
+			offset, err := strconv.Atoi(args[i+1].(BulkStringValue).Val)
+			if err != nil {
+				return NotIntegerError
+			}
+
+			count, err := strconv.Atoi(args[i+2].(BulkStringValue).Val)
+			if err != nil {
+				return NotIntegerError
+			}
+
+			spec.offset, spec.count = offset, count
+			hasLimit = true
+			i += 2
+		case allowRangeType && option == "BYSCORE":
+			spec.rangeType = ZRANGE_SCORE
+		case allowRangeType && option == "BYLEX":
+			spec.rangeType = ZRANGE_LEX
+		case allowRangeType && option == "REV":
+			spec.reverse = true
+		default:
+			return SyntaxError
+		}
+	}
+
+	if hasLimit && spec.rangeType == ZRANGE_RANK {
+		return ErrorValue{Val: "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"}
+	}
+
+	if spec.withScores && spec.rangeType == ZRANGE_LEX {
+		return ErrorValue{Val: "ERR syntax error, WITHSCORES not supported in combination with BYLEX"}
+	}
+
+	// A negative offset returns nothing, like in Redis.
+	if spec.offset < 0 {
+		spec.count = 0
+	}
+
+	return nil
+}
+
+func zrange(args []Value, _ *Client) Value {
+	if len(args) < 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for 'zrange' command"}
+	}
+
+	spec := zrangeSpec{rangeType: ZRANGE_RANK, min: args[1], max: args[2], count: -1}
+
+	if errValue := parseZrangeOptions(args[3:], &spec, true); errValue != nil {
+		return errValue
+	}
+
+	// With REV, the score and lex forms take the max before the min.
+	if spec.reverse && spec.rangeType != ZRANGE_RANK {
+		spec.min, spec.max = spec.max, spec.min
+	}
+
+	return zrangeGeneric(args[0].(BulkStringValue).Val, spec)
+}
+
+func zrevrange(args []Value, _ *Client) Value {
+	return legacyZrangeCommand(args, "zrevrange", ZRANGE_RANK, true)
+}
+
+func zrangebyscore(args []Value, _ *Client) Value {
+	return legacyZrangeCommand(args, "zrangebyscore", ZRANGE_SCORE, false)
+}
+
+func zrevrangebyscore(args []Value, _ *Client) Value {
+	return legacyZrangeCommand(args, "zrevrangebyscore", ZRANGE_SCORE, true)
+}
+
+func zrangebylex(args []Value, _ *Client) Value {
+	return legacyZrangeCommand(args, "zrangebylex", ZRANGE_LEX, false)
+}
+
+func zrevrangebylex(args []Value, _ *Client) Value {
+	return legacyZrangeCommand(args, "zrevrangebylex", ZRANGE_LEX, true)
+}
+
+// legacyZrangeCommand implements the commands ZRANGE superseded, which fix the
+// range type and direction in their name.
+func legacyZrangeCommand(args []Value, name string, rangeType int, reverse bool) Value {
+	if len(args) < 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	spec := zrangeSpec{rangeType: rangeType, min: args[1], max: args[2], reverse: reverse, count: -1}
+
+	if errValue := parseZrangeOptions(args[3:], &spec, false); errValue != nil {
+		return errValue
+	}
+
+	if reverse && rangeType != ZRANGE_RANK {
+		spec.min, spec.max = spec.max, spec.min
+	}
+
+	return zrangeGeneric(args[0].(BulkStringValue).Val, spec)
+}
+
+func zcount(args []Value, _ *Client) Value {
+	return zcountGeneric(args, "zcount", ZRANGE_SCORE)
+}
+
+func zlexcount(args []Value, _ *Client) Value {
+	return zcountGeneric(args, "zlexcount", ZRANGE_LEX)
+}
+
+// zcountGeneric implements ZCOUNT and ZLEXCOUNT by subtracting the ranks of
+// the first and last nodes in range, so it doesn't walk the range.
+func zcountGeneric(args []Value, name string, rangeType int) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	var first, last func(*SortedSet) *skiplistNode
+
+	if rangeType == ZRANGE_SCORE {
+		r, ok := parseScoreRange(args[1], args[2])
+		if !ok {
+			return ErrorValue{Val: "ERR min or max is not a float"}
+		}
+
+		first = func(zs *SortedSet) *skiplistNode { return zs.zsl.FirstInScoreRange(r) }
+		last = func(zs *SortedSet) *skiplistNode { return zs.zsl.LastInScoreRange(r) }
+	} else {
+		r, ok := parseLexRange(args[1], args[2])
+		if !ok {
+			return ErrorValue{Val: "ERR min or max not valid string range item"}
+		}
+
+		first = func(zs *SortedSet) *skiplistNode { return zs.zsl.FirstInLexRange(r) }
+		last = func(zs *SortedSet) *skiplistNode { return zs.zsl.LastInLexRange(r) }
+	}
+
+	zs, errValue := lookupZset(args[0].(BulkStringValue).Val)
+	if errValue != nil {
+		return errValue
+	}
+
+	if zs == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	firstNode := first(zs)
+	if firstNode == nil {
+		return IntegerValue{Val: 0}
+	}
+
+	lastNode := last(zs)
+
+	return IntegerValue{Val: zs.zsl.Rank(lastNode.score, lastNode.member) - zs.zsl.Rank(firstNode.score, firstNode.member) + 1}
+}
+
+func zremrangebyrank(args []Value, _ *Client) Value {
+	return zremrangeGeneric(args, "zremrangebyrank", ZRANGE_RANK)
+}
+
+func zremrangebyscore(args []Value, _ *Client) Value {
+	return zremrangeGeneric(args, "zremrangebyscore", ZRANGE_SCORE)
+}
+
+func zremrangebylex(args []Value, _ *Client) Value {
+	return zremrangeGeneric(args, "zremrangebylex", ZRANGE_LEX)
+}
+
+func zremrangeGeneric(args []Value, name string, rangeType int) Value {
+	if len(args) != 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	zs, errValue := lookupZset(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	nodes, errValue := zrangeNodes(zs, zrangeSpec{rangeType: rangeType, min: args[1], max: args[2], count: -1})
+	if errValue != nil {
+		return errValue
+	}
+
+	if len(nodes) == 0 {
+		preventCommandPropagation()
+	} else {
+		signalModifiedKey(key)
+	}
+
+	for _, node := range nodes {
+		zs.Remove(node.member)
+	}
+
+	if zs != nil {
+		deleteZsetIfEmpty(key, zs)
+	}
+
+	return IntegerValue{Val: len(nodes)}
+}
+
+func zpopmin(args []Value, _ *Client) Value {
+	return zpopGeneric(args, "zpopmin", false)
+}
+
+func zpopmax(args []Value, _ *Client) Value {
+	return zpopGeneric(args, "zpopmax", true)
+}
+
+// zpopGeneric implements ZPOPMIN and ZPOPMAX, replying with a flat array of
+// members and scores.
+func zpopGeneric(args []Value, name string, max bool) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].(BulkStringValue).Val
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+		if err != nil || n < 0 {
+			return ErrorValue{Val: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	zs, errValue := lookupZset(key)
+	if errValue != nil {
+		return errValue
+	}
+
+	array := []Value{}
+	if zs == nil || count == 0 {
+		preventCommandPropagation()
+		return ArrayValue{Val: array}
+	}
+
+	for ; count > 0 && zs.Len() > 0; count-- {
+		node := zs.zsl.First()
+		if max {
+			node = zs.zsl.Last()
+		}
+
+		array = append(array, BulkStringValue{Val: node.member}, BulkStringValue{Val: formatScore(node.score)})
+		zs.Remove(node.member)
+	}
+
+	signalModifiedKey(key)
+	deleteZsetIfEmpty(key, zs)
+
+	return ArrayValue{Val: array}
+}
+
+// zstoreKeys returns the keys of ZUNIONSTORE and ZINTERSTORE: the destination
+// followed by numkeys source keys.
+func zstoreKeys(argv []Value) []string {
+	return append([]string{argv[1].(BulkStringValue).Val}, keysAfterNumkeys(argv, 2)...)
+}
+
+func zunionstore(args []Value, _ *Client) Value {
+	return zsetOperationStore(args, "zunionstore", SET_OP_UNION)
+}
+
+func zinterstore(args []Value, _ *Client) Value {
+	return zsetOperationStore(args, "zinterstore", SET_OP_INTER)
+}
+
+// zsetOperationStore implements ZUNIONSTORE and ZINTERSTORE. Plain sets are
+// accepted as inputs, their members having a score of 1.
+func zsetOperationStore(args []Value, name string, op int) Value {
+	if len(args) < 3 {
+		return ErrorValue{Val: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	destination := args[0].(BulkStringValue).Val
+
+	numkeys, err := strconv.Atoi(args[1].(BulkStringValue).Val)
+	if err != nil {
+		return NotIntegerError
+	}
+
+	if numkeys <= 0 {
+		return ErrorValue{Val: "ERR at least 1 input key is needed for '" + name + "' command"}
+	}
+
+	if len(args) < numkeys+2 {
+		return SyntaxError
+	}
+
+	keys := keysFromArgs(args[2 : numkeys+2])
+
+	weights := make([]float64, numkeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+
+	aggregate := ZAGGREGATE_SUM
+
+	rest := args[numkeys+2:]
+	for i := 0; i < len(rest); i++ {
+		switch strings.ToUpper(rest[i].(BulkStringValue).Val) {
+		case "WEIGHTS":
+			if i+numkeys >= len(rest) {
+				return SyntaxError
+			}
+
+			for j := range weights {
+				weight, ok := parseScore(rest[i+1+j])
+				if !ok {
+					return ErrorValue{Val: "ERR weight value is not a float"}
+				}
+				weights[j] = weight
+			}
+
+			i += numkeys
+		case "AGGREGATE":
+			if i+1 >= len(rest) {
+				return SyntaxError
+			}
+
+			switch strings.ToUpper(rest[i+1].(BulkStringValue).Val) {
+			case "SUM":
+				aggregate = ZAGGREGATE_SUM
+			case "MIN":
+				aggregate = ZAGGREGATE_MIN
+			case "MAX":
+				aggregate = ZAGGREGATE_MAX
+			default:
+				return SyntaxError
+			}
+
+			i++
+		default:
+			return SyntaxError
+		}
+	}
+
+	// Collect every input as a member to score map, sets scoring 1.
+	inputs := make([]map[string]float64, numkeys)
+	for i, key := range keys {
+		obj := DB.Lookup(key)
+
+		switch {
+		case obj == nil:
+			inputs[i] = map[string]float64{}
+		case obj.Type == OBJ_ZSET:
+			inputs[i] = obj.Data.(*SortedSet).dict
+		case obj.Type == OBJ_SET:
+			scores := make(map[string]float64, len(obj.Data.(map[string]struct{})))
+			for member := range obj.Data.(map[string]struct{}) {
+				scores[member] = 1
+			}
+			inputs[i] = scores
+		default:
+			return WrongTypeError
+		}
+	}
+
+	result := NewSortedSet()
+	accumulated := make(map[string]float64)
+
+	for i, input := range inputs {
+		for member, score := range input {
+			score = weightedScore(score, weights[i])
+
+			if current, found := accumulated[member]; found {
+				accumulated[member] = aggregateScores(current, score, aggregate)
+			} else if op == SET_OP_UNION || i == 0 {
+				accumulated[member] = score
+			}
+		}
+
+		// An intersection only keeps the members present in every input so far.
+		if op == SET_OP_INTER && i > 0 {
+			for member := range accumulated {
+				if _, found := input[member]; !found {
+					delete(accumulated, member)
+				}
+			}
+		}
+	}
+
+	for member, score := range accumulated {
+		result.Add(member, score)
+	}
+
+	if result.Len() == 0 {
+		if !DB.Delete(destination) {
+			preventCommandPropagation()
+		}
+	} else {
+		DB.Set(destination, &Object{Type: OBJ_ZSET, Data: result})
+	}
+
+	return IntegerValue{Val: result.Len()}
+}
+
+// weightedScore multiplies a score by its weight, treating inf * 0 as 0 rather than NaN.
+func weightedScore(score, weight float64) float64 {
+	result := score * weight
+	if math.IsNaN(result) {
+		return 0
+	}
+
+	return result
+}
+
+func aggregateScores(a, b float64, aggregate int) float64 {
+	switch aggregate {
+	case ZAGGREGATE_MIN:
+		return math.Min(a, b)
+	case ZAGGREGATE_MAX:
+		return math.Max(a, b)
+	}
+
+	// inf + -inf is NaN, which Redis turns into 0.
+	sum := a + b
+	if math.IsNaN(sum) {
+		return 0
+	}
+
+	return sum
+}